@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/AchievementNetwork/vasco/logger"
+	"github.com/AchievementNetwork/vasco/registry"
+	"github.com/AchievementNetwork/vasco/tracing"
+)
+
+// Logging is configured from the environment:
+//
+//	LOG_FORMAT  logfmt (the default) or json
+//	LOG_LEVEL   debug, info (the default), warn or error
+//	LOG_ACCESS  false turns off the access log
+//
+// Everything is written to stderr. There are four logs, told apart by their
+// "log" field: access (one line per request), registry (registrations coming
+// and going), cache (persistence and redis connection trouble) and vasco
+// (everything else, including anything written with the standard log
+// package).
+var (
+	accessLog   = logger.Named("access")
+	registryLog = logger.Named("registry")
+	vascoLog    = logger.Named("vasco")
+
+	// accessLogging is turned off by LOG_ACCESS=false
+	accessLogging = true
+)
+
+// configureLogging sets up the logger from the environment, and sends the
+// standard log package through it.
+func configureLogging() error {
+	level, err := logger.ParseLevel(getEnvWithDefault("LOG_LEVEL", "info"))
+	if err != nil {
+		return err
+	}
+	if err := logger.Configure(os.Stderr, getEnvWithDefault("LOG_FORMAT", logger.FormatLogfmt), level); err != nil {
+		return err
+	}
+	if on, err := strconv.ParseBool(getEnvWithDefault("LOG_ACCESS", "true")); err == nil {
+		accessLogging = on
+	}
+	log.SetFlags(0)
+	log.SetOutput(logger.Writer(vascoLog, logger.InfoLevel))
+	return nil
+}
+
+// fatal logs an error that vasco can't run with, and exits
+func fatal(msg string, kv ...interface{}) {
+	vascoLog.Error(msg, kv...)
+	os.Exit(1)
+}
+
+// responseRecorder remembers the status and size of a response
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func newResponseRecorder(rw http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: rw, status: http.StatusOK}
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// Flush lets the reverse proxy flush streamed responses through the recorder
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// clientIP is the address the request came from, without the port; for
+// proxied requests it's worked out (allowing for trusted proxies) up front.
+func clientIP(req *http.Request) string {
+	if ip, ok := req.Context().Value(clientIPKey).(string); ok {
+		return ip
+	}
+	return remoteIP(req)
+}
+
+// proxyRoute is where the proxy decided to send a request; it's carried in
+// the request's context from ServeHTTP to the director and the access log.
+type proxyRoute struct {
+	reg  *registry.Registration
+	url  *url.URL
+	vars map[string]string // for the registration's header rules
+}
+
+type contextKey int
+
+const (
+	routeKey contextKey = iota
+	requestIDKey
+	clientIPKey
+)
+
+func withRoute(req *http.Request, route *proxyRoute) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), routeKey, route))
+}
+
+func routeFrom(req *http.Request) *proxyRoute {
+	route, _ := req.Context().Value(routeKey).(*proxyRoute)
+	return route
+}
+
+// logAccess writes the access log line for a request
+func logAccess(server string, req *http.Request, rec *responseRecorder, start time.Time, route *proxyRoute) {
+	if !accessLogging {
+		return
+	}
+	fields := []interface{}{
+		"server", server,
+		"method", req.Method,
+		"path", req.URL.Path,
+		"status", rec.status,
+		"bytes", rec.bytes,
+		"latency_ms", float64(time.Since(start)/time.Microsecond) / 1000,
+		"client", clientIP(req),
+	}
+	if id := requestIDFrom(req); id != "" {
+		fields = append(fields, "request_id", id)
+	}
+	if span := tracing.SpanFromContext(req.Context()); span != nil {
+		fields = append(fields, "trace_id", span.SpanContext().TraceID.String())
+	}
+	if route != nil {
+		fields = append(fields, "registration", route.reg.Name, "hash", route.reg.Hash(), "upstream", route.url.String())
+	}
+	accessLog.Info("request", fields...)
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AchievementNetwork/go-util/util"
+	"github.com/AchievementNetwork/vasco/registry"
+)
+
+// Alerts are sent to webhooks when a service changes state between status
+// updates. The webhooks come from the environment:
+//
+//	ALERT_WEBHOOKS  space-separated format:url entries, where format is json
+//	                (a generic JSON POST) or slack (an incoming webhook)
+//	ALERT_DEBOUNCE  seconds; after an alert about an instance, later changes
+//	                to it are held this long, and dropped if it changes back
+//	                (default 60)
+//
+// To try it out without an external service, point a json webhook at the
+// /alerts/sink endpoint on the status port and GET it to see what was sent.
+
+// Alert events
+const (
+	AlertDown       = "down"       // an instance stopped working
+	AlertUp         = "up"         // an instance started working again
+	AlertMissing    = "missing"    // an expected service disappeared
+	AlertPresent    = "present"    // an expected service that was missing is back
+	AlertUnexpected = "unexpected" // a service we weren't expecting appeared
+	AlertTest       = "test"       // sent by /alerts/test
+)
+
+// Alert describes one state transition.
+type Alert struct {
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	Name    string    `json:"name"`
+	Address string    `json:"address,omitempty"`
+	From    string    `json:"from,omitempty"`
+	To      string    `json:"to,omitempty"`
+	Message string    `json:"message"`
+}
+
+// Notifier sends alerts somewhere.
+type Notifier interface {
+	Notify(alerts []Alert) error
+	String() string
+}
+
+// webhookNotifier POSTs alerts to a URL, either as {"alerts": [...]} or in
+// the form a Slack incoming webhook expects.
+type webhookNotifier struct {
+	format string
+	url    string
+	client *http.Client
+}
+
+func newWebhookNotifier(format string, url string) (*webhookNotifier, error) {
+	if format != "json" && format != "slack" {
+		return nil, fmt.Errorf("unknown webhook format '%s' (should be json or slack)", format)
+	}
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("webhook URL '%s' should be http or https", url)
+	}
+	return &webhookNotifier{
+		format: format,
+		url:    url,
+		client: &http.Client{Timeout: 5 * time.Second},
+	}, nil
+}
+
+func (w *webhookNotifier) String() string {
+	return w.format + ":" + w.url
+}
+
+func (w *webhookNotifier) Notify(alerts []Alert) error {
+	var payload interface{} = map[string][]Alert{"alerts": alerts}
+	if w.format == "slack" {
+		lines := make([]string, 0, len(alerts))
+		for _, alert := range alerts {
+			lines = append(lines, alert.Message)
+		}
+		payload = map[string]string{"text": strings.Join(lines, "\n")}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %d", w.url, resp.StatusCode)
+	}
+	return nil
+}
+
+// instance keys are name and address; a missing service has no address
+func alertKey(name string, address string) string {
+	return name + " " + address
+}
+
+// debounceKey groups the alerts that can cancel each other out: missing and
+// present are about the service, the rest are about an instance
+func (alert Alert) debounceKey() string {
+	if alert.Event == AlertMissing || alert.Event == AlertPresent {
+		return alertKey(alert.Name, "")
+	}
+	return alertKey(alert.Name, alert.Address)
+}
+
+type alerted struct {
+	state string
+	at    time.Time
+}
+
+// Alerter watches successive status blocks for transitions and sends alerts
+// about them.
+type Alerter struct {
+	notifiers []Notifier
+	debounce  time.Duration
+	mutex     sync.Mutex
+	last      map[string]string  // the state of each instance at the last update
+	alerted   map[string]alerted // the last alert we sent for each instance
+	pending   map[string]Alert   // alerts held back by debouncing
+	timer     *time.Timer        // sends pending alerts when their debounce window ends
+	send      func(n Notifier, alerts []Alert)
+	after     func(d time.Duration, f func()) *time.Timer
+}
+
+func NewAlerter(notifiers []Notifier, debounce time.Duration) *Alerter {
+	a := &Alerter{
+		notifiers: notifiers,
+		debounce:  debounce,
+		alerted:   make(map[string]alerted),
+		pending:   make(map[string]Alert),
+		after:     time.AfterFunc,
+	}
+	a.send = func(n Notifier, alerts []Alert) {
+		go func() {
+			if err := n.Notify(alerts); err != nil {
+				vascoLog.Warn("alert failed", "notifier", n.String(), "err", err)
+			}
+		}()
+	}
+	return a
+}
+
+// loadAlerter builds an Alerter from the environment.
+func loadAlerter() (*Alerter, error) {
+	notifiers := make([]Notifier, 0)
+	for _, entry := range strings.Fields(getEnvWithDefault("ALERT_WEBHOOKS", "")) {
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("ALERT_WEBHOOKS entries look like format:url, not '%s'", entry)
+		}
+		n, err := newWebhookNotifier(parts[0], parts[1])
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, n)
+	}
+	debounce, err := strconv.Atoi(getEnvWithDefault("ALERT_DEBOUNCE", "60"))
+	if err != nil || debounce < 0 {
+		return nil, fmt.Errorf("ALERT_DEBOUNCE must be a number of seconds")
+	}
+	return NewAlerter(notifiers, time.Duration(debounce)*time.Second), nil
+}
+
+// healthy is whether a state counts as working, for the purposes of alerting
+func healthy(state string) bool {
+	return state == "up"
+}
+
+// Observe compares a status block with the previous one and alerts on the
+// differences. The first block it sees is just remembered.
+func (a *Alerter) Observe(block registry.StatusBlock, now time.Time) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	current := make(map[string]string)
+	alerts := make([]Alert, 0)
+	for _, item := range block {
+		name, address := item.Get("Name"), item.Get("Address")
+		if name == "" || name == "vasco" {
+			continue
+		}
+		state := item.State()
+		key := alertKey(name, address)
+		current[key] = state
+		if a.last == nil {
+			continue
+		}
+
+		prev, seen := a.last[key]
+		switch {
+		case state == "missing" && prev != "missing":
+			alerts = append(alerts, Alert{Event: AlertMissing, Name: name, To: state,
+				Message: fmt.Sprintf("Expected service %s is missing.", name)})
+		case !seen && state != "missing" && a.last[alertKey(name, "")] == "missing":
+			alerts = append(alerts, Alert{Event: AlertPresent, Name: name, Address: address, From: "missing", To: state,
+				Message: fmt.Sprintf("Expected service %s is present again at %s (%s).", name, address, state)})
+		case !seen:
+			if unexpected, _ := item["unexpected"].(bool); unexpected {
+				alerts = append(alerts, Alert{Event: AlertUnexpected, Name: name, Address: address, To: state,
+					Message: fmt.Sprintf("Unexpected service %s appeared at %s.", name, address)})
+			}
+		case healthy(prev) && !healthy(state):
+			alerts = append(alerts, Alert{Event: AlertDown, Name: name, Address: address, From: prev, To: state,
+				Message: fmt.Sprintf("%s at %s is %s.", name, address, state)})
+		case !healthy(prev) && healthy(state):
+			alerts = append(alerts, Alert{Event: AlertUp, Name: name, Address: address, From: prev, To: state,
+				Message: fmt.Sprintf("%s at %s is up again.", name, address)})
+		}
+	}
+	a.last = current
+
+	for _, alert := range alerts {
+		alert.Time = now.UTC()
+		a.debounceAlert(alert, now)
+	}
+	a.flush(now)
+}
+
+// debounceAlert queues an alert; if we alerted about the same instance
+// recently, it replaces anything already waiting, and if the instance is
+// back where it was when we last alerted, nothing is waiting any more.
+func (a *Alerter) debounceAlert(alert Alert, now time.Time) {
+	key := alert.debounceKey()
+	last, ok := a.alerted[key]
+	if ok && now.Sub(last.at) < a.debounce && last.state == alert.To {
+		delete(a.pending, key)
+		return
+	}
+	a.pending[key] = alert
+}
+
+// flush sends every pending alert that's outside its debounce window.
+func (a *Alerter) flush(now time.Time) {
+	due := make([]Alert, 0)
+	for key, alert := range a.pending {
+		if last, ok := a.alerted[key]; ok && now.Sub(last.at) < a.debounce {
+			continue
+		}
+		due = append(due, alert)
+		a.alerted[key] = alerted{state: alert.To, at: now}
+		delete(a.pending, key)
+	}
+	a.scheduleFlush(now)
+	if len(due) == 0 {
+		return
+	}
+	sort.Sort(byAlertTime(due))
+	for _, alert := range due {
+		vascoLog.Info("alert", "event", alert.Event, "message", alert.Message)
+	}
+	for _, n := range a.notifiers {
+		a.send(n, due)
+	}
+}
+
+// scheduleFlush sets the timer for the end of the first pending alert's
+// debounce window, so that it's sent then rather than at the next status
+// update (which might be a long time coming).
+func (a *Alerter) scheduleFlush(now time.Time) {
+	if a.timer != nil {
+		a.timer.Stop()
+		a.timer = nil
+	}
+	var due time.Time
+	for key := range a.pending {
+		if at := a.alerted[key].at.Add(a.debounce); due.IsZero() || at.Before(due) {
+			due = at
+		}
+	}
+	if due.IsZero() {
+		return
+	}
+	a.timer = a.after(due.Sub(now), func() {
+		a.mutex.Lock()
+		defer a.mutex.Unlock()
+		a.flush(due)
+	})
+}
+
+// Test sends a test alert to every notifier and reports what happened.
+func (a *Alerter) Test(now time.Time) map[string]string {
+	results := make(map[string]string)
+	alert := []Alert{{Time: now.UTC(), Event: AlertTest, Name: "vasco", Message: "This is a test alert from Vasco."}}
+	for _, n := range a.notifiers {
+		if err := n.Notify(alert); err != nil {
+			results[n.String()] = err.Error()
+		} else {
+			results[n.String()] = "ok"
+		}
+	}
+	return results
+}
+
+type byAlertTime []Alert
+
+func (s byAlertTime) Len() int      { return len(s) }
+func (s byAlertTime) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byAlertTime) Less(i, j int) bool {
+	if !s[i].Time.Equal(s[j].Time) {
+		return s[i].Time.Before(s[j].Time)
+	}
+	return s[i].Name+s[i].Address < s[j].Name+s[j].Address
+}
+
+// alertSink remembers the most recent alerts POSTed to it.
+type alertSink struct {
+	mutex  sync.Mutex
+	alerts []Alert
+}
+
+const alertSinkSize = 100
+
+func (s *alertSink) receive(rw http.ResponseWriter, req *http.Request) {
+	var payload struct {
+		Alerts []Alert `json:"alerts"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+		util.WriteNewWebError(rw, http.StatusBadRequest, "VAS-108", err.Error())
+		return
+	}
+	s.mutex.Lock()
+	s.alerts = append(s.alerts, payload.Alerts...)
+	if len(s.alerts) > alertSinkSize {
+		s.alerts = s.alerts[len(s.alerts)-alertSinkSize:]
+	}
+	s.mutex.Unlock()
+}
+
+func (s *alertSink) list(rw http.ResponseWriter, req *http.Request) {
+	s.mutex.Lock()
+	alerts := append([]Alert{}, s.alerts...)
+	s.mutex.Unlock()
+	util.WriteJSONPretty(rw, alerts)
+}
@@ -0,0 +1,68 @@
+package cache
+
+import "time"
+
+// Batch queues a group of writes that are applied atomically by Exec: either
+// all of them happen or none do, and no reader sees some of them without the
+// others. Each method returns the batch so that calls can be chained.
+// Operations that have nothing to do (deleting a missing key, removing from
+// a missing set) are not errors inside a batch.
+type Batch interface {
+	Set(key string, value string) Batch
+	SetWithExpiry(key string, value string, seconds int) Batch
+	Delete(key string) Batch
+	Expire(key string, seconds int) Batch
+	SAdd(key string, values ...string) Batch
+	SRemove(key string, values ...string) Batch
+	Exec() error
+}
+
+// opBatch is the Batch used by all of our caches: it records each write as
+// an operation and hands the list to the cache's exec function. Relative
+// expirations are converted to absolute times when they're queued.
+type opBatch struct {
+	ops  []operation
+	exec func(ops []operation) error
+}
+
+func newBatch(exec func(ops []operation) error) *opBatch {
+	return &opBatch{exec: exec}
+}
+
+func (b *opBatch) add(op operation) Batch {
+	b.ops = append(b.ops, op)
+	return b
+}
+
+func (b *opBatch) Set(key string, value string) Batch {
+	return b.add(operation{Op: "set", Key: key, Value: value})
+}
+
+func (b *opBatch) SetWithExpiry(key string, value string, seconds int) Batch {
+	exptime := time.Time.Unix(time.Now()) + int64(seconds)
+	return b.add(operation{Op: "set", Key: key, Value: value, Exp: exptime})
+}
+
+func (b *opBatch) Delete(key string) Batch {
+	return b.add(operation{Op: "del", Key: key})
+}
+
+func (b *opBatch) Expire(key string, seconds int) Batch {
+	exptime := time.Time.Unix(time.Now()) + int64(seconds)
+	return b.add(operation{Op: "expireat", Key: key, Exp: exptime})
+}
+
+func (b *opBatch) SAdd(key string, values ...string) Batch {
+	return b.add(operation{Op: "sadd", Key: key, Values: values})
+}
+
+func (b *opBatch) SRemove(key string, values ...string) Batch {
+	return b.add(operation{Op: "srem", Key: key, Values: values})
+}
+
+func (b *opBatch) Exec() error {
+	if len(b.ops) == 0 {
+		return nil
+	}
+	return b.exec(b.ops)
+}
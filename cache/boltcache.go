@@ -0,0 +1,508 @@
+package cache
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// an implementation of the Cache that keeps everything in an embedded
+// on-disk bolt database -- good for a single server that needs its data to
+// survive a restart without running redis.
+//
+// Plain values live in the "values" bucket, prefixed with an 8-byte expiration
+// time (0 means it never expires). Each set is a nested bucket of "sets" whose
+// keys are the members. Each sorted set is a nested bucket of "zsets" with two
+// buckets inside it: "members" maps a member to its score, and "index" holds
+// score+member keys so that bolt's byte ordering gives us the members in
+// score order.
+//
+// Expired values are deleted when a write transaction comes across them, and
+// every boltPurgeInterval a purge deletes the rest, so that keys nobody looks
+// at again don't stay in the file forever.
+type BoltCache struct {
+	db   *bolt.DB
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+const boltPurgeInterval = time.Minute
+
+var (
+	boltValues  = []byte("values")
+	boltSets    = []byte("sets")
+	boltZSets   = []byte("zsets")
+	boltMembers = []byte("members")
+	boltIndex   = []byte("index")
+)
+
+func NewBoltCache(path string) (*BoltCache, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltValues, boltSets, boltZSets} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	c := &BoltCache{db: db, done: make(chan struct{})}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		ticker := time.NewTicker(boltPurgeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				if _, err := c.purge(time.Time.Unix(now)); err != nil {
+					events.Error("bolt cache purge failed", "path", c.db.Path(), "err", err)
+				}
+			case <-c.done:
+				return
+			}
+		}
+	}()
+	return c, nil
+}
+
+func (c *BoltCache) Close() {
+	close(c.done)
+	c.wg.Wait()
+	c.db.Close()
+}
+
+// purge deletes every value that has expired as of now, and returns how many
+// it deleted.
+func (c *BoltCache) purge(now int64) (count int, err error) {
+	err = c.db.Update(func(tx *bolt.Tx) error {
+		values := tx.Bucket(boltValues)
+		var expired [][]byte
+		// bolt doesn't allow deleting while iterating
+		err := values.ForEach(func(k, v []byte) error {
+			if _, exp := decodeValue(v); exp != 0 && now >= exp {
+				expired = append(expired, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := values.Delete(k); err != nil {
+				return err
+			}
+		}
+		count = len(expired)
+		return nil
+	})
+	return
+}
+
+// ----- value helpers -------
+
+func encodeValue(value string, exp int64) []byte {
+	b := make([]byte, 8+len(value))
+	binary.BigEndian.PutUint64(b, uint64(exp))
+	copy(b[8:], value)
+	return b
+}
+
+func decodeValue(b []byte) (value string, exp int64) {
+	return string(b[8:]), int64(binary.BigEndian.Uint64(b))
+}
+
+// getUnexpired returns the value and expiration for a key, treating expired
+// keys as missing; in a write transaction, they're deleted, too.
+func getUnexpired(tx *bolt.Tx, key string) (value string, exp int64, err error) {
+	values := tx.Bucket(boltValues)
+	b := values.Get([]byte(key))
+	if b == nil {
+		err = ErrNotFound
+		return
+	}
+	value, exp = decodeValue(b)
+	if exp != 0 && time.Time.Unix(time.Now()) >= exp {
+		err = ErrNotFound
+		if tx.Writable() {
+			if e := values.Delete([]byte(key)); e != nil {
+				err = e
+			}
+		}
+	}
+	return
+}
+
+// ----- end value helpers -------
+
+func (c *BoltCache) Set(key string, value string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltValues).Put([]byte(key), encodeValue(value, 0))
+	})
+}
+
+func (c *BoltCache) SetWithExpiry(key string, value string, seconds int) error {
+	exptime := time.Time.Unix(time.Now()) + int64(seconds)
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltValues).Put([]byte(key), encodeValue(value, exptime))
+	})
+}
+
+func (c *BoltCache) SetIfAbsent(key string, value string, seconds int) (ok bool, err error) {
+	err = c.db.Update(func(tx *bolt.Tx) error {
+		if _, _, e := getUnexpired(tx, key); e == nil {
+			return nil
+		}
+		var exptime int64
+		if seconds != 0 {
+			exptime = time.Time.Unix(time.Now()) + int64(seconds)
+		}
+		ok = true
+		return tx.Bucket(boltValues).Put([]byte(key), encodeValue(value, exptime))
+	})
+	return
+}
+
+// Batch returns a batch that's applied in a single bolt transaction.
+func (c *BoltCache) Batch() Batch {
+	return newBatch(func(ops []operation) error {
+		return c.db.Update(func(tx *bolt.Tx) error {
+			values := tx.Bucket(boltValues)
+			for _, op := range ops {
+				var err error
+				switch op.Op {
+				case "set":
+					err = values.Put([]byte(op.Key), encodeValue(op.Value, op.Exp))
+				case "del":
+					err = values.Delete([]byte(op.Key))
+				case "expireat":
+					if value, _, e := getUnexpired(tx, op.Key); e == nil {
+						err = values.Put([]byte(op.Key), encodeValue(value, op.Exp))
+					}
+				case "sadd":
+					err = boltSAdd(tx, op.Key, op.Values...)
+				case "srem":
+					if e := boltSRemove(tx, op.Key, op.Values...); e != ErrNotFound {
+						err = e
+					}
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+func (c *BoltCache) Get(key string) (value string, err error) {
+	err = c.db.View(func(tx *bolt.Tx) (e error) {
+		value, _, e = getUnexpired(tx, key)
+		return
+	})
+	return
+}
+
+func (c *BoltCache) Delete(key string) error {
+	found := false
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		// an expired key has been deleted already, and returning an error
+		// here would roll that back
+		if _, _, err := getUnexpired(tx, key); err == ErrNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		found = true
+		return tx.Bucket(boltValues).Delete([]byte(key))
+	})
+	if err == nil && !found {
+		err = ErrNotFound
+	}
+	return err
+}
+
+func (c *BoltCache) Expire(key string, seconds int) error {
+	exptime := time.Time.Unix(time.Now()) + int64(seconds)
+	return c.ExpireAt(key, exptime)
+}
+
+func (c *BoltCache) ExpireAt(key string, timestamp int64) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		value, _, err := getUnexpired(tx, key)
+		if err != nil {
+			// like the other caches, expiring a missing key isn't an error
+			return nil
+		}
+		return tx.Bucket(boltValues).Put([]byte(key), encodeValue(value, timestamp))
+	})
+}
+
+func (c *BoltCache) TTL(key string) (seconds int, err error) {
+	err = c.db.View(func(tx *bolt.Tx) error {
+		_, exp, err := getUnexpired(tx, key)
+		if err != nil {
+			return err
+		}
+		if exp == 0 {
+			seconds = -1
+		} else {
+			seconds = int(exp - time.Time.Unix(time.Now()))
+		}
+		return nil
+	})
+	return
+}
+
+func (c *BoltCache) SAdd(key string, values ...string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return boltSAdd(tx, key, values...)
+	})
+}
+
+func boltSAdd(tx *bolt.Tx, key string, values ...string) error {
+	s, err := tx.Bucket(boltSets).CreateBucketIfNotExists([]byte(key))
+	if err != nil {
+		return err
+	}
+	for _, v := range values {
+		if err := s.Put([]byte(v), []byte{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *BoltCache) SGet(key string) (values []string, err error) {
+	err = c.db.View(func(tx *bolt.Tx) error {
+		s := tx.Bucket(boltSets).Bucket([]byte(key))
+		if s == nil {
+			return ErrNotFound
+		}
+		return s.ForEach(func(k, _ []byte) error {
+			values = append(values, string(k))
+			return nil
+		})
+	})
+	return
+}
+
+func (c *BoltCache) SRemove(key string, values ...string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return boltSRemove(tx, key, values...)
+	})
+}
+
+func boltSRemove(tx *bolt.Tx, key string, values ...string) error {
+	sets := tx.Bucket(boltSets)
+	s := sets.Bucket([]byte(key))
+	if s == nil {
+		return ErrNotFound
+	}
+	for _, v := range values {
+		if err := s.Delete([]byte(v)); err != nil {
+			return err
+		}
+	}
+	// if we've removed the last item, delete the key
+	if k, _ := s.Cursor().First(); k == nil {
+		return sets.DeleteBucket([]byte(key))
+	}
+	return nil
+}
+
+func (c *BoltCache) SCount(key string) (count int, err error) {
+	err = c.db.View(func(tx *bolt.Tx) error {
+		s := tx.Bucket(boltSets).Bucket([]byte(key))
+		if s == nil {
+			return ErrNotFound
+		}
+		count = s.Stats().KeyN
+		return nil
+	})
+	return
+}
+
+func (c *BoltCache) SRandMember(key string) (value string, err error) {
+	values, err := c.SGet(key)
+	if err != nil {
+		return
+	}
+	value = values[rand.Intn(len(values))]
+	return
+}
+
+// ----- sorted set helpers -------
+
+// scores are stored so that their byte order matches their numeric order:
+// positive numbers get their sign bit set, negative numbers are inverted
+func encodeScore(score float64) []byte {
+	bits := math.Float64bits(score)
+	if bits&(1<<63) == 0 {
+		bits |= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, bits)
+	return b
+}
+
+func decodeScore(b []byte) float64 {
+	bits := binary.BigEndian.Uint64(b)
+	if bits&(1<<63) != 0 {
+		bits &^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	return math.Float64frombits(bits)
+}
+
+func indexKey(score []byte, value string) []byte {
+	return append(append([]byte{}, score...), value...)
+}
+
+// ----- end sorted set helpers -------
+
+func (c *BoltCache) ZAdd(key string, score float64, value string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		z, err := tx.Bucket(boltZSets).CreateBucketIfNotExists([]byte(key))
+		if err != nil {
+			return err
+		}
+		members, err := z.CreateBucketIfNotExists(boltMembers)
+		if err != nil {
+			return err
+		}
+		index, err := z.CreateBucketIfNotExists(boltIndex)
+		if err != nil {
+			return err
+		}
+		// in case it already exists
+		if old := members.Get([]byte(value)); old != nil {
+			if err := index.Delete(indexKey(old, value)); err != nil {
+				return err
+			}
+		}
+		sc := encodeScore(score)
+		if err := members.Put([]byte(value), sc); err != nil {
+			return err
+		}
+		return index.Put(indexKey(sc, value), []byte{})
+	})
+}
+
+func (c *BoltCache) ZRem(key string, value string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		zsets := tx.Bucket(boltZSets)
+		z := zsets.Bucket([]byte(key))
+		if z == nil {
+			return nil
+		}
+		members := z.Bucket(boltMembers)
+		sc := members.Get([]byte(value))
+		if sc == nil {
+			return nil
+		}
+		if err := z.Bucket(boltIndex).Delete(indexKey(sc, value)); err != nil {
+			return err
+		}
+		if err := members.Delete([]byte(value)); err != nil {
+			return err
+		}
+		if k, _ := members.Cursor().First(); k == nil {
+			return zsets.DeleteBucket([]byte(key))
+		}
+		return nil
+	})
+}
+
+func (c *BoltCache) ZRange(key string, start int, stop int) (values []string, err error) {
+	values = make([]string, 0)
+	err = c.db.View(func(tx *bolt.Tx) error {
+		z := tx.Bucket(boltZSets).Bucket([]byte(key))
+		if z == nil {
+			return nil
+		}
+		members := z.Bucket(boltMembers)
+		n := members.Stats().KeyN
+		if start < 0 {
+			start += n
+		}
+		if stop < 0 {
+			stop += n
+		}
+		if start < 0 {
+			start = 0
+		}
+		if start > stop || start >= n {
+			return nil
+		}
+
+		ix := 0
+		cur := z.Bucket(boltIndex).Cursor()
+		for k, _ := cur.First(); k != nil && ix <= stop; k, _ = cur.Next() {
+			if ix >= start {
+				values = append(values, string(k[8:]))
+			}
+			ix++
+		}
+		return nil
+	})
+	return
+}
+
+func (c *BoltCache) ZRangeByScore(key string, min float64, max float64) (values []string, err error) {
+	values = make([]string, 0)
+	err = c.db.View(func(tx *bolt.Tx) error {
+		z := tx.Bucket(boltZSets).Bucket([]byte(key))
+		if z == nil {
+			return nil
+		}
+		cur := z.Bucket(boltIndex).Cursor()
+		for k, _ := cur.Seek(encodeScore(min)); k != nil && decodeScore(k[:8]) <= max; k, _ = cur.Next() {
+			values = append(values, string(k[8:]))
+		}
+		return nil
+	})
+	return
+}
+
+func (c *BoltCache) ZScore(key string, value string) (score float64, err error) {
+	err = c.db.View(func(tx *bolt.Tx) error {
+		z := tx.Bucket(boltZSets).Bucket([]byte(key))
+		if z == nil {
+			return ErrNotFound
+		}
+		sc := z.Bucket(boltMembers).Get([]byte(value))
+		if sc == nil {
+			return ErrNotFound
+		}
+		score = decodeScore(sc)
+		return nil
+	})
+	return
+}
+
+func (c *BoltCache) ZCard(key string) (count int, err error) {
+	err = c.db.View(func(tx *bolt.Tx) error {
+		z := tx.Bucket(boltZSets).Bucket([]byte(key))
+		if z == nil {
+			return ErrNotFound
+		}
+		count = z.Bucket(boltMembers).Stats().KeyN
+		return nil
+	})
+	return
+}
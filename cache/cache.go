@@ -10,14 +10,34 @@
 
 package cache
 
+import (
+	"errors"
+	"time"
+
+	"github.com/AchievementNetwork/vasco/logger"
+)
+
+// events is the cache's event log: persistence and connection trouble
+var events = logger.Named("cache")
+
+// ErrNotFound is returned when a key doesn't exist (or has expired); any
+// other error means the cache itself had a problem.
+var ErrNotFound = errors.New("Key not found")
+
 type Cache interface {
 	Close()
 
 	Set(key string, value string) (err error)
+	SetWithExpiry(key string, value string, seconds int) (err error)
+	// SetIfAbsent sets key only if it doesn't already exist, expiring it after
+	// seconds (or never, if seconds is 0), and reports whether it did
+	SetIfAbsent(key string, value string, seconds int) (ok bool, err error)
 	Get(key string) (value string, err error)
 	Delete(key string) (err error)
 	Expire(key string, seconds int) (err error)
 	ExpireAt(key string, timestamp int64) (err error)
+	// TTL returns the number of seconds before key expires, or -1 if it never does
+	TTL(key string) (seconds int, err error)
 
 	SAdd(key string, values ...string) (err error)
 	SGet(key string) (values []string, err error)
@@ -25,7 +45,36 @@ type Cache interface {
 	SCount(key string) (count int, err error)
 	SRandMember(key string) (value string, err error)
 
-	ZAdd(key string, score int, value string) (err error)
+	ZAdd(key string, score float64, value string) (err error)
 	ZRem(key string, value string) (err error)
 	ZRange(key string, start int, end int) (values []string, err error)
+	// ZRangeByScore returns the members with min <= score <= max, in order
+	ZRangeByScore(key string, min float64, max float64) (values []string, err error)
+	ZScore(key string, value string) (score float64, err error)
+	ZCard(key string) (count int, err error)
+
+	// Batch returns a new, empty batch of writes to be applied atomically
+	Batch() Batch
+}
+
+// ExpiryNotifier is implemented by caches that can report keys as they expire,
+// rather than leaving it to the next reader to notice.
+type ExpiryNotifier interface {
+	OnExpire(f func(key string, value string))
+}
+
+// Availability is implemented by caches that depend on a connection to
+// something else. Available returns nil when the cache is usable and the
+// most recent error when it isn't.
+type Availability interface {
+	Available() error
+}
+
+// RateLimiter is implemented by caches that can keep token buckets that are
+// shared with everyone else using the cache. Take takes a token from the
+// bucket for key, which holds up to burst tokens and refills at rate tokens
+// a second; if there isn't one, it returns false and how long until there
+// will be.
+type RateLimiter interface {
+	Take(key string, rate float64, burst int, now time.Time) (ok bool, wait time.Duration, err error)
 }
@@ -1,15 +1,22 @@
 package cache
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"sort"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/AchievementNetwork/stringset"
+	"github.com/AchievementNetwork/vasco/logger"
 	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
 )
 
 // we want to support using the same tests for a variety of implementations
@@ -25,9 +32,24 @@ func TestMain(m *testing.M) {
 	memResult := m.Run()
 	c.Close()
 
+	dir, err := ioutil.TempDir("", "vasco-bolt")
+	if err != nil {
+		panic(err)
+	}
+	if c, err = NewBoltCache(dir + "/test.db"); err != nil {
+		panic(err)
+	}
+	if boltResult := m.Run(); boltResult != 0 {
+		memResult = boltResult
+	}
+	c.Close()
+	os.RemoveAll(dir)
+
 	if os.Getenv("TEST_REDIS") != "" {
 		c = NewRedisCache("localhost:6379")
-		memResult = m.Run()
+		if redisResult := m.Run(); redisResult != 0 {
+			memResult = redisResult
+		}
 		c.Close()
 	}
 
@@ -55,7 +77,7 @@ func TestOverwritingKey(t *testing.T) {
 
 func TestGetFail(t *testing.T) {
 	v, err := c.Get("badkey")
-	assert.NotNil(t, err)
+	assert.Equal(t, ErrNotFound, err)
 	assert.Empty(t, v)
 }
 
@@ -136,6 +158,132 @@ func TestExpire(t *testing.T) {
 
 }
 
+func TestTTL(t *testing.T) {
+	c.Set("ttlkey", "value")
+	n, err := c.TTL("ttlkey")
+	assert.Nil(t, err)
+	assert.Equal(t, -1, n)
+
+	c.Expire("ttlkey", 30)
+	n, err = c.TTL("ttlkey")
+	assert.Nil(t, err)
+	assert.InDelta(t, 30, n, 1)
+
+	c.Delete("ttlkey")
+	_, err = c.TTL("ttlkey")
+	assert.NotNil(t, err)
+}
+
+func TestSetWithExpiry(t *testing.T) {
+	err := c.SetWithExpiry("sxkey", "value", 30)
+	assert.Nil(t, err)
+	v, err := c.Get("sxkey")
+	assert.Nil(t, err)
+	assert.Equal(t, "value", v)
+	n, err := c.TTL("sxkey")
+	assert.Nil(t, err)
+	assert.InDelta(t, 30, n, 1)
+
+	// a plain Set clears the expiration
+	c.Set("sxkey", "value")
+	n, _ = c.TTL("sxkey")
+	assert.Equal(t, -1, n)
+	c.Delete("sxkey")
+}
+
+func TestSetIfAbsent(t *testing.T) {
+	ok, err := c.SetIfAbsent("nxkey", "first", 30)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = c.SetIfAbsent("nxkey", "second", 30)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	v, _ := c.Get("nxkey")
+	assert.Equal(t, "first", v)
+	n, _ := c.TTL("nxkey")
+	assert.InDelta(t, 30, n, 1)
+
+	// an expired key is absent
+	c.ExpireAt("nxkey", time.Time.Unix(time.Now())-1)
+	ok, err = c.SetIfAbsent("nxkey", "third", 0)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	n, _ = c.TTL("nxkey")
+	assert.Equal(t, -1, n)
+	c.Delete("nxkey")
+}
+
+func TestBatch(t *testing.T) {
+	c.Set("bkey3", "old")
+	c.SAdd("bset", "x", "y")
+
+	err := c.Batch().
+		Set("bkey1", "one").
+		SetWithExpiry("bkey2", "two", 30).
+		Delete("bkey3").
+		Delete("bkeynotfound").
+		SAdd("bset", "z").
+		SRemove("bset", "x").
+		SRemove("bsetnotfound", "x").
+		Exec()
+	assert.Nil(t, err)
+
+	v, err := c.Get("bkey1")
+	assert.Nil(t, err)
+	assert.Equal(t, "one", v)
+	n, err := c.TTL("bkey2")
+	assert.Nil(t, err)
+	assert.InDelta(t, 30, n, 1)
+	_, err = c.Get("bkey3")
+	assert.NotNil(t, err)
+	members, err := c.SGet("bset")
+	assert.Nil(t, err)
+	checkEquivalence(t, []string{"y", "z"}, members)
+
+	err = c.Batch().Expire("bkey1", 20).Delete("bkey2").SRemove("bset", "y", "z").Exec()
+	assert.Nil(t, err)
+	n, _ = c.TTL("bkey1")
+	assert.InDelta(t, 20, n, 1)
+	_, err = c.SGet("bset")
+	assert.NotNil(t, err)
+
+	// an empty batch is fine
+	assert.Nil(t, c.Batch().Exec())
+	c.Delete("bkey1")
+
+	// and a batch can be executed again
+	again := c.Batch().Set("bkey4", "four")
+	assert.Nil(t, again.Exec())
+	c.Delete("bkey4")
+	assert.Nil(t, again.Exec())
+	v, err = c.Get("bkey4")
+	assert.Nil(t, err)
+	assert.Equal(t, "four", v)
+	c.Delete("bkey4")
+}
+
+// the key prefix is specific to the RedisCache
+func TestRedisBatchPrefix(t *testing.T) {
+	if os.Getenv("TEST_REDIS") == "" {
+		t.Skip("TEST_REDIS isn't set")
+	}
+	rc, err := NewRedisCacheFromURL("redis://localhost:6379?prefix=batch:")
+	assert.Nil(t, err)
+	defer rc.Close()
+	plain := NewRedisCache("localhost:6379")
+	defer plain.Close()
+
+	again := rc.Batch().Set("pkey", "p")
+	assert.Nil(t, again.Exec())
+	assert.Nil(t, again.Exec())
+	v, err := plain.Get("batch:pkey")
+	assert.Nil(t, err)
+	assert.Equal(t, "p", v)
+	_, err = plain.Get("batch:batch:pkey")
+	assert.NotNil(t, err)
+	rc.Delete("pkey")
+}
+
 func TestSAddSGet(t *testing.T) {
 	values := []string{"a", "b", "c", "d", "e"}
 	err := c.SAdd("skey", values...)
@@ -259,6 +407,117 @@ func TestZAddAgain(t *testing.T) {
 	assert.Equal(t, values, results)
 }
 
+func TestZScoreZCard(t *testing.T) {
+	score, err := c.ZScore("key", "e")
+	assert.Nil(t, err)
+	assert.Equal(t, 35.0, score)
+	_, err = c.ZScore("key", "nothere")
+	assert.NotNil(t, err)
+	_, err = c.ZScore("nokey", "e")
+	assert.NotNil(t, err)
+
+	n, err := c.ZCard("key")
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	n, err = c.ZCard("nokey")
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestZRangeByScore(t *testing.T) {
+	results, err := c.ZRangeByScore("key", 25, 45)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"b", "e", "d"}, results)
+
+	results, err = c.ZRangeByScore("key", math.Inf(-1), 20)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"c"}, results)
+
+	results, err = c.ZRangeByScore("key", 50, math.Inf(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a"}, results)
+
+	results, err = c.ZRangeByScore("key", 26, 34)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, results)
+}
+
+func TestZFloatScores(t *testing.T) {
+	c.ZAdd("fkey", 1.5, "b")
+	c.ZAdd("fkey", -2.25, "a")
+	c.ZAdd("fkey", 1.5, "a2")
+	c.ZAdd("fkey", 1e10, "c")
+
+	// equal scores are ordered by member
+	results, err := c.ZRange("fkey", 0, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "a2", "b", "c"}, results)
+
+	results, err = c.ZRangeByScore("fkey", -3, 1.5)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "a2", "b"}, results)
+
+	score, err := c.ZScore("fkey", "a")
+	assert.Nil(t, err)
+	assert.Equal(t, -2.25, score)
+
+	for _, v := range results {
+		c.ZRem("fkey", v)
+	}
+	c.ZRem("fkey", "c")
+	n, err := c.ZCard("fkey")
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestZManyMembers(t *testing.T) {
+	// add members in random order, move some and remove others, and make
+	// sure ranks and ranges agree with a simple sort
+	const count = 300
+	expected := make(map[string]float64)
+	for _, i := range rand.Perm(count) {
+		member := fmt.Sprintf("m%03d", i)
+		expected[member] = float64(i)
+		c.ZAdd("bigkey", float64(i), member)
+	}
+	for i := 0; i < count; i += 3 {
+		member := fmt.Sprintf("m%03d", i)
+		delete(expected, member)
+		c.ZRem("bigkey", member)
+	}
+	for i := 1; i < count; i += 7 {
+		member := fmt.Sprintf("m%03d", i)
+		expected[member] = float64(count - i)
+		c.ZAdd("bigkey", float64(count-i), member)
+	}
+
+	members := make([]string, 0, len(expected))
+	for m := range expected {
+		members = append(members, m)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		si, sj := expected[members[i]], expected[members[j]]
+		return si < sj || (si == sj && members[i] < members[j])
+	})
+
+	n, err := c.ZCard("bigkey")
+	assert.Nil(t, err)
+	assert.Equal(t, len(members), n)
+	results, err := c.ZRange("bigkey", 0, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, members, results)
+	results, err = c.ZRange("bigkey", 17, 41)
+	assert.Nil(t, err)
+	assert.Equal(t, members[17:42], results)
+	results, err = c.ZRange("bigkey", -10, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, members[len(members)-10:], results)
+
+	for _, m := range members {
+		c.ZRem("bigkey", m)
+	}
+}
+
 func TestConcurrentKV(t *testing.T) {
 	keys := []string{
 		"generate", "1000", "random", "results", "and", "make", "sure", "reasonably",
@@ -349,9 +608,275 @@ func TestConcurrentSets(t *testing.T) {
 	assert.Equal(t, 0, n)
 }
 
+// persistence is specific to the LocalCache, so this doesn't use the global
+func TestPersistentLocalCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vasco-cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	pc, err := NewPersistentLocalCache(dir, time.Hour)
+	assert.Nil(t, err)
+	pc.Set("forever", "a")
+	pc.Set("later", "b")
+	pc.Expire("later", 60)
+	pc.Set("soon", "c")
+	pc.Expire("soon", 0)
+	pc.Set("gone", "d")
+	pc.Delete("gone")
+	pc.SAdd("pset", "x", "y", "z")
+	pc.SRemove("pset", "y")
+	pc.Batch().Set("batched", "e").SAdd("pset", "w").SRemove("pset", "w").Exec()
+	pc.ZAdd("pz", 2, "second")
+	pc.ZAdd("pz", 1, "first")
+
+	// simulate a crash by reading a copy of the directory taken while the
+	// cache is still open; everything is in the log
+	check := func(c2 *LocalCache) {
+		v, err := c2.Get("forever")
+		assert.Nil(t, err)
+		assert.Equal(t, "a", v)
+		n, err := c2.TTL("later")
+		assert.Nil(t, err)
+		assert.InDelta(t, 60, n, 1)
+		_, err = c2.Get("soon")
+		assert.NotNil(t, err)
+		_, err = c2.Get("gone")
+		assert.NotNil(t, err)
+		v, err = c2.Get("batched")
+		assert.Nil(t, err)
+		assert.Equal(t, "e", v)
+		members, err := c2.SGet("pset")
+		assert.Nil(t, err)
+		checkEquivalence(t, []string{"x", "z"}, members)
+		zs, err := c2.ZRange("pz", 0, -1)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"first", "second"}, zs)
+	}
+	crashed, err := ioutil.TempDir("", "vasco-cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(crashed)
+	assert.Nil(t, copyDir(dir, crashed))
+	c2, err := NewPersistentLocalCache(crashed, time.Hour)
+	assert.Nil(t, err)
+	check(c2)
+	c2.Close()
+	pc.Close()
+
+	// and a clean restart from the snapshot written by Close
+	c3, err := NewPersistentLocalCache(dir, time.Hour)
+	assert.Nil(t, err)
+	check(c3)
+	c3.Close()
+}
+
+// a log cut off by a crash is replayed up to the cut, and the cache's event
+// log says so
+func TestPersistentLocalCacheTornLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vasco-cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	torn := `{"op":"set","key":"kept","value":"a"}` + "\n" + `{"op":"set","key":"to`
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, logFile), []byte(torn), 0644))
+
+	var buf bytes.Buffer
+	logger.Configure(&buf, logger.FormatLogfmt, logger.InfoLevel)
+	defer logger.Configure(os.Stderr, logger.FormatLogfmt, logger.InfoLevel)
+	pc, err := NewPersistentLocalCache(dir, time.Hour)
+	assert.Nil(t, err)
+	defer pc.Close()
+
+	v, err := pc.Get("kept")
+	assert.Nil(t, err)
+	assert.Equal(t, "a", v)
+	assert.Contains(t, buf.String(), `level=warn log=cache msg="stopped replaying the cache log"`)
+}
+
+func copyDir(from string, to string) error {
+	files, err := ioutil.ReadDir(from)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		data, err := ioutil.ReadFile(filepath.Join(from, f.Name()))
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(to, f.Name()), data, f.Mode()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the sweeper is specific to the LocalCache, so this doesn't use the global
+func TestLocalCacheSweeper(t *testing.T) {
+	lc := NewLocalCache()
+	defer lc.Close()
+
+	var mutex sync.Mutex
+	expired := make(map[string]string)
+	lc.OnExpire(func(key string, value string) {
+		mutex.Lock()
+		expired[key] = value
+		mutex.Unlock()
+	})
+
+	now := time.Time.Unix(time.Now())
+	lc.Set("short", "1")
+	lc.ExpireAt("short", now+1)
+	lc.Set("long", "2")
+	lc.ExpireAt("long", now+100)
+	lc.Set("rewritten", "3")
+	lc.ExpireAt("rewritten", now+1)
+	lc.Set("rewritten", "4") // no longer expires
+	lc.Set("forever", "5")
+
+	lc.sweep(now + 2)
+	assert.Equal(t, map[string]string{"short": "1"}, expired)
+	assert.Equal(t, 3, len(lc.values))
+	_, err := lc.Get("rewritten")
+	assert.Nil(t, err)
+
+	// a key that's read after it expires is only reported once
+	lc.ExpireAt("forever", now+1)
+	lc.values["forever"] = cacheValue{value: "5", exp: now - 1}
+	_, err = lc.Get("forever")
+	assert.NotNil(t, err)
+	lc.sweep(now + 2)
+	assert.Equal(t, map[string]string{"short": "1", "forever": "5"}, expired)
+}
+
+// purging is specific to the BoltCache, so this doesn't use the global
+func TestBoltCachePurge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vasco-bolt")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	bc, err := NewBoltCache(filepath.Join(dir, "purge.db"))
+	assert.Nil(t, err)
+	defer bc.Close()
+
+	stored := func() int {
+		n := 0
+		bc.db.View(func(tx *bolt.Tx) error {
+			n = tx.Bucket(boltValues).Stats().KeyN
+			return nil
+		})
+		return n
+	}
+
+	now := time.Time.Unix(time.Now())
+	bc.Set("forever", "1")
+	bc.SetWithExpiry("long", "2", 100)
+	for _, key := range []string{"a", "b", "c"} {
+		bc.Set(key, "x")
+		bc.ExpireAt(key, now-1)
+	}
+	assert.Equal(t, 5, stored())
+
+	// writes that come across an expired key delete it
+	assert.Equal(t, ErrNotFound, bc.Delete("a"))
+	bc.Expire("b", 10)
+	assert.Equal(t, 3, stored())
+
+	// and the purge gets the rest
+	n, err := bc.purge(now)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 2, stored())
+	n, err = bc.purge(now + 200)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	v, err := bc.Get("forever")
+	assert.Nil(t, err)
+	assert.Equal(t, "1", v)
+}
+
+func TestParseRedisURL(t *testing.T) {
+	opts, err := ParseRedisURL("localhost:6379")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"localhost:6379"}, opts.Addrs)
+	assert.Equal(t, "", opts.Prefix)
+
+	opts, err = ParseRedisURL("redis://:secret@redis:6380/2?prefix=staging:")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"redis:6380"}, opts.Addrs)
+	assert.Equal(t, "secret", opts.Password)
+	assert.Equal(t, int64(2), opts.DB)
+	assert.Equal(t, "staging:", opts.Prefix)
+	assert.Nil(t, opts.TLS)
+
+	opts, err = ParseRedisURL("rediss://redis.example.com:6379?insecure=true")
+	assert.Nil(t, err)
+	if assert.NotNil(t, opts.TLS) {
+		assert.Equal(t, "redis.example.com", opts.TLS.ServerName)
+		assert.True(t, opts.TLS.InsecureSkipVerify)
+	}
+
+	opts, err = ParseRedisURL("redis-sentinel://s1:26379,s2:26379/1?master=mymaster")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"s1:26379", "s2:26379"}, opts.Addrs)
+	assert.Equal(t, "mymaster", opts.MasterName)
+	assert.Equal(t, int64(1), opts.DB)
+
+	opts, err = ParseRedisURL("redis-cluster://n1:7000,n2:7000")
+	assert.Nil(t, err)
+	assert.True(t, opts.Cluster)
+	assert.Equal(t, "{vasco}", opts.Prefix)
+	opts, err = ParseRedisURL("redis-cluster://n1:7000?prefix=prod")
+	assert.Nil(t, err)
+	assert.Equal(t, "{prod}", opts.Prefix)
+
+	for _, bad := range []string{
+		"",
+		"redis://",
+		"redis://host:6379/notanumber",
+		"redis://h1:6379,h2:6379",
+		"redis-sentinel://s1:26379",
+		"redis-cluster://n1:7000/3",
+		"memcache://host:11211",
+	} {
+		_, err = ParseRedisURL(bad)
+		assert.NotNil(t, err, bad)
+	}
+}
+
 // This performs an equivalence test for two string slices
 func checkEquivalence(t *testing.T, a []string, b []string) {
 	ssa := stringset.New().Add(a...)
 	ssb := stringset.New().Add(b...)
 	assert.True(t, ssa.Equals(ssb))
 }
+
+func TestRateLimiter(t *testing.T) {
+	limiter, ok := c.(RateLimiter)
+	if !ok {
+		limiter = NewMemoryRateLimiter()
+	}
+	now := time.Unix(1500000000, 0)
+	key := fmt.Sprintf("RateLimit:test:%d", time.Now().UnixNano())
+
+	// a full bucket of 3, refilling at 2 a second
+	for i := 0; i < 3; i++ {
+		ok, _, err := limiter.Take(key, 2, 3, now)
+		assert.Nil(t, err)
+		assert.True(t, ok)
+	}
+	ok, wait, err := limiter.Take(key, 2, 3, now)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	ok, _, _ = limiter.Take(key, 2, 3, now.Add(500*time.Millisecond))
+	assert.True(t, ok)
+	ok, wait, _ = limiter.Take(key, 2, 3, now.Add(750*time.Millisecond))
+	assert.False(t, ok)
+	assert.Equal(t, 250*time.Millisecond, wait)
+
+	// it never holds more than the burst
+	for i := 0; i < 3; i++ {
+		ok, _, _ = limiter.Take(key, 2, 3, now.Add(time.Hour))
+		assert.True(t, ok)
+	}
+	ok, _, _ = limiter.Take(key, 2, 3, now.Add(time.Hour))
+	assert.False(t, ok)
+}
@@ -1,12 +1,7 @@
 package cache
 
 import (
-	"errors"
-	"fmt"
 	"math/rand"
-	"sort"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
 
@@ -25,27 +20,90 @@ type LocalCache struct {
 	valuemutex sync.RWMutex
 	sets       map[string]*stringset.StringSet
 	setmutex   sync.RWMutex
+	zsets      map[string]*zset
+	zsetmutex  sync.RWMutex
+	persist    *persister
+	sweeper    *sweeper
 }
 
 func NewLocalCache() *LocalCache {
 	c := LocalCache{
 		values: make(map[string]cacheValue),
 		sets:   make(map[string]*stringset.StringSet),
+		zsets:  make(map[string]*zset),
 	}
+	c.startSweeper()
 	return &c
 }
 
 func (c *LocalCache) Close() {
+	c.stopSweeper()
+	if c.persist != nil {
+		c.persist.close(c)
+	}
 }
 
 func (c *LocalCache) Set(key string, value string) (err error) {
 	c.valuemutex.Lock()
 	c.values[key] = cacheValue{value: value, exp: 0}
+	c.record(operation{Op: "set", Key: key, Value: value})
 	c.valuemutex.Unlock()
 	err = nil
 	return
 }
 
+func (c *LocalCache) SetWithExpiry(key string, value string, seconds int) (err error) {
+	exptime := time.Time.Unix(time.Now()) + int64(seconds)
+	c.valuemutex.Lock()
+	c.values[key] = cacheValue{value: value, exp: exptime}
+	c.scheduleExpiry(key, exptime)
+	c.record(operation{Op: "set", Key: key, Value: value, Exp: exptime})
+	c.valuemutex.Unlock()
+	return
+}
+
+func (c *LocalCache) SetIfAbsent(key string, value string, seconds int) (ok bool, err error) {
+	now := time.Time.Unix(time.Now())
+	c.valuemutex.Lock()
+	defer c.valuemutex.Unlock()
+	if v, exists := c.values[key]; exists && (v.exp == 0 || now < v.exp) {
+		return false, nil
+	}
+	var exptime int64
+	if seconds != 0 {
+		exptime = now + int64(seconds)
+		c.scheduleExpiry(key, exptime)
+	}
+	c.values[key] = cacheValue{value: value, exp: exptime}
+	c.record(operation{Op: "set", Key: key, Value: value, Exp: exptime})
+	return true, nil
+}
+
+// Batch returns a batch that's applied with the values and sets both locked,
+// and logged as a single record if the cache is persistent.
+func (c *LocalCache) Batch() Batch {
+	return newBatch(func(ops []operation) error {
+		now := time.Time.Unix(time.Now())
+		applied := make([]operation, 0, len(ops))
+		c.valuemutex.Lock()
+		c.setmutex.Lock()
+		for _, op := range ops {
+			// as in ExpireAt, an expired key can't be given a new expiration
+			if op.Op == "expireat" {
+				if v, ok := c.values[op.Key]; !ok || (v.exp != 0 && now >= v.exp) {
+					continue
+				}
+			}
+			c.apply(op)
+			applied = append(applied, op)
+		}
+		c.record(operation{Op: "batch", Ops: applied})
+		c.setmutex.Unlock()
+		c.valuemutex.Unlock()
+		return nil
+	})
+}
+
 func (c *LocalCache) getUnexpired(key string, now int64) (item cacheValue, err error) {
 	c.valuemutex.RLock()
 	v, ok := c.values[key]
@@ -57,12 +115,20 @@ func (c *LocalCache) getUnexpired(key string, now int64) (item cacheValue, err e
 			item = v
 			return
 		}
+		// key has expired; make sure nobody beat us to it before we delete it
 		c.valuemutex.Lock()
-		delete(c.values, key) // key has expired
+		current, ok := c.values[key]
+		expired := ok && current.exp == v.exp
+		if expired {
+			delete(c.values, key)
+		}
 		c.valuemutex.Unlock()
+		if expired {
+			c.notifyExpired(key, v.value)
+		}
 	}
 
-	err = errors.New("Key not found")
+	err = ErrNotFound
 	return
 }
 
@@ -76,17 +142,14 @@ func (c *LocalCache) Get(key string) (value string, err error) {
 }
 
 func (c *LocalCache) Delete(key string) (err error) {
-	c.valuemutex.RLock()
-	_, ok := c.values[key]
-	c.valuemutex.RUnlock()
-
-	if ok {
-		c.valuemutex.Lock()
-		delete(c.values, key) // key has expired
-		c.valuemutex.Unlock()
+	c.valuemutex.Lock()
+	defer c.valuemutex.Unlock()
+	if _, ok := c.values[key]; ok {
+		delete(c.values, key)
+		c.record(operation{Op: "del", Key: key})
 		return
 	}
-	err = errors.New("Key not found")
+	err = ErrNotFound
 	return
 }
 
@@ -97,9 +160,27 @@ func (c *LocalCache) Expire(key string, seconds int) (err error) {
 
 func (c *LocalCache) ExpireAt(key string, timestamp int64) (err error) {
 	now := time.Time.Unix(time.Now())
-	if item, err := c.getUnexpired(key, now); err == nil {
+	c.valuemutex.Lock()
+	defer c.valuemutex.Unlock()
+	if item, ok := c.values[key]; ok && (item.exp == 0 || now < item.exp) {
 		item.exp = timestamp
 		c.values[key] = item
+		c.scheduleExpiry(key, timestamp)
+		c.record(operation{Op: "expireat", Key: key, Exp: timestamp})
+	}
+	return
+}
+
+func (c *LocalCache) TTL(key string) (seconds int, err error) {
+	now := time.Time.Unix(time.Now())
+	item, err := c.getUnexpired(key, now)
+	if err != nil {
+		return
+	}
+	if item.exp == 0 {
+		seconds = -1
+	} else {
+		seconds = int(item.exp - now)
 	}
 	return
 }
@@ -113,6 +194,7 @@ func (c *LocalCache) SAdd(key string, values ...string) (err error) {
 	}
 	s.Add(values...)
 	c.sets[key] = s
+	c.record(operation{Op: "sadd", Key: key, Values: values})
 	c.setmutex.Unlock()
 	return
 }
@@ -124,7 +206,7 @@ func (c *LocalCache) SGet(key string) (values []string, err error) {
 	if ok {
 		values = s.Strings()
 	} else {
-		err = errors.New("Key not found")
+		err = ErrNotFound
 	}
 	c.setmutex.RUnlock()
 	return
@@ -142,8 +224,9 @@ func (c *LocalCache) SRemove(key string, values ...string) (err error) {
 		} else {
 			c.sets[key] = s
 		}
+		c.record(operation{Op: "srem", Key: key, Values: values})
 	} else {
-		err = errors.New("Key not found")
+		err = ErrNotFound
 	}
 	c.setmutex.Unlock()
 	return
@@ -156,7 +239,7 @@ func (c *LocalCache) SCount(key string) (count int, err error) {
 	if ok {
 		count = s.Length()
 	} else {
-		err = errors.New("Key not found")
+		err = ErrNotFound
 	}
 	c.setmutex.RUnlock()
 	return
@@ -171,84 +254,82 @@ func (c *LocalCache) SRandMember(key string) (value string, err error) {
 		r := rand.Intn(len(all))
 		value = all[r]
 	} else {
-		err = errors.New("Key not found")
+		err = ErrNotFound
 	}
 	c.setmutex.RUnlock()
 	return
 }
 
-// warning -- this stuff is worse than O(n) so if we start managing big lists, this needs a rewrite
-// or to use Redis.
-func (c *LocalCache) ZAdd(key string, score int, value string) (err error) {
-	newvalue := fmt.Sprintf("%d:%s", score, value)
-	c.ZRem(key, value) // in case it already exists
-	return c.SAdd("Z"+key, newvalue)
+// sorted sets are kept in a skiplist (see zset.go), so these are all O(log n)
+// apart from the size of the results they return.
+func (c *LocalCache) ZAdd(key string, score float64, value string) (err error) {
+	c.zsetmutex.Lock()
+	z, ok := c.zsets[key]
+	if !ok {
+		z = newZSet()
+		c.zsets[key] = z
+	}
+	z.add(score, value)
+	c.record(operation{Op: "zadd", Key: key, Value: value, Score: score})
+	c.zsetmutex.Unlock()
+	return
 }
 
 func (c *LocalCache) ZRem(key string, value string) (err error) {
-	zkey := "Z" + key
-	c.setmutex.RLock()
-	all, ok := c.sets[zkey]
-	c.setmutex.RUnlock()
-	if !ok {
-		return
-	}
-	for _, item := range all.Strings() {
-		sv := strings.SplitN(item, ":", 2)
-		if sv[1] == value {
-			c.SRemove(zkey, item)
+	c.zsetmutex.Lock()
+	if z, ok := c.zsets[key]; ok && z.remove(value) {
+		// if we've removed the last item, delete the key
+		if z.card() == 0 {
+			delete(c.zsets, key)
 		}
+		c.record(operation{Op: "zrem", Key: key, Value: value})
 	}
+	c.zsetmutex.Unlock()
 	return
 }
 
-// ----- sort helpers  -------
-// this is a helper struct for organizing items according to their priority
-type pri struct {
-	score int
-	val   string
-}
-type byPri []pri
-
-func (a byPri) Len() int           { return len(a) }
-func (a byPri) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a byPri) Less(i, j int) bool { return a[i].score < a[j].score }
-
-// ----- end sort helpers  -------
-
 func (c *LocalCache) ZRange(key string, start int, stop int) (values []string, err error) {
-	items, err := c.SGet("Z" + key)
-	if err != nil {
-		return
-	}
-	priorities := make(byPri, 0, len(items))
-	for _, e := range items {
-		sv := strings.SplitN(e, ":", 2)
-		sc, _ := strconv.Atoi(sv[0])
-		priorities = append(priorities, pri{sc, sv[1]})
-	}
-	sort.Sort(priorities)
-	if start < 0 {
-		start += len(priorities)
-	}
-	if stop < 0 {
-		stop += len(priorities)
+	c.zsetmutex.RLock()
+	if z, ok := c.zsets[key]; ok {
+		values = z.rangeByRank(start, stop)
+	} else {
+		values = make([]string, 0)
 	}
+	c.zsetmutex.RUnlock()
+	return
+}
 
-	if start > stop || start >= len(priorities) || stop < 0 {
+func (c *LocalCache) ZRangeByScore(key string, min float64, max float64) (values []string, err error) {
+	c.zsetmutex.RLock()
+	if z, ok := c.zsets[key]; ok {
+		values = z.rangeByScore(min, max)
+	} else {
 		values = make([]string, 0)
-		return
 	}
-	if start < 0 {
-		start = 0
+	c.zsetmutex.RUnlock()
+	return
+}
+
+func (c *LocalCache) ZScore(key string, value string) (score float64, err error) {
+	c.zsetmutex.RLock()
+	z, ok := c.zsets[key]
+	if ok {
+		score, ok = z.scores[value]
 	}
-	if stop > len(priorities) {
-		stop = len(priorities) - 1
+	if !ok {
+		err = ErrNotFound
 	}
+	c.zsetmutex.RUnlock()
+	return
+}
 
-	p := priorities[start : stop+1]
-	for _, item := range p {
-		values = append(values, item.val)
+func (c *LocalCache) ZCard(key string) (count int, err error) {
+	c.zsetmutex.RLock()
+	if z, ok := c.zsets[key]; ok {
+		count = z.card()
+	} else {
+		err = ErrNotFound
 	}
+	c.zsetmutex.RUnlock()
 	return
 }
@@ -0,0 +1,348 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/AchievementNetwork/stringset"
+)
+
+// Persistence for the LocalCache. Every change is appended to a log file as
+// a JSON record, and every so often the whole cache is written to a snapshot
+// file and the log is started over. On startup we load the snapshot and then
+// replay the log on top of it.
+//
+// When we take a snapshot, the current log is renamed to cache.log.old while
+// the cache is locked, so that every change after that point goes to a new
+// log. The old log is only removed once the snapshot has been safely written;
+// if we crash in between, the old log is replayed along with the new one.
+// All of the logged operations are idempotent so replaying extra records
+// is harmless.
+
+const (
+	snapshotFile = "cache.snapshot"
+	logFile      = "cache.log"
+	oldLogFile   = "cache.log.old"
+)
+
+// a single change to the cache; these are the records in the log, and are
+// also how a Batch queues its writes. A "batch" operation holds a group of
+// operations in Ops that were applied together, so that they are replayed
+// all or nothing.
+type operation struct {
+	Op     string      `json:"op"`
+	Key    string      `json:"key,omitempty"`
+	Value  string      `json:"value,omitempty"`
+	Exp    int64       `json:"exp,omitempty"`
+	Values []string    `json:"values,omitempty"`
+	Score  float64     `json:"score,omitempty"`
+	Ops    []operation `json:"ops,omitempty"`
+}
+
+type snapshotValue struct {
+	Value string `json:"value"`
+	Exp   int64  `json:"exp,omitempty"`
+}
+
+type snapshot struct {
+	Values map[string]snapshotValue      `json:"values"`
+	Sets   map[string][]string           `json:"sets"`
+	ZSets  map[string]map[string]float64 `json:"zsets"`
+}
+
+type persister struct {
+	dir       string
+	snapmutex sync.Mutex // only one snapshot at a time
+	logmutex  sync.Mutex
+	logf      *os.File
+	enc       *json.Encoder
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// NewPersistentLocalCache returns a LocalCache that keeps its contents in dir
+// and reloads them when it's created, so that its data survives a restart.
+// A snapshot is taken every snapshotInterval and when the cache is closed.
+func NewPersistentLocalCache(dir string, snapshotInterval time.Duration) (*LocalCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := NewLocalCache()
+	if err := c.load(dir); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	p := &persister{dir: dir, done: make(chan struct{})}
+	if err := p.openLog(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.persist = p
+
+	// start from a clean snapshot so the logs we just replayed can go away
+	if err := c.Snapshot(); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(snapshotInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := c.Snapshot(); err != nil {
+					events.Error("cache snapshot failed", "dir", p.dir, "err", err)
+				}
+			case <-p.done:
+				return
+			}
+		}
+	}()
+	return c, nil
+}
+
+func (p *persister) path(name string) string {
+	return filepath.Join(p.dir, name)
+}
+
+func (p *persister) openLog() (err error) {
+	p.logf, err = os.OpenFile(p.path(logFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	p.enc = json.NewEncoder(p.logf)
+	return
+}
+
+// close stops the snapshot loop, takes a final snapshot and closes the log.
+func (p *persister) close(c *LocalCache) {
+	close(p.done)
+	p.wg.Wait()
+	if err := c.Snapshot(); err != nil {
+		events.Error("final cache snapshot failed", "dir", p.dir, "err", err)
+	}
+	p.logmutex.Lock()
+	p.logf.Close()
+	p.logmutex.Unlock()
+}
+
+// record appends an operation to the log; it's a no-op for a cache that
+// isn't persistent. Callers hold the lock for the data they changed so that
+// the log is in the same order as the changes.
+func (c *LocalCache) record(e operation) {
+	p := c.persist
+	if p == nil {
+		return
+	}
+	p.logmutex.Lock()
+	if err := p.enc.Encode(e); err != nil {
+		events.Error("cache log write failed", "dir", p.dir, "op", e.Op, "key", e.Key, "err", err)
+	}
+	p.logmutex.Unlock()
+}
+
+// Snapshot writes the whole cache to disk and discards the log that led up
+// to it. It's called periodically, but can also be called directly.
+func (c *LocalCache) Snapshot() error {
+	p := c.persist
+	if p == nil {
+		return nil
+	}
+	p.snapmutex.Lock()
+	defer p.snapmutex.Unlock()
+
+	now := time.Time.Unix(time.Now())
+	snap := snapshot{
+		Values: make(map[string]snapshotValue),
+		Sets:   make(map[string][]string),
+		ZSets:  make(map[string]map[string]float64),
+	}
+
+	// lock everything (in the same order as the writers do) while we copy
+	// the data and switch to a new log
+	c.valuemutex.RLock()
+	c.setmutex.RLock()
+	c.zsetmutex.RLock()
+	p.logmutex.Lock()
+	for k, v := range c.values {
+		if v.exp == 0 || now < v.exp {
+			snap.Values[k] = snapshotValue{Value: v.value, Exp: v.exp}
+		}
+	}
+	for k, s := range c.sets {
+		snap.Sets[k] = s.Strings()
+	}
+	for k, z := range c.zsets {
+		scores := make(map[string]float64, len(z.scores))
+		for member, score := range z.scores {
+			scores[member] = score
+		}
+		snap.ZSets[k] = scores
+	}
+	p.logf.Close()
+	err := os.Rename(p.path(logFile), p.path(oldLogFile))
+	if err == nil {
+		err = p.openLog()
+	}
+	p.logmutex.Unlock()
+	c.zsetmutex.RUnlock()
+	c.setmutex.RUnlock()
+	c.valuemutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := p.path(snapshotFile + ".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err = json.NewEncoder(f).Encode(snap); err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, p.path(snapshotFile)); err != nil {
+		return err
+	}
+	return os.Remove(p.path(oldLogFile))
+}
+
+// load reads the snapshot and replays any logs found in dir.
+func (c *LocalCache) load(dir string) error {
+	f, err := os.Open(filepath.Join(dir, snapshotFile))
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	default:
+		var snap snapshot
+		err = json.NewDecoder(f).Decode(&snap)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		for k, v := range snap.Values {
+			c.values[k] = cacheValue{value: v.Value, exp: v.Exp}
+		}
+		for k, values := range snap.Sets {
+			c.sets[k] = stringset.New().Add(values...)
+		}
+		for k, scores := range snap.ZSets {
+			z := newZSet()
+			for member, score := range scores {
+				z.add(score, member)
+			}
+			c.zsets[k] = z
+		}
+	}
+
+	for _, name := range []string{oldLogFile, logFile} {
+		if err := c.replay(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+
+	// throw away anything that expired while we were down, and let the
+	// sweeper know about everything else that will expire
+	now := time.Time.Unix(time.Now())
+	for k, v := range c.values {
+		if v.exp != 0 && now >= v.exp {
+			delete(c.values, k)
+		} else {
+			c.scheduleExpiry(k, v.exp)
+		}
+	}
+	return nil
+}
+
+func (c *LocalCache) replay(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var e operation
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			// a partial record at the end of the log means we crashed while
+			// writing it; everything before it is still good
+			events.Warn("stopped replaying the cache log", "path", path, "err", err)
+			return nil
+		}
+		c.apply(e)
+	}
+}
+
+// apply makes the change described by an operation without logging it. It's
+// used to replay the log and to execute batches; the caller must hold the
+// locks for the data that's changed.
+func (c *LocalCache) apply(e operation) {
+	switch e.Op {
+	case "batch":
+		for _, op := range e.Ops {
+			c.apply(op)
+		}
+	case "set":
+		c.values[e.Key] = cacheValue{value: e.Value, exp: e.Exp}
+		c.scheduleExpiry(e.Key, e.Exp)
+	case "del":
+		delete(c.values, e.Key)
+	case "expireat":
+		if v, ok := c.values[e.Key]; ok {
+			v.exp = e.Exp
+			c.values[e.Key] = v
+			c.scheduleExpiry(e.Key, e.Exp)
+		}
+	case "sadd":
+		s, ok := c.sets[e.Key]
+		if !ok {
+			s = stringset.New()
+			c.sets[e.Key] = s
+		}
+		s.Add(e.Values...)
+	case "srem":
+		if s, ok := c.sets[e.Key]; ok {
+			s.Delete(e.Values...)
+			if s.Length() == 0 {
+				delete(c.sets, e.Key)
+			}
+		}
+	case "zadd":
+		z, ok := c.zsets[e.Key]
+		if !ok {
+			z = newZSet()
+			c.zsets[e.Key] = z
+		}
+		z.add(e.Score, e.Value)
+	case "zrem":
+		if z, ok := c.zsets[e.Key]; ok {
+			z.remove(e.Value)
+			if z.card() == 0 {
+				delete(c.zsets, e.Key)
+			}
+		}
+	default:
+		events.Warn("unknown cache log operation", "op", e.Op, "key", e.Key)
+	}
+}
@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryRateLimiter keeps token buckets in memory, for caches that can't
+// share them (and so each process limits on its own).
+type MemoryRateLimiter struct {
+	mutex   sync.Mutex
+	buckets map[string]*bucket
+	takes   int
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	rate   float64
+	burst  int
+}
+
+// how often (in takes) we forget buckets that have filled up again
+const pruneEvery = 1000
+
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+	return &MemoryRateLimiter{buckets: make(map[string]*bucket)}
+}
+
+func (m *MemoryRateLimiter) Take(key string, rate float64, burst int, now time.Time) (bool, time.Duration, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.takes++
+	if m.takes%pruneEvery == 0 {
+		m.prune(now)
+	}
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(burst), last: now}
+		m.buckets[key] = b
+	}
+	b.rate, b.burst = rate, burst
+	ok, wait := b.take(now)
+	return ok, wait, nil
+}
+
+func (b *bucket) take(now time.Time) (bool, time.Duration) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(b.burst), b.tokens+elapsed*b.rate)
+		b.last = now
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// prune forgets full buckets; a new bucket starts full, so that's the same
+func (m *MemoryRateLimiter) prune(now time.Time) {
+	for key, b := range m.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.rate >= float64(b.burst) {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+// tokenBucketScript is Take for redis. KEYS[1] is the bucket; ARGV is the
+// rate, the burst and the time in milliseconds. It returns whether a token
+// was taken and, if not, the wait in milliseconds. The bucket expires once
+// it would have filled up again.
+const tokenBucketScript = `
+local rate, burst, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local b = redis.call("HMGET", KEYS[1], "tokens", "last")
+local tokens, last = tonumber(b[1]), tonumber(b[2])
+if tokens == nil then
+	tokens, last = burst, now
+end
+if now > last then
+	tokens = math.min(burst, tokens + (now - last) / 1000 * rate)
+	last = now
+end
+local ok, wait = 0, 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	ok = 1
+else
+	wait = math.ceil((1 - tokens) / rate * 1000)
+end
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "last", tostring(last))
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {ok, wait}
+`
+
+// Take uses a bucket in redis, so all the replicas using the same redis share
+// it. The callers' clocks are assumed to agree closely enough.
+func (c *RedisCache) Take(key string, rate float64, burst int, now time.Time) (bool, time.Duration, error) {
+	args := []string{
+		strconv.FormatFloat(rate, 'f', -1, 64),
+		strconv.Itoa(burst),
+		strconv.FormatInt(now.UnixNano()/int64(time.Millisecond), 10),
+	}
+	result, err := c.client.Eval(tokenBucketScript, []string{c.key(key)}, args).Result()
+	if err = c.observe(err); err != nil {
+		return false, 0, err
+	}
+	values, _ := result.([]interface{})
+	if len(values) != 2 {
+		return false, 0, fmt.Errorf("unexpected reply from the token bucket script: %v", result)
+	}
+	ok, _ := values[0].(int64)
+	wait, _ := values[1].(int64)
+	return ok == 1, time.Duration(wait) * time.Millisecond, nil
+}
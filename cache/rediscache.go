@@ -2,6 +2,9 @@ package cache
 
 import (
 	"errors"
+	"math"
+	"strconv"
+	"strings"
 	"time"
 
 	"gopkg.in/redis.v3"
@@ -9,105 +12,304 @@ import (
 
 // an implementation of the Cache that uses redis for the backing store
 type RedisCache struct {
-	R *redis.Client
+	client redisClient
+	prefix string
+	health *redisHealth
 }
 
+// NewRedisCache connects to redis at addr (host:port, or any of the URLs
+// that ParseRedisURL understands) and panics if addr is invalid.
 func NewRedisCache(addr string) *RedisCache {
-	c := RedisCache{
-		R: redis.NewClient(&redis.Options{Addr: addr}),
+	c, err := NewRedisCacheFromURL(addr)
+	if err != nil {
+		panic(err.Error())
+	}
+	return c
+}
+
+// NewRedisCacheFromURL connects to redis as described by rawurl. It only
+// fails if rawurl is invalid; if redis can't be reached, the cache starts out
+// unavailable and keeps trying to reconnect.
+func NewRedisCacheFromURL(rawurl string) (*RedisCache, error) {
+	opts, err := ParseRedisURL(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return NewRedisCacheWithOptions(opts), nil
+}
+
+func NewRedisCacheWithOptions(opts *RedisOptions) *RedisCache {
+	c := &RedisCache{
+		client: newRedisClient(opts),
+		prefix: opts.Prefix,
 	}
-	if c.R == nil {
-		panic("Unable to open redis client - can't continue.")
+	events.Info("connecting to redis", "addrs", strings.Join(opts.Addrs, ","), "db", opts.DB, "prefix", opts.Prefix)
+	err := c.check()
+	if err != nil {
+		events.Warn("redis unavailable; starting degraded", "err", err)
 	}
-	if err := c.R.Set("VASCO_START", "test", 0).Err(); err != nil {
-		panic("Failed to set a value in redis:" + err.Error())
+	c.startMonitor(err)
+	return c
+}
+
+// check makes sure we can write, read and delete a key
+func (c *RedisCache) check() error {
+	key := c.key("VASCO_START")
+	if err := c.client.Set(key, "test", 0).Err(); err != nil {
+		return errors.New("Failed to set a value in redis:" + err.Error())
 	}
-	if err := c.R.Get("VASCO_START").Err(); err != nil {
-		panic("Failed to get a value from redis:" + err.Error())
+	if err := c.client.Get(key).Err(); err != nil {
+		return errors.New("Failed to get a value from redis:" + err.Error())
 	}
-	if err := c.R.Del("VASCO_START").Err(); err != nil {
-		panic("Failed to delete a value from redis:" + err.Error())
+	if err := c.client.Del(key).Err(); err != nil {
+		return errors.New("Failed to delete a value from redis:" + err.Error())
 	}
+	return nil
+}
 
-	return &c
+// key applies our prefix to a key
+func (c *RedisCache) key(k string) string {
+	return c.prefix + k
 }
 
 func (c *RedisCache) Close() {
-	c.R.Close()
+	c.stopMonitor()
+	c.client.Close()
 }
 
 func (c *RedisCache) Set(key string, value string) error {
-	return c.R.Set(key, value, 0).Err()
+	return c.observe(c.client.Set(c.key(key), value, 0).Err())
+}
+
+func (c *RedisCache) SetWithExpiry(key string, value string, seconds int) error {
+	return c.observe(c.client.Set(c.key(key), value, time.Duration(seconds)*time.Second).Err())
+}
+
+func (c *RedisCache) SetIfAbsent(key string, value string, seconds int) (bool, error) {
+	ok, err := c.client.SetNX(c.key(key), value, time.Duration(seconds)*time.Second).Result()
+	return ok, c.observe(err)
+}
+
+// Batch returns a batch that's executed inside MULTI/EXEC, or for a cluster
+// (which doesn't support MULTI in this client), as a Lua script.
+func (c *RedisCache) Batch() Batch {
+	return newBatch(func(queued []operation) error {
+		// the batch keeps its own operations, in case it's executed again
+		ops := make([]operation, len(queued))
+		for ix, op := range queued {
+			op.Key = c.key(op.Key)
+			ops[ix] = op
+		}
+		client, ok := c.client.(*redis.Client)
+		if !ok {
+			return c.evalBatch(ops)
+		}
+
+		multi := client.Multi()
+		defer multi.Close()
+		_, err := multi.Exec(func() error {
+			for _, op := range ops {
+				switch op.Op {
+				case "set":
+					multi.Set(op.Key, op.Value, 0)
+					if op.Exp != 0 {
+						multi.ExpireAt(op.Key, time.Unix(op.Exp, 0))
+					}
+				case "del":
+					multi.Del(op.Key)
+				case "expireat":
+					multi.ExpireAt(op.Key, time.Unix(op.Exp, 0))
+				case "sadd":
+					multi.SAdd(op.Key, op.Values...)
+				case "srem":
+					multi.SRem(op.Key, op.Values...)
+				}
+			}
+			return nil
+		})
+		return c.observe(err)
+	})
+}
+
+// batchScript applies a batch of operations. Each operation uses the next
+// key, and its arguments are the operation name, the number of values that
+// follow, and then the values.
+const batchScript = `
+local k = 1
+local a = 1
+while a <= #ARGV do
+	local op, n = ARGV[a], tonumber(ARGV[a+1])
+	local key = KEYS[k]
+	a = a + 2
+	k = k + 1
+	if op == "set" then
+		redis.call("SET", key, ARGV[a])
+		if ARGV[a+1] ~= "0" then
+			redis.call("EXPIREAT", key, ARGV[a+1])
+		end
+	elseif op == "del" then
+		redis.call("DEL", key)
+	elseif op == "expireat" then
+		redis.call("EXPIREAT", key, ARGV[a])
+	elseif op == "sadd" and n > 0 then
+		redis.call("SADD", key, unpack(ARGV, a, a+n-1))
+	elseif op == "srem" and n > 0 then
+		redis.call("SREM", key, unpack(ARGV, a, a+n-1))
+	end
+	a = a + n
+end
+return 1
+`
+
+func (c *RedisCache) evalBatch(ops []operation) error {
+	keys := make([]string, 0, len(ops))
+	args := make([]string, 0)
+	for _, op := range ops {
+		var values []string
+		switch op.Op {
+		case "set":
+			values = []string{op.Value, strconv.FormatInt(op.Exp, 10)}
+		case "expireat":
+			values = []string{strconv.FormatInt(op.Exp, 10)}
+		case "sadd", "srem":
+			values = op.Values
+		}
+		keys = append(keys, op.Key)
+		args = append(args, op.Op, strconv.Itoa(len(values)))
+		args = append(args, values...)
+	}
+	return c.observe(c.client.Eval(batchScript, keys, args).Err())
+}
+
+// notFound turns redis' "nil" reply into ErrNotFound
+func notFound(err error) error {
+	if err == redis.Nil {
+		return ErrNotFound
+	}
+	return err
 }
 
 func (c *RedisCache) Get(key string) (string, error) {
-	return c.R.Get(key).Result()
+	value, err := c.client.Get(c.key(key)).Result()
+	return value, notFound(c.observe(err))
 }
 
 func (c *RedisCache) Delete(key string) error {
-	n, err := c.R.Del(key).Result()
+	n, err := c.client.Del(c.key(key)).Result()
 	if err != nil {
-		return err
+		return c.observe(err)
 	}
 	if n == 0 {
-		return errors.New("redis: key did not exist")
+		return ErrNotFound
 	}
 	return nil
 }
 
 func (c *RedisCache) Expire(key string, seconds int) error {
-	return c.R.Expire(key, time.Duration(seconds)*time.Second).Err()
+	return c.observe(c.client.Expire(c.key(key), time.Duration(seconds)*time.Second).Err())
 }
 
 func (c *RedisCache) ExpireAt(key string, timestamp int64) error {
-	return c.R.ExpireAt(key, time.Unix(timestamp, 0)).Err()
+	return c.observe(c.client.ExpireAt(c.key(key), time.Unix(timestamp, 0)).Err())
+}
+
+func (c *RedisCache) TTL(key string) (int, error) {
+	d, err := c.client.TTL(c.key(key)).Result()
+	if err != nil {
+		return 0, c.observe(err)
+	}
+	// redis reports -2 for a missing key and -1 for one with no expiration
+	if d == -2*time.Second {
+		return 0, ErrNotFound
+	}
+	if d < 0 {
+		return -1, nil
+	}
+	return int(d / time.Second), nil
 }
 
 func (c *RedisCache) SAdd(key string, values ...string) error {
-	return c.R.SAdd(key, values...).Err()
+	return c.observe(c.client.SAdd(c.key(key), values...).Err())
 }
 
 func (c *RedisCache) SGet(key string) ([]string, error) {
-	a, err := c.R.SMembers(key).Result()
+	a, err := c.client.SMembers(c.key(key)).Result()
 	if err != nil {
-		return a, err
+		return a, c.observe(err)
 	}
 	if len(a) == 0 {
-		return a, errors.New("redis: sget returned empty list")
+		return a, ErrNotFound
 	}
 	return a, nil
 }
 
 func (c *RedisCache) SRemove(key string, values ...string) error {
-	return c.R.SRem(key, values...).Err()
+	return c.observe(c.client.SRem(c.key(key), values...).Err())
 }
 
 func (c *RedisCache) SCount(key string) (int, error) {
-	count, err := c.R.SCard(key).Result()
+	count, err := c.client.SCard(c.key(key)).Result()
 	if err != nil {
-		return int(count), err
+		return int(count), c.observe(err)
 	}
 	if count == 0 {
-		return 0, errors.New("redis: key did not exist to count")
+		return 0, ErrNotFound
 	}
 	return int(count), nil
 }
 
 func (c *RedisCache) SRandMember(key string) (string, error) {
-	return c.R.SRandMember(key).Result()
+	value, err := c.client.SRandMember(c.key(key)).Result()
+	return value, notFound(c.observe(err))
 }
 
-func (c *RedisCache) ZAdd(key string, score int, value string) error {
-	zkey := "Z" + key
-	return c.R.ZAdd(zkey, redis.Z{Score: float64(score), Member: value}).Err()
+func (c *RedisCache) ZAdd(key string, score float64, value string) error {
+	zkey := c.key("Z" + key)
+	return c.observe(c.client.ZAdd(zkey, redis.Z{Score: score, Member: value}).Err())
 }
 
 func (c *RedisCache) ZRem(key string, value string) error {
-	zkey := "Z" + key
-	return c.R.ZRem(zkey, value).Err()
+	zkey := c.key("Z" + key)
+	return c.observe(c.client.ZRem(zkey, value).Err())
 }
 
 func (c *RedisCache) ZRange(key string, start int, stop int) ([]string, error) {
-	zkey := "Z" + key
-	return c.R.ZRange(zkey, int64(start), int64(stop)).Result()
+	zkey := c.key("Z" + key)
+	values, err := c.client.ZRange(zkey, int64(start), int64(stop)).Result()
+	return values, c.observe(err)
+}
+
+// formatScore writes a score the way redis expects it in a range query
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "+inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
+func (c *RedisCache) ZRangeByScore(key string, min float64, max float64) ([]string, error) {
+	zkey := c.key("Z" + key)
+	values, err := c.client.ZRangeByScore(zkey, redis.ZRangeByScore{Min: formatScore(min), Max: formatScore(max)}).Result()
+	return values, c.observe(err)
+}
+
+func (c *RedisCache) ZScore(key string, value string) (float64, error) {
+	zkey := c.key("Z" + key)
+	score, err := c.client.ZScore(zkey, value).Result()
+	return score, notFound(c.observe(err))
+}
+
+func (c *RedisCache) ZCard(key string) (int, error) {
+	zkey := c.key("Z" + key)
+	count, err := c.client.ZCard(zkey).Result()
+	if err != nil {
+		return int(count), c.observe(err)
+	}
+	if count == 0 {
+		return 0, ErrNotFound
+	}
+	return int(count), nil
 }
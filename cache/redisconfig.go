@@ -0,0 +1,159 @@
+package cache
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/redis.v3"
+)
+
+// RedisOptions describes how to reach redis; it's usually built from a URL by
+// ParseRedisURL.
+type RedisOptions struct {
+	Addrs      []string    // one address, or the sentinels or cluster nodes
+	Password   string      // for AUTH
+	DB         int64       // not allowed in cluster mode
+	TLS        *tls.Config // non-nil to connect with TLS
+	MasterName string      // the sentinel master name; set for sentinel mode
+	Cluster    bool        // cluster mode
+	Prefix     string      // prepended to every key we use
+}
+
+// ParseRedisURL parses the redis connection string. Supported forms are:
+//
+//	host:port
+//	redis://[:password@]host:port[/db][?prefix=p]
+//	rediss://[:password@]host:port[/db][?prefix=p&insecure=true]
+//	redis-sentinel://[:password@]host:port,host:port[/db]?master=name[&prefix=p]
+//	redis-cluster://[:password@]host:port,host:port[?prefix=p]
+//
+// rediss connects with TLS (insecure skips certificate verification). The
+// prefix is prepended to every key so that several Vasco environments can
+// share one redis. In cluster mode, the prefix is wrapped in a hash tag (if it
+// doesn't already have one) so that all of our keys live in the same slot,
+// which is what allows a batch to be applied atomically.
+func ParseRedisURL(rawurl string) (*RedisOptions, error) {
+	if !strings.Contains(rawurl, "://") {
+		if rawurl == "" {
+			return nil, errors.New("redis: no address given")
+		}
+		return &RedisOptions{Addrs: []string{rawurl}}, nil
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	opts := &RedisOptions{Prefix: u.Query().Get("prefix")}
+	if u.User != nil {
+		opts.Password, _ = u.User.Password()
+	}
+	for _, addr := range strings.Split(u.Host, ",") {
+		if addr != "" {
+			opts.Addrs = append(opts.Addrs, addr)
+		}
+	}
+	if len(opts.Addrs) == 0 {
+		return nil, fmt.Errorf("redis: no address in '%s'", rawurl)
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if opts.DB, err = strconv.ParseInt(db, 10, 64); err != nil {
+			return nil, fmt.Errorf("redis: invalid database number '%s'", db)
+		}
+	}
+
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		host, _, _ := net.SplitHostPort(opts.Addrs[0])
+		opts.TLS = &tls.Config{
+			ServerName:         host,
+			InsecureSkipVerify: u.Query().Get("insecure") == "true",
+		}
+	case "redis-sentinel":
+		opts.MasterName = u.Query().Get("master")
+		if opts.MasterName == "" {
+			return nil, errors.New("redis: a sentinel URL needs a master parameter")
+		}
+	case "redis-cluster":
+		opts.Cluster = true
+		if opts.DB != 0 {
+			return nil, errors.New("redis: cluster mode doesn't support database numbers")
+		}
+		if !strings.Contains(opts.Prefix, "{") {
+			tag := opts.Prefix
+			if tag == "" {
+				tag = "vasco"
+			}
+			opts.Prefix = "{" + tag + "}"
+		}
+	default:
+		return nil, fmt.Errorf("redis: unknown scheme '%s'", u.Scheme)
+	}
+	if !opts.Cluster && opts.MasterName == "" && len(opts.Addrs) > 1 {
+		return nil, errors.New("redis: only sentinel and cluster URLs can have more than one address")
+	}
+	return opts, nil
+}
+
+// the redis commands we use, which both kinds of client support
+type redisClient interface {
+	Close() error
+	Ping() *redis.StatusCmd
+	Set(key string, value interface{}, expiration time.Duration) *redis.StatusCmd
+	SetNX(key string, value interface{}, expiration time.Duration) *redis.BoolCmd
+	Get(key string) *redis.StringCmd
+	Del(keys ...string) *redis.IntCmd
+	Expire(key string, expiration time.Duration) *redis.BoolCmd
+	ExpireAt(key string, tm time.Time) *redis.BoolCmd
+	TTL(key string) *redis.DurationCmd
+	SAdd(key string, members ...string) *redis.IntCmd
+	SMembers(key string) *redis.StringSliceCmd
+	SRem(key string, members ...string) *redis.IntCmd
+	SCard(key string) *redis.IntCmd
+	SRandMember(key string) *redis.StringCmd
+	ZAdd(key string, members ...redis.Z) *redis.IntCmd
+	ZRem(key string, members ...string) *redis.IntCmd
+	ZRange(key string, start, stop int64) *redis.StringSliceCmd
+	ZRangeByScore(key string, opt redis.ZRangeByScore) *redis.StringSliceCmd
+	ZScore(key, member string) *redis.FloatCmd
+	ZCard(key string) *redis.IntCmd
+	Eval(script string, keys []string, args []string) *redis.Cmd
+}
+
+// newRedisClient makes the right kind of client for the options
+func newRedisClient(opts *RedisOptions) redisClient {
+	switch {
+	case opts.Cluster:
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:    opts.Addrs,
+			Password: opts.Password,
+		})
+	case opts.MasterName != "":
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    opts.MasterName,
+			SentinelAddrs: opts.Addrs,
+			Password:      opts.Password,
+			DB:            opts.DB,
+		})
+	}
+
+	ropts := &redis.Options{
+		Addr:     opts.Addrs[0],
+		Password: opts.Password,
+		DB:       opts.DB,
+	}
+	if opts.TLS != nil {
+		addr, cfg := opts.Addrs[0], opts.TLS
+		ropts.Dialer = func() (net.Conn, error) {
+			return tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr, cfg)
+		}
+	}
+	return redis.NewClient(ropts)
+}
@@ -0,0 +1,110 @@
+package cache
+
+import (
+	"sync"
+	"time"
+
+	"gopkg.in/redis.v3"
+)
+
+// Keeping track of whether redis is reachable. A monitor goroutine pings
+// redis every few seconds while it's up; when a ping (or any command) fails,
+// the cache is marked unavailable and the monitor retries with exponential
+// backoff until redis answers again. The client reconnects on its own, so
+// nothing else has to change when it comes back -- but while it's down,
+// Available lets the callers skip redis and fall back on what they already
+// know.
+
+const (
+	redisPingInterval = 5 * time.Second
+	redisMinBackoff   = time.Second
+	redisMaxBackoff   = 30 * time.Second
+)
+
+type redisHealth struct {
+	mutex sync.RWMutex
+	err   error         // nil while redis is available
+	check chan struct{} // asks the monitor to check right away
+	done  chan struct{}
+}
+
+func (c *RedisCache) startMonitor(err error) {
+	c.health = &redisHealth{
+		err:   err,
+		check: make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+	go c.monitor()
+}
+
+func (c *RedisCache) stopMonitor() {
+	close(c.health.done)
+}
+
+// Available returns nil if redis is reachable, or the error that says why it
+// isn't.
+func (c *RedisCache) Available() error {
+	c.health.mutex.RLock()
+	defer c.health.mutex.RUnlock()
+	return c.health.err
+}
+
+func (c *RedisCache) setAvailable(err error) {
+	c.health.mutex.Lock()
+	c.health.err = err
+	c.health.mutex.Unlock()
+}
+
+// observe looks at the error from a command; anything other than a missing
+// key might mean we've lost redis, so we ask the monitor to find out. It
+// returns err so that it can wrap a return value.
+func (c *RedisCache) observe(err error) error {
+	if err != nil && err != redis.Nil {
+		select {
+		case c.health.check <- struct{}{}:
+		default:
+		}
+	}
+	return err
+}
+
+func (c *RedisCache) monitor() {
+	backoff := redisMinBackoff
+	for {
+		wait := redisPingInterval
+		// while we're down, failing commands shouldn't cut the backoff short
+		check := c.health.check
+		if c.Available() != nil {
+			wait = backoff
+			check = nil
+		}
+		select {
+		case <-time.After(wait):
+		case <-check:
+		case <-c.health.done:
+			return
+		}
+
+		wasDown := c.Available() != nil
+		var err error
+		if wasDown {
+			err = c.check()
+		} else {
+			err = c.client.Ping().Err()
+		}
+		switch {
+		case err == nil && wasDown:
+			events.Info("redis available again")
+			backoff = redisMinBackoff
+		case err != nil && !wasDown:
+			events.Warn("redis unavailable", "err", err)
+		case err != nil:
+			backoff *= 2
+			if backoff > redisMaxBackoff {
+				backoff = redisMaxBackoff
+			}
+			events.Warn("redis still unavailable", "retry", backoff.String(), "err", err)
+		}
+		c.setAvailable(err)
+	}
+}
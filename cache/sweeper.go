@@ -0,0 +1,110 @@
+package cache
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Active expiration for the LocalCache. Every key that's given an expiration
+// time is pushed onto a heap ordered by that time, and once a second the
+// sweeper pops everything that is due and deletes it (if the key still has
+// the same expiration -- it may have been overwritten or re-expired since it
+// was pushed, in which case the heap entry is simply dropped). Expired keys
+// are still removed lazily when they're read, too; either way the expiry
+// callbacks are called exactly once per expired key.
+
+const sweepInterval = time.Second
+
+type expiry struct {
+	exp int64
+	key string
+}
+
+// ----- heap helpers  -------
+type expiryHeap []expiry
+
+func (h expiryHeap) Len() int            { return len(h) }
+func (h expiryHeap) Less(i, j int) bool  { return h[i].exp < h[j].exp }
+func (h expiryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x interface{}) { *h = append(*h, x.(expiry)) }
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// ----- end heap helpers  -------
+
+type sweeper struct {
+	expiries  expiryHeap // protected by the cache's valuemutex
+	callbacks []func(key string, value string)
+	cbmutex   sync.RWMutex
+	done      chan struct{}
+}
+
+func (c *LocalCache) startSweeper() {
+	c.sweeper = &sweeper{done: make(chan struct{})}
+	go func() {
+		ticker := time.NewTicker(sweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				c.sweep(time.Time.Unix(now))
+			case <-c.sweeper.done:
+				return
+			}
+		}
+	}()
+}
+
+func (c *LocalCache) stopSweeper() {
+	close(c.sweeper.done)
+}
+
+// OnExpire registers a function to be called whenever a key expires, with
+// the key and the value it had. It's called from the sweeper goroutine (or
+// whichever goroutine noticed the expiration) without any locks held.
+func (c *LocalCache) OnExpire(f func(key string, value string)) {
+	c.sweeper.cbmutex.Lock()
+	c.sweeper.callbacks = append(c.sweeper.callbacks, f)
+	c.sweeper.cbmutex.Unlock()
+}
+
+// scheduleExpiry must be called with valuemutex held.
+func (c *LocalCache) scheduleExpiry(key string, exp int64) {
+	if exp != 0 {
+		heap.Push(&c.sweeper.expiries, expiry{exp: exp, key: key})
+	}
+}
+
+// sweep deletes every key that has expired as of now.
+func (c *LocalCache) sweep(now int64) {
+	expired := make(map[string]string)
+	c.valuemutex.Lock()
+	h := &c.sweeper.expiries
+	for h.Len() > 0 && (*h)[0].exp <= now {
+		e := heap.Pop(h).(expiry)
+		if v, ok := c.values[e.key]; ok && v.exp == e.exp {
+			delete(c.values, e.key)
+			expired[e.key] = v.value
+		}
+	}
+	c.valuemutex.Unlock()
+
+	for key, value := range expired {
+		c.notifyExpired(key, value)
+	}
+}
+
+func (c *LocalCache) notifyExpired(key string, value string) {
+	c.sweeper.cbmutex.RLock()
+	callbacks := c.sweeper.callbacks
+	c.sweeper.cbmutex.RUnlock()
+	for _, f := range callbacks {
+		f(key, value)
+	}
+}
@@ -0,0 +1,226 @@
+package cache
+
+import "math/rand"
+
+// A sorted set for the LocalCache, built the same way as the one in redis:
+// a map from member to score for O(1) lookups, plus a skiplist ordered by
+// (score, member) for O(log n) inserts, deletes and rank or score lookups.
+// Each level of the skiplist records the span (number of nodes skipped) of
+// its forward link so that we can compute ranks as we walk it.
+
+const (
+	zMaxLevel    = 32
+	zProbability = 0.25
+)
+
+type zLevel struct {
+	forward *zNode
+	span    int
+}
+
+type zNode struct {
+	member string
+	score  float64
+	level  []zLevel
+}
+
+type skiplist struct {
+	head   *zNode
+	length int
+	level  int
+}
+
+type zset struct {
+	scores map[string]float64
+	list   *skiplist
+}
+
+func newZSet() *zset {
+	return &zset{
+		scores: make(map[string]float64),
+		list:   newSkiplist(),
+	}
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		head:  &zNode{level: make([]zLevel, zMaxLevel)},
+		level: 1,
+	}
+}
+
+// ----- zset -------
+
+// add inserts or updates a member
+func (z *zset) add(score float64, member string) {
+	if old, ok := z.scores[member]; ok {
+		if old == score {
+			return
+		}
+		z.list.remove(old, member)
+	}
+	z.scores[member] = score
+	z.list.insert(score, member)
+}
+
+// remove deletes a member, returning false if it wasn't there
+func (z *zset) remove(member string) bool {
+	score, ok := z.scores[member]
+	if !ok {
+		return false
+	}
+	delete(z.scores, member)
+	z.list.remove(score, member)
+	return true
+}
+
+func (z *zset) card() int {
+	return z.list.length
+}
+
+// rangeByRank returns the members from start to stop inclusive (0-based;
+// negative values count back from the end, as in redis)
+func (z *zset) rangeByRank(start, stop int) []string {
+	values := make([]string, 0)
+	n := z.list.length
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start > stop || start >= n {
+		return values
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	for x := z.list.nodeByRank(start); x != nil && start <= stop; x = x.level[0].forward {
+		values = append(values, x.member)
+		start++
+	}
+	return values
+}
+
+// rangeByScore returns the members with min <= score <= max
+func (z *zset) rangeByScore(min, max float64) []string {
+	values := make([]string, 0)
+	for x := z.list.firstAtLeast(min); x != nil && x.score <= max; x = x.level[0].forward {
+		values = append(values, x.member)
+	}
+	return values
+}
+
+// ----- skiplist -------
+
+func randomLevel() int {
+	level := 1
+	for level < zMaxLevel && rand.Float64() < zProbability {
+		level++
+	}
+	return level
+}
+
+// less orders nodes by score, then by member
+func (x *zNode) less(score float64, member string) bool {
+	return x.score < score || (x.score == score && x.member < member)
+}
+
+func (sl *skiplist) insert(score float64, member string) {
+	var update [zMaxLevel]*zNode
+	var rank [zMaxLevel]int
+
+	x := sl.head
+	for i := sl.level - 1; i >= 0; i-- {
+		if i < sl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && x.level[i].forward.less(score, member) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	level := randomLevel()
+	if level > sl.level {
+		for i := sl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = sl.head
+			update[i].level[i].span = sl.length
+		}
+		sl.level = level
+	}
+
+	x = &zNode{member: member, score: score, level: make([]zLevel, level)}
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = rank[0] - rank[i] + 1
+	}
+	// the levels above the new node now skip over one more node
+	for i := level; i < sl.level; i++ {
+		update[i].level[i].span++
+	}
+	sl.length++
+}
+
+func (sl *skiplist) remove(score float64, member string) {
+	var update [zMaxLevel]*zNode
+
+	x := sl.head
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && x.level[i].forward.less(score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	x = x.level[0].forward
+	if x == nil || x.score != score || x.member != member {
+		return
+	}
+
+	for i := 0; i < sl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+	for sl.level > 1 && sl.head.level[sl.level-1].forward == nil {
+		sl.level--
+	}
+	sl.length--
+}
+
+// nodeByRank returns the node at a 0-based rank
+func (sl *skiplist) nodeByRank(rank int) *zNode {
+	traversed := 0
+	x := sl.head
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank+1 {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank+1 {
+			return x
+		}
+	}
+	return nil
+}
+
+// firstAtLeast returns the first node with a score >= min
+func (sl *skiplist) firstAtLeast(min float64) *zNode {
+	x := sl.head
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && x.level[i].forward.score < min {
+			x = x.level[i].forward
+		}
+	}
+	return x.level[0].forward
+}
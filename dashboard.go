@@ -0,0 +1,183 @@
+package main
+
+import (
+	"io"
+	"net/http"
+)
+
+func (v *Vasco) statusDashboard(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(rw, dashboardHTML)
+}
+
+// dashboardHTML is the whole status dashboard; it has no external assets, and
+// it fetches everything it shows from the other status endpoints (relative to
+// its own URL, so it works behind a proxy too).
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Vasco status</title>
+<style>
+  body { font-family: -apple-system, Helvetica, Arial, sans-serif; margin: 1.5em; color: #222; }
+  h1 { font-size: 1.4em; margin: 0 0 0.3em 0; }
+  #verdict { display: inline-block; padding: 0.2em 0.6em; border-radius: 4px; color: #fff; font-weight: bold; }
+  .ok { background: #2e7d32; }
+  .degraded { background: #ef6c00; }
+  .critical { background: #c62828; }
+  #counts, #updated, #problems { margin: 0.4em 0; }
+  #problems li { color: #c62828; }
+  table { border-collapse: collapse; width: 100%; margin-top: 1em; }
+  th, td { text-align: left; padding: 0.3em 0.6em; border-bottom: 1px solid #ddd; font-size: 0.9em; }
+  th { background: #f5f5f5; }
+  td.state { font-weight: bold; }
+  td.up { color: #2e7d32; }
+  td.failing { color: #ef6c00; }
+  td.down, td.missing { color: #c62828; }
+  .mark { font-size: 0.8em; padding: 0.1em 0.4em; border-radius: 3px; background: #eee; margin-left: 0.3em; }
+  .error { color: #c62828; }
+</style>
+</head>
+<body>
+<h1>Vasco status <span id="verdict"></span></h1>
+<div id="counts"></div>
+<ul id="problems"></ul>
+<div id="updated"></div>
+<table>
+  <thead>
+    <tr>
+      <th>Name</th><th>State</th><th>Code</th><th>Version</th><th>Address</th>
+      <th>Disabled</th><th>Since</th><th>Up 1h</th><th>Up 24h</th><th>Changes</th>
+    </tr>
+  </thead>
+  <tbody id="services"></tbody>
+</table>
+<script>
+(function() {
+  var REFRESH = 10000;
+  var base = location.pathname.replace(/\/dashboard\/?$/, "");
+
+  function getJSON(path, done) {
+    var xhr = new XMLHttpRequest();
+    xhr.open("GET", base + path);
+    xhr.setRequestHeader("Accept", "application/json");
+    xhr.onload = function() {
+      // /status answers with an error code when things are bad, but the body
+      // is still what we want
+      try { done(null, JSON.parse(xhr.responseText)); }
+      catch (e) { done(e); }
+    };
+    xhr.onerror = function() { done(new Error("request failed")); };
+    xhr.send();
+  }
+
+  function el(tag, text, cls) {
+    var e = document.createElement(tag);
+    if (text !== undefined && text !== null) { e.textContent = text; }
+    if (cls) { e.className = cls; }
+    return e;
+  }
+
+  function state(item) {
+    if (item.missing) { return "missing"; }
+    if (item.disabled || item.Error) { return "down"; }
+    if (!item.StatusCode || item.StatusCode < 200 || item.StatusCode > 299) { return "failing"; }
+    return "up";
+  }
+
+  function ago(seconds) {
+    if (seconds === undefined) { return ""; }
+    if (seconds < 120) { return seconds + "s"; }
+    if (seconds < 7200) { return Math.floor(seconds / 60) + "m"; }
+    if (seconds < 172800) { return Math.floor(seconds / 3600) + "h"; }
+    return Math.floor(seconds / 86400) + "d";
+  }
+
+  function pct(avail, win) {
+    if (!avail || avail[win] === undefined) { return ""; }
+    return avail[win].toFixed(1) + "%";
+  }
+
+  function showSummary(err, sum) {
+    var verdict = document.getElementById("verdict");
+    var problems = document.getElementById("problems");
+    problems.innerHTML = "";
+    if (err) {
+      verdict.textContent = "unknown";
+      verdict.className = "critical";
+      return;
+    }
+    verdict.textContent = sum.state;
+    verdict.className = sum.state;
+    document.getElementById("counts").textContent =
+      sum.up + " up, " + sum.failing + " failing, " + sum.down + " down, " +
+      sum.missing + " missing, " + sum.unexpected + " unexpected; cache " + sum.cache;
+    (sum.problems || []).forEach(function(p) { problems.appendChild(el("li", p)); });
+  }
+
+  function showServices(err, items) {
+    var tbody = document.getElementById("services");
+    if (err) {
+      tbody.innerHTML = "";
+      var row = el("tr");
+      var cell = el("td", "Couldn't load status: " + err.message, "error");
+      cell.colSpan = 10;
+      row.appendChild(cell);
+      tbody.appendChild(row);
+      return;
+    }
+    var rows = [];
+    var names = {};
+    items.forEach(function(item) {
+      var s = state(item);
+      var name = el("td", item.Name);
+      if (item.unexpected) { name.appendChild(el("span", "unexpected", "mark")); }
+      if (item.missing) { name.appendChild(el("span", "expected", "mark")); }
+      var row = el("tr");
+      row.appendChild(name);
+      row.appendChild(el("td", s, "state " + s));
+      row.appendChild(el("td", item.StatusCode));
+      row.appendChild(el("td", item.deploytag || item.revision || ""));
+      row.appendChild(el("td", item.Address || ""));
+      row.appendChild(el("td", item.disabled ? "yes" : ""));
+      var history = [el("td"), el("td"), el("td"), el("td")];
+      history.forEach(function(c) { row.appendChild(c); });
+      rows.push(row);
+      if (item.Name !== "vasco") {
+        (names[item.Name] = names[item.Name] || []).push({address: item.Address || "", cells: history});
+      }
+    });
+    tbody.innerHTML = "";
+    rows.forEach(function(r) { tbody.appendChild(r); });
+
+    Object.keys(names).forEach(function(name) {
+      getJSON("/history/" + encodeURIComponent(name), function(err, hist) {
+        if (err || !hist.instances) { return; }
+        hist.instances.forEach(function(inst) {
+          names[name].forEach(function(row) {
+            if (row.address !== inst.address) { return; }
+            row.cells[0].textContent = ago(inst.sinceSeconds);
+            row.cells[1].textContent = pct(inst.availability, "1h");
+            row.cells[2].textContent = pct(inst.availability, "24h");
+            row.cells[3].textContent = inst.transitions.slice(-3).map(function(t) {
+              return t.from + "→" + t.to + " " + new Date(t.time).toLocaleTimeString();
+            }).join(", ");
+          });
+        });
+      });
+    });
+  }
+
+  function refresh() {
+    getJSON("", showSummary);
+    getJSON("/detail", showServices);
+    document.getElementById("updated").textContent = "Updated " + new Date().toLocaleTimeString();
+  }
+
+  refresh();
+  setInterval(refresh, REFRESH);
+})();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The proxy tells backends about the original request with the usual
+// headers:
+//
+//	X-Forwarded-For     the client, and any proxies before us
+//	X-Forwarded-Host    the Host the client asked for
+//	X-Forwarded-Proto   http or https
+//	X-Forwarded-Port    the port the client connected to
+//	X-Forwarded-Prefix  the part of the path a pattern like /foo(/.*) removed
+//	Forwarded           all of the above, as RFC 7239 has it
+//	Via                 that the request came through us
+//
+// A client could send these itself, so we only believe incoming values from
+// the proxies listed (as addresses or CIDRs) in TRUSTED_PROXIES; from anyone
+// else they're replaced. Backends get their own address as the Host unless
+// PRESERVE_HOST is true.
+
+type forwardPolicy struct {
+	trusted      []*net.IPNet
+	preserveHost bool
+}
+
+func loadForwardPolicy() (*forwardPolicy, error) {
+	p := &forwardPolicy{}
+	for _, entry := range strings.Fields(getEnvWithDefault("TRUSTED_PROXIES", "")) {
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy '%s'", entry)
+		}
+		p.trusted = append(p.trusted, network)
+	}
+	preserve, err := strconv.ParseBool(getEnvWithDefault("PRESERVE_HOST", "false"))
+	if err != nil {
+		return nil, fmt.Errorf("PRESERVE_HOST must be true or false")
+	}
+	p.preserveHost = preserve
+	return p, nil
+}
+
+func (p *forwardPolicy) trusts(addr string) bool {
+	ip := net.ParseIP(strings.TrimSpace(addr))
+	if ip == nil {
+		return false
+	}
+	for _, network := range p.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is the address of the real client: the closest address (walking
+// back through X-Forwarded-For) that isn't one of our trusted proxies.
+func (p *forwardPolicy) clientIP(req *http.Request) string {
+	ip := remoteIP(req)
+	if !p.trusts(ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(req.Header["X-Forwarded-For"], ","), ",")
+	for ix := len(hops) - 1; ix >= 0; ix-- {
+		hop := strings.TrimSpace(hops[ix])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !p.trusts(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// setHeaders sets the forwarding headers on an outgoing request; it must be
+// called before the URL is rewritten, and rewritten is the path the backend
+// will see.
+func (p *forwardPolicy) setHeaders(req *http.Request, rewritten string) {
+	h := req.Header
+	trusted := p.trusts(remoteIP(req))
+	if !trusted {
+		for _, name := range []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Forwarded-Port", "X-Forwarded-Prefix", "Forwarded"} {
+			h.Del(name)
+		}
+	}
+
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	port := "80"
+	if proto == "https" {
+		port = "443"
+	}
+	if _, hostPort, err := net.SplitHostPort(req.Host); err == nil {
+		port = hostPort
+	}
+	// the proxy below adds the client to X-Forwarded-For itself
+	setIfAbsent(h, "X-Forwarded-Host", req.Host)
+	setIfAbsent(h, "X-Forwarded-Proto", proto)
+	setIfAbsent(h, "X-Forwarded-Port", port)
+	if prefix := strings.TrimSuffix(req.URL.Path, rewritten); prefix != req.URL.Path && prefix != "" {
+		h.Set("X-Forwarded-Prefix", h.Get("X-Forwarded-Prefix")+prefix)
+	}
+
+	forwarded := fmt.Sprintf("for=%s;host=%s;proto=%s", forwardedNode(remoteIP(req)), forwardedValue(req.Host), proto)
+	if prior := h.Get("Forwarded"); prior != "" {
+		forwarded = prior + ", " + forwarded
+	}
+	h.Set("Forwarded", forwarded)
+	via := fmt.Sprintf("%d.%d vasco", req.ProtoMajor, req.ProtoMinor)
+	if prior := h.Get("Via"); prior != "" {
+		via = prior + ", " + via
+	}
+	h.Set("Via", via)
+}
+
+func setIfAbsent(h http.Header, name, value string) {
+	if h.Get(name) == "" {
+		h.Set(name, value)
+	}
+}
+
+// forwardedNode formats an address for Forwarded; IPv6 is bracketed and quoted
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return forwardedValue(ip)
+}
+
+// forwardedValue quotes a value unless it's an RFC 7230 token
+func forwardedValue(value string) string {
+	for _, c := range value {
+		if c > '~' || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return strconv.Quote(value)
+		}
+	}
+	return value
+}
+
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func withClientIP(req *http.Request, ip string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), clientIPKey, ip))
+}
@@ -2,9 +2,8 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
-	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -20,7 +19,21 @@ import (
 // a bunch of http traffic, we don't want to hammer the servers during
 // startup, so we just do it "soon".
 func (v *Vasco) refreshStatusSoon() {
-	v.statusTimer.AtMost(2 * time.Second)
+	v.timerMutex.Lock()
+	defer v.timerMutex.Unlock()
+	// the timer doesn't exist until we're done starting up
+	if v.statusTimer != nil {
+		v.statusTimer.AtMost(2 * time.Second)
+	}
+}
+
+// startStatusTimer starts the status loop, with the first update no later
+// than first.
+func (v *Vasco) startStatusTimer(loop time.Duration, first time.Duration) {
+	v.timerMutex.Lock()
+	defer v.timerMutex.Unlock()
+	v.statusTimer = NewLoopTimer(250*time.Millisecond, loop, v.statusUpdate)
+	v.statusTimer.AtMost(first)
 }
 
 func (v *Vasco) register(rw http.ResponseWriter, req *http.Request) {
@@ -29,21 +42,20 @@ func (v *Vasco) register(rw http.ResponseWriter, req *http.Request) {
 	dec := json.NewDecoder(req.Body)
 	err := dec.Decode(reg)
 	if err != nil {
-		log.Println("Couldn't read registration request: ", err.Error())
+		registryLog.Warn("couldn't read registration request", "err", err)
 		util.WriteNewWebError(rw, http.StatusBadRequest, "VAS-100", err.Error())
 		return
 	}
 	if err := reg.SetDefaults(); err != nil {
-		log.Println("Couldn't set defaults: ", err.Error())
+		registryLog.Warn("couldn't set registration defaults", "err", err)
 		util.WriteNewWebError(rw, http.StatusBadRequest, "VAS-101", err.Error())
 		return
 	}
 	hash := v.registry.Register(reg, true)
-	log.Printf("Registered %s %s as %s \n", reg.Name, reg.Address, hash)
 
 	r2 := v.registry.Find(hash)
 	if r2 == nil {
-		log.Printf("Unable to find the hash we just registered!")
+		registryLog.Error("unable to find the hash we just registered", "hash", hash)
 	}
 
 	util.WriteJSON(rw, hash)
@@ -53,13 +65,13 @@ func (v *Vasco) refresh(rw http.ResponseWriter, req *http.Request) {
 	hash := bone.GetValue(req, "hash")
 	reg := v.registry.Find(hash)
 	if reg == nil {
-		log.Printf("FAILED: Refresh call for '%s'\n", hash)
+		registryLog.Warn("refresh for an unknown registration", "hash", hash)
 		util.WriteNewWebError(rw, http.StatusNotFound, "VAS-102", "No registration found for that hash.")
 		return
 	}
 	v.registry.Refresh(reg)
 	v.refreshStatusSoon()
-	log.Printf("Refreshing %s %s\n", reg.Name, reg.Address)
+	registryLog.Debug("refreshed", "hash", hash, "name", reg.Name, "address", reg.Address)
 }
 
 func (v *Vasco) testRegistration(rw http.ResponseWriter, req *http.Request) {
@@ -68,70 +80,202 @@ func (v *Vasco) testRegistration(rw http.ResponseWriter, req *http.Request) {
 		util.WriteNewWebError(rw, http.StatusNotFound, "VAS-103", "url query parameter required")
 		return
 	}
-	match, err := v.registry.FindBestMatch(u)
+	upstream, err := url.Parse(u)
+	if err != nil {
+		util.WriteNewWebError(rw, http.StatusBadRequest, "VAS-103", "url query parameter is not a valid URL")
+		return
+	}
+	if explain, _ := strconv.ParseBool(req.URL.Query().Get("explain")); explain {
+		util.WriteJSONPretty(rw, v.registry.Explain(upstream))
+		return
+	}
+	match, err := v.registry.Route(upstream)
 	if err != nil {
 		util.WriteNewWebError(rw, http.StatusNotFound, "VAS-101", err.Error())
 		return
 	}
-	util.WriteJSON(rw, match)
+	util.WriteJSON(rw, routeTest{Registration: match, Upstream: upstream.String()})
+}
+
+// routeTest is the registration a URL would go to, and the URL it would be
+// sent to
+type routeTest struct {
+	*registry.Registration
+	Upstream string `json:"upstream"`
 }
 
 func (v *Vasco) unregister(rw http.ResponseWriter, req *http.Request) {
 	hash := bone.GetValue(req, "hash")
 	v.registry.Unregister(v.registry.Find(hash))
-	log.Printf("Unregistered %s\n", hash)
+	registryLog.Info("unregistered", "hash", hash)
 	v.refreshStatusSoon()
 }
 
-// the status request always returns 200 because we need to be able to
-// examine status to figure out what's going on.
-func (v *Vasco) statusGeneral(rw http.ResponseWriter, req *http.Request) {
-	for _, v := range v.lastStatus {
-		stat := v["StatusCode"]
-		if stat == nil || stat.(int) < 200 || stat.(int) > 299 {
-			log.Printf("Status problem %d on %s", stat, v["Name"])
-		}
+func (v *Vasco) leasePort(rw http.ResponseWriter, req *http.Request) {
+	name := req.URL.Query().Get("name")
+	if name == "" {
+		util.WriteNewWebError(rw, http.StatusBadRequest, "VAS-110", "name query parameter required")
+		return
+	}
+	lease, err := v.registry.LeasePort(name)
+	if err == registry.ErrNoPorts {
+		util.WriteNewWebError(rw, http.StatusServiceUnavailable, "VAS-111", err.Error())
+		return
+	} else if err != nil {
+		util.WriteNewWebError(rw, http.StatusInternalServerError, "VAS-111", err.Error())
+		return
 	}
+	util.WriteJSON(rw, lease)
 }
 
-// the status strict request returns 200 only if all expected servers are up,
-// and 500 if any of them are down.
-// The body of the response includes information on which servers are
-// being problematic.
-func (v *Vasco) statusStrict(rw http.ResponseWriter, req *http.Request) {
-	retcode := 200
-	names := []string{}
-	for _, v := range v.lastStatus {
-		stat := v["StatusCode"]
-		if stat == nil || stat.(int) < 200 || stat.(int) > 299 {
-			log.Printf("Status problem %d on %s", stat, v["Name"])
-			retcode = stat.(int)
-			names = append(names, v["Name"].(string))
-		}
+// portParam returns the port in the URL, or writes an error and returns 0
+func portParam(rw http.ResponseWriter, req *http.Request) int {
+	port, err := strconv.Atoi(bone.GetValue(req, "port"))
+	if err != nil || port <= 0 {
+		util.WriteNewWebError(rw, http.StatusBadRequest, "VAS-113", "The port must be a number.")
+		return 0
+	}
+	return port
+}
+
+func (v *Vasco) findPort(rw http.ResponseWriter, req *http.Request) {
+	port := portParam(rw, req)
+	if port == 0 {
+		return
 	}
-	if retcode != 200 {
-		util.WriteNewWebError(rw, retcode, "STAT-500", strings.Join(names, ","))
+	lease := v.registry.FindPort(port)
+	if lease == nil {
+		util.WriteNewWebError(rw, http.StatusNotFound, "VAS-112", registry.ErrNoLease.Error())
+		return
 	}
+	util.WriteJSON(rw, lease)
 }
 
-const sumfmt = "%7s %6s %26s  %s\n"
+// writeLeaseError answers a refresh or release that the registry turned down
+func writeLeaseError(rw http.ResponseWriter, err error) {
+	if err == registry.ErrNotLeasee {
+		util.WriteNewWebError(rw, http.StatusConflict, "VAS-117", err.Error())
+		return
+	}
+	util.WriteNewWebError(rw, http.StatusNotFound, "VAS-112", err.Error())
+}
 
-func (v *Vasco) statusSummary(rw http.ResponseWriter, req *http.Request) {
-	fmt.Fprintf(rw, sumfmt, "State", "Code", "Ver", "Name")
-	for _, v := range v.lastStatus {
-		stat := v["StatusCode"]
-		name := v["Name"]
-		tag := v["deploytag"]
-		if tag == nil || tag == "" {
-			tag = "unknown"
-		}
-		state := "ok"
-		if stat == nil || stat.(int) < 200 || stat.(int) > 299 {
-			state = "NOT OK"
+func (v *Vasco) refreshPort(rw http.ResponseWriter, req *http.Request) {
+	port := portParam(rw, req)
+	if port == 0 {
+		return
+	}
+	name := req.URL.Query().Get("name")
+	if name == "" {
+		util.WriteNewWebError(rw, http.StatusBadRequest, "VAS-110", "name query parameter required")
+		return
+	}
+	if err := v.registry.RefreshPort(port, name); err != nil {
+		registryLog.Warn("refresh refused", "port", port, "name", name, "err", err)
+		writeLeaseError(rw, err)
+	}
+}
+
+func (v *Vasco) releasePort(rw http.ResponseWriter, req *http.Request) {
+	port := portParam(rw, req)
+	if port == 0 {
+		return
+	}
+	name := req.URL.Query().Get("name")
+	if name == "" {
+		util.WriteNewWebError(rw, http.StatusBadRequest, "VAS-110", "name query parameter required")
+		return
+	}
+	if err := v.registry.ReleasePort(port, name); err != nil {
+		registryLog.Warn("release refused", "port", port, "name", name, "err", err)
+		writeLeaseError(rw, err)
+	}
+}
+
+func (v *Vasco) exportRegistry(rw http.ResponseWriter, req *http.Request) {
+	util.WriteJSONPretty(rw, v.registry.Export())
+}
+
+func (v *Vasco) importRegistry(rw http.ResponseWriter, req *http.Request) {
+	qp := req.URL.Query()
+	mode := qp.Get("mode")
+	if mode == "" {
+		mode = registry.ImportMerge
+	}
+	dryRun := qp.Get("dryrun") != ""
+
+	var snap = new(registry.Snapshot)
+	dec := json.NewDecoder(req.Body)
+	if err := dec.Decode(snap); err != nil {
+		registryLog.Warn("couldn't read snapshot", "err", err)
+		util.WriteNewWebError(rw, http.StatusBadRequest, "VAS-104", err.Error())
+		return
+	}
+	result, err := v.registry.Import(snap, mode, dryRun)
+	if err != nil {
+		registryLog.Warn("couldn't import snapshot", "err", err)
+		util.WriteNewWebError(rw, http.StatusBadRequest, "VAS-105", err.Error())
+		return
+	}
+	if !dryRun {
+		v.refreshStatusSoon()
+	}
+	if len(result.Failed) > 0 {
+		registryLog.Warn("snapshot import incomplete", "failed", len(result.Failed))
+		writeJSONWithCode(rw, http.StatusInternalServerError, result)
+		return
+	}
+	util.WriteJSON(rw, result)
+}
+
+// the status request summarizes the most recent status and decides on an
+// overall state; the response code for each state is set by the status
+// rules, so it can still return 200 when we need to be able to examine
+// status to figure out what's going on.
+func (v *Vasco) statusGeneral(rw http.ResponseWriter, req *http.Request) {
+	sum := v.statusRules.Summarize(v.lastStatus, v.registry.CacheError())
+	for _, problem := range sum.Problems {
+		vascoLog.Warn("status problem", "problem", problem)
+	}
+	writeJSONWithCode(rw, v.statusRules.Code(sum), sum)
+}
+
+// writeJSONWithCode is like util.WriteJSON, but with a status code
+func writeJSONWithCode(rw http.ResponseWriter, code int, data interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	if err := json.NewEncoder(rw).Encode(data); err != nil {
+		vascoLog.Warn("couldn't write response", "err", err)
+	}
+}
+
+// the status strict request returns 200 only if every requirement is met,
+// and 500 if any of them aren't. By default every instance of every service
+// must be up; requirements from the configuration file and the query
+// parameters can instead ask for a minimum number of healthy instances, and
+// for particular revisions or deploy tags.
+// The body of the response lists each violated requirement.
+func (v *Vasco) statusStrict(rw http.ResponseWriter, req *http.Request) {
+	reqs, err := parseRequirements(req.URL.Query(), v.configRequirements())
+	if err != nil {
+		util.WriteNewWebError(rw, http.StatusBadRequest, "VAS-106", err.Error())
+		return
+	}
+	result := StrictResult{Violations: strictViolations(v.lastStatus, reqs)}
+	result.OK = len(result.Violations) == 0
+	retcode := http.StatusOK
+	if !result.OK {
+		retcode = http.StatusInternalServerError
+		for _, viol := range result.Violations {
+			vascoLog.Warn("status problem", "name", viol.Service, "address", viol.Address,
+				"requirement", viol.Requirement, "expected", viol.Expected, "actual", viol.Actual)
 		}
-		fmt.Fprintf(rw, sumfmt, state, strconv.FormatInt(int64(stat.(int)), 10), tag, name)
 	}
+	writeJSONWithCode(rw, retcode, result)
+}
 
+func (v *Vasco) statusSummary(rw http.ResponseWriter, req *http.Request) {
+	writeStatus(rw, req, v.registry.WithInFlight(v.lastStatus), formatText)
 	v.refreshStatusSoon()
 }
 
@@ -155,7 +299,21 @@ func (v *Vasco) statusDetail(rw http.ResponseWriter, req *http.Request) {
 	} else {
 		v.refreshStatusSoon()
 	}
-	util.WriteJSONPretty(rw, v.lastStatus)
+	writeStatus(rw, req, v.registry.WithInFlight(v.lastStatus), formatJSON)
+}
+
+func (v *Vasco) statusHistory(rw http.ResponseWriter, req *http.Request) {
+	name := bone.GetValue(req, "name")
+	hist := v.registry.History(name, time.Now())
+	if hist == nil {
+		util.WriteNewWebError(rw, http.StatusNotFound, "VAS-107", "No status history for that name.")
+		return
+	}
+	util.WriteJSONPretty(rw, hist)
+}
+
+func (v *Vasco) testAlerts(rw http.ResponseWriter, req *http.Request) {
+	util.WriteJSON(rw, v.alerter.Test(time.Now()))
 }
 
 func (v *Vasco) statusUpdate() {
@@ -165,6 +323,8 @@ func (v *Vasco) statusUpdate() {
 		statTime = 60
 	}
 	v.lastStatus = v.registry.DetailedStatus()
+	v.registry.RecordStatus(v.lastStatus, time.Now())
+	v.alerter.Observe(v.lastStatus, time.Now())
 	vascostat := registry.StatusItem{
 		"Name":          "vasco",
 		"Port":          getEnvWithDefault("VASCO_REGISTRY", "8081"),
@@ -174,6 +334,13 @@ func (v *Vasco) statusUpdate() {
 		"configtype":    os.Getenv("DEPLOYTYPE"),
 		"configversion": os.Getenv("CONFIGVERSION"),
 		"pid":           os.Getpid(),
+		"expirations":   v.registry.Expirations(),
+		"cache":         "ok",
+	}
+	if err := v.registry.CacheError(); err != nil {
+		// we're still routing, but from what we knew before the cache failed
+		vascostat["cache"] = "degraded"
+		vascostat["cacheError"] = err.Error()
 	}
 	if ip, err := util.ExternalIP(); err != nil {
 		vascostat["ip"] = err.Error()
@@ -0,0 +1,202 @@
+/**
+ * Name: logger.go
+ * Description: Structured, levelled logging
+ * Copyright 2016 The Achievement Network. All rights reserved.
+ */
+
+// Package logger writes structured log lines, as logfmt or JSON, with levels.
+// Every Logger writes through the one shared configuration, so Configure
+// (usually called once, from main) affects loggers that were created before
+// it was called.
+//
+// Fields are given as alternating keys and values:
+//
+//	log := logger.Named("registry")
+//	log.Info("registered", "name", reg.Name, "hash", hash)
+//
+// writes something like
+//
+//	time=2016-03-01T12:00:00Z level=info log=registry msg=registered name=user hash=4f1c...
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < DebugLevel || l > ErrorLevel {
+		return "unknown"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel turns debug, info, warn or error into a Level.
+func ParseLevel(s string) (Level, error) {
+	for ix, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(ix), nil
+		}
+	}
+	return InfoLevel, fmt.Errorf("unknown log level '%s' (should be debug, info, warn or error)", s)
+}
+
+// Formats
+const (
+	FormatLogfmt = "logfmt"
+	FormatJSON   = "json"
+)
+
+type config struct {
+	mutex  sync.Mutex
+	out    io.Writer
+	format string
+	level  Level
+}
+
+var std = &config{out: os.Stderr, format: FormatLogfmt, level: InfoLevel}
+
+// Configure sets where every logger writes, in what format, and the lowest
+// level that's written.
+func Configure(out io.Writer, format string, level Level) error {
+	if format != FormatLogfmt && format != FormatJSON {
+		return fmt.Errorf("unknown log format '%s' (should be %s or %s)", format, FormatLogfmt, FormatJSON)
+	}
+	std.mutex.Lock()
+	defer std.mutex.Unlock()
+	std.out = out
+	std.format = format
+	std.level = level
+	return nil
+}
+
+// Logger adds its fields to everything it logs.
+type Logger struct {
+	fields []interface{}
+}
+
+// Named returns a logger for one kind of log (access, registry, and so on).
+func Named(name string) *Logger {
+	return &Logger{fields: []interface{}{"log", name}}
+}
+
+// With returns a logger with more fields.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{fields: fields}
+}
+
+// Enabled reports whether anything at level would be written.
+func (l *Logger) Enabled(level Level) bool {
+	std.mutex.Lock()
+	defer std.mutex.Unlock()
+	return level >= std.level
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.Log(DebugLevel, msg, kv...) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.Log(InfoLevel, msg, kv...) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.Log(WarnLevel, msg, kv...) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.Log(ErrorLevel, msg, kv...) }
+
+// Log writes msg and the fields if level is enabled.
+func (l *Logger) Log(level Level, msg string, kv ...interface{}) {
+	std.mutex.Lock()
+	defer std.mutex.Unlock()
+	if level < std.level {
+		return
+	}
+
+	all := make([]interface{}, 0, 6+len(l.fields)+len(kv))
+	all = append(all, "time", time.Now().UTC().Format(time.RFC3339Nano), "level", level.String())
+	all = append(all, l.fields...)
+	all = append(all, "msg", msg)
+	all = append(all, kv...)
+	if len(all)%2 != 0 {
+		all = append(all, "(missing)")
+	}
+
+	var buf bytes.Buffer
+	if std.format == FormatJSON {
+		writeJSON(&buf, all)
+	} else {
+		writeLogfmt(&buf, all)
+	}
+	buf.WriteByte('\n')
+	std.out.Write(buf.Bytes())
+}
+
+func writeJSON(buf *bytes.Buffer, kv []interface{}) {
+	buf.WriteByte('{')
+	for ix := 0; ix < len(kv); ix += 2 {
+		if ix > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(fmt.Sprint(kv[ix]))
+		buf.Write(key)
+		buf.WriteByte(':')
+		value := kv[ix+1]
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			data, _ = json.Marshal(fmt.Sprint(value))
+		}
+		buf.Write(data)
+	}
+	buf.WriteByte('}')
+}
+
+func writeLogfmt(buf *bytes.Buffer, kv []interface{}) {
+	for ix := 0; ix < len(kv); ix += 2 {
+		if ix > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(fmt.Sprint(kv[ix]))
+		buf.WriteByte('=')
+		value := fmt.Sprint(kv[ix+1])
+		if value == "" || strings.ContainsAny(value, " =\"\t\n") {
+			value = fmt.Sprintf("%q", value)
+		}
+		buf.WriteString(value)
+	}
+}
+
+// Writer returns an io.Writer that logs each line written to it as a
+// message; it's how the standard library's log package is redirected.
+func Writer(l *Logger, level Level) io.Writer {
+	return lineWriter{l: l, level: level}
+}
+
+type lineWriter struct {
+	l     *Logger
+	level Level
+}
+
+func (w lineWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			w.l.Log(w.level, line)
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,63 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogfmt(t *testing.T) {
+	var buf bytes.Buffer
+	Configure(&buf, FormatLogfmt, InfoLevel)
+	defer Configure(os.Stderr, FormatLogfmt, InfoLevel)
+
+	l := Named("registry").With("id", 7)
+	l.Debug("not written")
+	l.Info("registered", "name", "user", "address", "http://1.1.1.1 8080", "empty", "")
+	line := buf.String()
+	assert.True(t, strings.HasPrefix(line, "time="))
+	assert.Contains(t, line, ` level=info log=registry id=7 msg=registered name=user address="http://1.1.1.1 8080" empty=""`)
+	assert.True(t, strings.HasSuffix(line, "\n"))
+	assert.Equal(t, 1, strings.Count(line, "\n"))
+	assert.False(t, l.Enabled(DebugLevel))
+	assert.True(t, l.Enabled(WarnLevel))
+}
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	Configure(&buf, FormatJSON, DebugLevel)
+	defer Configure(os.Stderr, FormatLogfmt, InfoLevel)
+
+	Named("access").Debug("request", "status", 200, "err", errors.New("boom"), "odd")
+	var entry map[string]interface{}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "debug", entry["level"])
+	assert.Equal(t, "access", entry["log"])
+	assert.Equal(t, "request", entry["msg"])
+	assert.Equal(t, float64(200), entry["status"])
+	assert.Equal(t, "boom", entry["err"])
+	assert.Equal(t, "(missing)", entry["odd"])
+}
+
+func TestLevelsAndWriter(t *testing.T) {
+	level, err := ParseLevel("WARN")
+	assert.Nil(t, err)
+	assert.Equal(t, WarnLevel, level)
+	_, err = ParseLevel("loud")
+	assert.NotNil(t, err)
+	assert.NotNil(t, Configure(os.Stderr, "xml", InfoLevel))
+
+	var buf bytes.Buffer
+	Configure(&buf, FormatLogfmt, InfoLevel)
+	defer Configure(os.Stderr, FormatLogfmt, InfoLevel)
+	std := log.New(Writer(Named("app"), InfoLevel), "", 0)
+	std.Printf("first line\nsecond line\n")
+	assert.Equal(t, 2, strings.Count(buf.String(), "\n"))
+	assert.Contains(t, buf.String(), `msg="second line"`)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AchievementNetwork/go-util/util"
+	"github.com/AchievementNetwork/vasco/registry"
+)
+
+// rateLimited takes a token for a request to a registration that has a rate
+// limit; if there isn't one, it returns true and how long the client should
+// wait. If the limiter itself fails, the request is let through.
+func (v *Vasco) rateLimited(reg *registry.Registration, req *http.Request) (time.Duration, bool) {
+	rl := reg.RateLimit
+	if rl == nil {
+		return 0, false
+	}
+	key := rl.BucketKey(reg.Name, clientIP(req), req.Header)
+	ok, wait, err := v.limiter.Take(key, rl.Rate, rl.Burst, time.Now())
+	if err != nil {
+		vascoLog.Warn("rate limiter failed; letting the request through", "name", reg.Name, "err", err)
+		return 0, false
+	}
+	return wait, !ok
+}
+
+// rateLimitError turns away a request that's over its limit before it takes
+// a concurrency slot
+type rateLimitError struct {
+	reg  *registry.Registration
+	wait time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return "too many requests for " + e.reg.Name
+}
+
+// admitRequest is the admit check that ServeHTTP hands to Acquire
+func (v *Vasco) admitRequest(req *http.Request) func(*registry.Registration) error {
+	return func(reg *registry.Registration) error {
+		if wait, limited := v.rateLimited(reg, req); limited {
+			return &rateLimitError{reg: reg, wait: wait}
+		}
+		return nil
+	}
+}
+
+// writeRateLimited answers a request that's over its limit
+func writeRateLimited(rw http.ResponseWriter, reg *registry.Registration, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	rw.Header().Set("Retry-After", strconv.Itoa(seconds))
+	util.WriteNewWebError(rw, http.StatusTooManyRequests, "VAS-115", "Too many requests for %s; try again in %d seconds.", reg.Name, seconds)
+}
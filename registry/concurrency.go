@@ -0,0 +1,228 @@
+/**
+ * Name: concurrency.go
+ * Description: Limiting the requests in flight to each registration
+ * Copyright 2016 The Achievement Network. All rights reserved.
+ */
+
+package registry
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/AchievementNetwork/go-util/util"
+)
+
+// A registration with maxConcurrent gets at most that many requests at once
+// from each Vasco server. When it's full, a request goes to another
+// registration with the same name in the same match group (the ones that tied
+// for the longest match) that has room; if there isn't one, it waits up to
+// queueTimeout milliseconds for one to free up, and then gives up with a 503.
+// Only the same name, because that's what admit checks (rate limits are kept
+// by name), so falling back can't get a request around a limit.
+
+// inFlight counts the requests in flight to each registration, by hash
+type inFlight struct {
+	mutex   sync.Mutex
+	counts  map[string]int
+	waiters map[string][]*waiter // by hash, the requests waiting for room there
+}
+
+// a waiter is a request waiting for room on any registration in its match
+// group; the first of them to finish a request wakes it
+type waiter struct {
+	ch    chan struct{}
+	woken bool
+}
+
+func newInFlight() *inFlight {
+	return &inFlight{counts: make(map[string]int), waiters: make(map[string][]*waiter)}
+}
+
+// tryAcquire takes a slot on the first registration that has room, trying
+// them in the order given; it returns nil if they're all full.
+func (f *inFlight) tryAcquire(regs []*Registration) *Registration {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, reg := range regs {
+		hash := reg.Hash()
+		if reg.MaxConcurrent == 0 || f.counts[hash] < reg.MaxConcurrent {
+			f.counts[hash]++
+			return reg
+		}
+	}
+	return nil
+}
+
+// release frees a slot, waking only the requests that were waiting for
+// room on that registration
+func (f *inFlight) release(reg *Registration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	hash := reg.Hash()
+	if f.counts[hash]--; f.counts[hash] <= 0 {
+		delete(f.counts, hash)
+	}
+	for _, w := range f.waiters[hash] {
+		if !w.woken {
+			w.woken = true
+			close(w.ch)
+		}
+	}
+	delete(f.waiters, hash)
+}
+
+// wait returns a channel that's closed the next time a request to one of
+// regs finishes, and a func to call once the caller stops waiting on it
+func (f *inFlight) wait(regs []*Registration) (<-chan struct{}, func()) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	w := &waiter{ch: make(chan struct{})}
+	for _, reg := range regs {
+		hash := reg.Hash()
+		f.waiters[hash] = append(f.waiters[hash], w)
+	}
+	return w.ch, func() { f.forget(w, regs) }
+}
+
+// forget takes a waiter off the lists it's still on
+func (f *inFlight) forget(w *waiter, regs []*Registration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, reg := range regs {
+		hash := reg.Hash()
+		waiting := f.waiters[hash]
+		for ix, other := range waiting {
+			if other == w {
+				waiting = append(waiting[:ix], waiting[ix+1:]...)
+				break
+			}
+		}
+		if len(waiting) == 0 {
+			delete(f.waiters, hash)
+		} else {
+			f.waiters[hash] = waiting
+		}
+	}
+}
+
+func (f *inFlight) count(hash string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.counts[hash]
+}
+
+// InFlight returns the number of requests this server has in flight to a
+// registration.
+func (r *Registry) InFlight(hash string) int {
+	return r.inflight.count(hash)
+}
+
+// WithInFlight returns a copy of a status block with the current in-flight
+// counts filled in for each registration.
+func (r *Registry) WithInFlight(block StatusBlock) StatusBlock {
+	current := make(StatusBlock, 0, len(block))
+	for _, item := range block {
+		if _, ok := item["inflight"]; ok {
+			copied := make(StatusItem, len(item))
+			for k, v := range item {
+				copied[k] = v
+			}
+			copied["inflight"] = r.InFlight(Hash(item.Get("Name"), item.Get("Address")))
+			item = copied
+		}
+		current = append(current, item)
+	}
+	return current
+}
+
+// Acquire routes a URL like Route does, but also takes a slot on the
+// registration it picks; done must be called when the request finishes.
+// Requests that find their match group full wait, until the context is done,
+// for as long as the chosen registration's queueTimeout. If admit is given,
+// it's called with the chosen registration before any slot is taken, and an
+// error from it is returned as is, so a request that's turned away (by a
+// rate limit, say) never holds or queues for a slot.
+func (r *Registry) Acquire(ctx context.Context, reqUrl *url.URL, admit func(*Registration) error) (target *Registration, done func(), err error) {
+	target, err = r.route(reqUrl, func(choices []*Registration) (*Registration, error) {
+		return r.acquire(ctx, choices, admit)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return target, func() { r.inflight.release(target) }, nil
+}
+
+func (r *Registry) acquire(ctx context.Context, choices []*Registration, admit func(*Registration) error) (*Registration, error) {
+	first := r.choose(choices)
+	if admit != nil {
+		if err := admit(first); err != nil {
+			return nil, err
+		}
+	}
+	choices = sameName(first, choices)
+	if reg := r.inflight.tryAcquire(r.fallbackOrder(first, choices)); reg != nil {
+		return reg, nil
+	}
+	events.Debug("match group full", "name", first.Name, "address", first.Address)
+	if first.QueueTimeout > 0 {
+		timer := time.NewTimer(time.Duration(first.QueueTimeout) * time.Millisecond)
+		defer timer.Stop()
+		for {
+			freed, stop := r.inflight.wait(choices)
+			// something may have finished before we started waiting
+			if reg := r.inflight.tryAcquire(r.fallbackOrder(first, choices)); reg != nil {
+				stop()
+				return reg, nil
+			}
+			select {
+			case <-freed:
+				stop()
+			case <-timer.C:
+				stop()
+				return nil, util.NewWebError(http.StatusServiceUnavailable, "VASCO-101", "%s is too busy; no request finished within %dms.", first.Name, first.QueueTimeout)
+			case <-ctx.Done():
+				stop()
+				return nil, ctx.Err()
+			}
+		}
+	}
+	return nil, util.NewWebError(http.StatusServiceUnavailable, "VASCO-101", "%s is too busy.", first.Name)
+}
+
+// sameName is the choices that have the same name as first
+func sameName(first *Registration, choices []*Registration) []*Registration {
+	same := make([]*Registration, 0, len(choices))
+	for _, choice := range choices {
+		if choice.Name == first.Name {
+			same = append(same, choice)
+		}
+	}
+	return same
+}
+
+// fallbackOrder is the order to try the registrations in a match group:
+// the one that was chosen, then the others in weighted random order.
+func (r *Registry) fallbackOrder(first *Registration, choices []*Registration) []*Registration {
+	order := []*Registration{first}
+	rest := make([]*Registration, 0, len(choices)-1)
+	for _, choice := range choices {
+		if choice != first {
+			rest = append(rest, choice)
+		}
+	}
+	for len(rest) > 0 {
+		next := r.choose(rest)
+		order = append(order, next)
+		for ix, choice := range rest {
+			if choice == next {
+				rest = append(rest[:ix], rest[ix+1:]...)
+				break
+			}
+		}
+	}
+	return order
+}
@@ -0,0 +1,187 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/AchievementNetwork/go-util/util"
+	"github.com/AchievementNetwork/vasco/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConcurrencyValidation(t *testing.T) {
+	reg := NewRegFromJSON(`{"name": "user", "address": "http://1.1.1.1:8080", "pattern": "/user", "status": {"path": "/status"},
+		"maxConcurrent": 5, "queueTimeout": 100}`)
+	assert.NotNil(t, reg)
+	assert.Nil(t, reg.SetDefaults())
+	assert.Equal(t, 5, reg.MaxConcurrent)
+	assert.Equal(t, 100, reg.QueueTimeout)
+
+	reg.MaxConcurrent = -1
+	assert.NotNil(t, reg.SetDefaults())
+	reg.MaxConcurrent = 5
+	reg.QueueTimeout = -1
+	assert.NotNil(t, reg.SetDefaults())
+}
+
+func acquire(r *Registry, ctx context.Context, path string) (*Registration, func(), error) {
+	u, _ := url.Parse("http://example.com" + path)
+	return r.Acquire(ctx, u, nil)
+}
+
+func TestAcquireFallback(t *testing.T) {
+	r := NewRegistry(cache.NewLocalCache(), "", "", 60)
+	a := NewRegFromJSON(`{"name": "busy", "address": "http://1.1.1.1:8080", "pattern": "/busy(/.*)", "status": {"path": "/status"}, "maxConcurrent": 1}`)
+	b := NewRegFromJSON(`{"name": "busy", "address": "http://1.1.1.2:8080", "pattern": "/busy(/.*)", "status": {"path": "/status"}, "maxConcurrent": 1}`)
+	r.Register(a, false)
+	r.Register(b, false)
+
+	// when one is full, requests go to the other
+	first, done1, err := acquire(r, context.Background(), "/busy/x")
+	assert.Nil(t, err)
+	second, done2, err := acquire(r, context.Background(), "/busy/x")
+	assert.Nil(t, err)
+	assert.NotEqual(t, first.Hash(), second.Hash())
+	assert.Equal(t, 1, r.InFlight(a.Hash()))
+	assert.Equal(t, 1, r.InFlight(b.Hash()))
+
+	// and when both are, they're rejected
+	_, _, err = acquire(r, context.Background(), "/busy/x")
+	e, ok := err.(*util.WebError)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusServiceUnavailable, e.Code)
+
+	done1()
+	done2()
+	assert.Equal(t, 0, r.InFlight(a.Hash()))
+	assert.Equal(t, 0, r.InFlight(b.Hash()))
+}
+
+func TestAcquireFallbackSameName(t *testing.T) {
+	r := NewRegistry(cache.NewLocalCache(), "", "", 60)
+	a := NewRegFromJSON(`{"name": "limited", "address": "http://1.1.1.1:8080", "pattern": "/shared", "status": {"path": "/status"}, "maxConcurrent": 1}`)
+	b := NewRegFromJSON(`{"name": "other", "address": "http://1.1.1.2:8080", "pattern": "/shared", "status": {"path": "/status"}}`)
+	r.Register(a, false)
+	r.Register(b, false)
+	assert.NotNil(t, r.inflight.tryAcquire([]*Registration{a}))
+
+	// a request admitted to the full one isn't sent to the other, which
+	// wasn't asked
+	u, _ := url.Parse("http://example.com/shared")
+	for ix := 0; ix < 20; ix++ {
+		var admitted *Registration
+		reg, done, err := r.Acquire(context.Background(), u, func(reg *Registration) error {
+			admitted = reg
+			return nil
+		})
+		if admitted.Name == "limited" {
+			assert.NotNil(t, err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, "other", reg.Name)
+		done()
+	}
+}
+
+func TestAcquireQueue(t *testing.T) {
+	r := NewRegistry(cache.NewLocalCache(), "", "", 60)
+	reg := NewRegFromJSON(`{"name": "slow", "address": "http://1.1.1.1:8080", "pattern": "/slow", "status": {"path": "/status"}, "maxConcurrent": 1, "queueTimeout": 1000}`)
+	r.Register(reg, false)
+
+	_, done, err := acquire(r, context.Background(), "/slow")
+	assert.Nil(t, err)
+
+	// a queued request gets in when the first one finishes
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		done()
+	}()
+	start := time.Now()
+	_, done, err = acquire(r, context.Background(), "/slow")
+	assert.Nil(t, err)
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+	assert.Equal(t, 1, r.InFlight(reg.Hash()))
+
+	// or stops waiting when the client goes away
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = acquire(r, ctx, "/slow")
+	assert.Equal(t, context.Canceled, err)
+
+	// or when the queue timeout is up
+	reg.QueueTimeout = 10
+	r.Register(reg, false)
+	_, _, err = acquire(r, context.Background(), "/slow")
+	e, ok := err.(*util.WebError)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusServiceUnavailable, e.Code)
+
+	done()
+	assert.Equal(t, 0, r.InFlight(reg.Hash()))
+}
+
+func TestInFlightWake(t *testing.T) {
+	f := newInFlight()
+	a := NewRegFromJSON(`{"name": "a", "address": "http://1.1.1.1:8080", "pattern": "/a", "maxConcurrent": 1}`)
+	b := NewRegFromJSON(`{"name": "b", "address": "http://1.1.1.2:8080", "pattern": "/b", "maxConcurrent": 1}`)
+	c := NewRegFromJSON(`{"name": "c", "address": "http://1.1.1.3:8080", "pattern": "/c", "maxConcurrent": 1}`)
+	for _, reg := range []*Registration{a, b, c} {
+		assert.NotNil(t, f.tryAcquire([]*Registration{reg}))
+	}
+	woken := func(ch <-chan struct{}) bool {
+		select {
+		case <-ch:
+			return true
+		default:
+			return false
+		}
+	}
+
+	onA, stopA := f.wait([]*Registration{a})
+	onGroup, stopGroup := f.wait([]*Registration{a, b})
+
+	// a request finishing elsewhere wakes nobody
+	f.release(c)
+	assert.False(t, woken(onA))
+	assert.False(t, woken(onGroup))
+
+	// and one finishing on b only wakes those waiting for it
+	f.release(b)
+	assert.False(t, woken(onA))
+	assert.True(t, woken(onGroup))
+	stopGroup()
+
+	f.release(a)
+	assert.True(t, woken(onA))
+	stopA()
+	assert.Equal(t, 0, len(f.waiters))
+
+	// giving up takes a waiter off every list it was on
+	_, stop := f.wait([]*Registration{a, b})
+	stop()
+	assert.Equal(t, 0, len(f.waiters))
+}
+
+func TestWithInFlight(t *testing.T) {
+	r := NewRegistry(cache.NewLocalCache(), "", "", 60)
+	reg := NewRegFromJSON(`{"name": "user", "address": "http://1.1.1.1:8080", "pattern": "/user", "status": {"path": "/status"}, "maxConcurrent": 2}`)
+	r.Register(reg, false)
+	u, _ := url.Parse("/user")
+	_, done, err := r.Acquire(context.Background(), u, nil)
+	assert.Nil(t, err)
+	defer done()
+
+	block := StatusBlock{
+		StatusItem{"Name": "user", "Address": "http://1.1.1.1:8080", "inflight": 0},
+		StatusItem{"Name": "assess", "missing": true},
+	}
+	current := r.WithInFlight(block)
+	assert.Equal(t, 1, current[0]["inflight"])
+	assert.Equal(t, 0, block[0]["inflight"])
+	_, ok := current[1]["inflight"]
+	assert.False(t, ok)
+}
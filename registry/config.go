@@ -0,0 +1,148 @@
+/**
+ * Name: config.go
+ * Description: Static registrations loaded from a configuration file
+ * Copyright 2016 The Achievement Network. All rights reserved.
+ */
+
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the contents of a static configuration file. The registrations
+// it lists are registered without expiry and are maintained by the registry
+// until a later configuration no longer contains them.
+//
+// The file may be YAML or JSON (chosen by its extension):
+//
+//	registrations:
+//	  - name: static
+//	    address: http://10.0.0.5:8000
+//	    pattern: /static(/.*)
+//	    weight: 100
+//	    status:
+//	      path: /status
+//	requirements:
+//	  - name: user
+//	    min: 2
+//	    revision: b1b171d
+//
+// Requirements are what /status/strict checks each service against.
+type Config struct {
+	Registrations []*Registration `json:"registrations" yaml:"registrations"`
+	Requirements  []*Requirement  `json:"requirements" yaml:"requirements"`
+}
+
+// Requirement describes what a service must look like for strict status to
+// pass: at least Min healthy instances, and if Revision or DeployTag is set,
+// every healthy instance must report that value.
+type Requirement struct {
+	Name      string `json:"name" yaml:"name"`
+	Min       int    `json:"min,omitempty" yaml:"min"`
+	Revision  string `json:"revision,omitempty" yaml:"revision"`
+	DeployTag string `json:"deploytag,omitempty" yaml:"deploytag"`
+}
+
+// LoadConfig reads and validates a configuration file.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(data, filepath.Ext(path))
+}
+
+// ParseConfig parses the configuration in data; ext is the file extension
+// used to choose the format (".json" is JSON, anything else is YAML).
+func ParseConfig(data []byte, ext string) (*Config, error) {
+	cfg := new(Config)
+	var err error
+	if strings.ToLower(ext) == ".json" {
+		err = json.Unmarshal(data, cfg)
+	} else {
+		err = yaml.Unmarshal(data, cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate sets defaults on every registration in the configuration and
+// makes sure that none of them (or the requirements) are duplicated.
+func (cfg *Config) Validate() error {
+	seen := make(map[string]int)
+	for ix, reg := range cfg.Registrations {
+		if reg == nil {
+			return fmt.Errorf("registration %d is empty", ix)
+		}
+		if err := reg.SetDefaults(); err != nil {
+			return fmt.Errorf("registration %d (%s): %s", ix, reg.Name, err.Error())
+		}
+		if prev, ok := seen[reg.Hash()]; ok {
+			return fmt.Errorf("registration %d (%s) duplicates registration %d", ix, reg.Name, prev)
+		}
+		seen[reg.Hash()] = ix
+	}
+	names := make(map[string]bool)
+	for ix, req := range cfg.Requirements {
+		switch {
+		case req == nil || req.Name == "":
+			return fmt.Errorf("requirement %d has no name", ix)
+		case req.Min < 0:
+			return fmt.Errorf("requirement %d (%s) has a negative minimum", ix, req.Name)
+		case names[req.Name]:
+			return fmt.Errorf("requirement %d (%s) is a duplicate", ix, req.Name)
+		}
+		names[req.Name] = true
+	}
+	return nil
+}
+
+// ApplyConfig registers everything in the configuration that is new or has
+// changed since the last configuration was applied, and unregisters static
+// registrations that are no longer present. It returns the hashes that were
+// registered and unregistered.
+func (r *Registry) ApplyConfig(cfg *Config) (registered []string, unregistered []string) {
+	r.staticMutex.Lock()
+	defer r.staticMutex.Unlock()
+
+	next := make(map[string]*Registration)
+	for _, reg := range cfg.Registrations {
+		hash := reg.Hash()
+		next[hash] = reg
+		if old, ok := r.static[hash]; !ok || old.String() != reg.String() {
+			r.Register(reg, false)
+			registered = append(registered, hash)
+		}
+	}
+	for hash, old := range r.static {
+		if _, ok := next[hash]; !ok {
+			r.Unregister(old)
+			unregistered = append(unregistered, hash)
+		}
+	}
+	r.static = next
+
+	events.Info("applied static configuration", "registrations", len(next),
+		"registered", len(registered), "unregistered", len(unregistered))
+	return
+}
+
+// staticRegistration returns the static registration for a hash, or nil if
+// the hash did not come from the configuration file.
+func (r *Registry) staticRegistration(hash string) *Registration {
+	r.staticMutex.RLock()
+	defer r.staticMutex.RUnlock()
+	return r.static[hash]
+}
@@ -0,0 +1,112 @@
+package registry
+
+import (
+	"testing"
+
+	"github.com/AchievementNetwork/vasco/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+const yamlConfig = `
+registrations:
+  - name: static
+    address: http://2.2.2.1:8000
+    pattern: /static(/.*)
+    status:
+      path: /status
+  - name: docs
+    address: http://2.2.2.2:8000
+    pattern: /docs
+    weight: 50
+    status:
+      path: /status
+requirements:
+  - name: docs
+    min: 2
+    deploytag: Branch:master
+`
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := ParseConfig([]byte(yamlConfig), ".yaml")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(cfg.Registrations))
+	assert.Equal(t, "/status", cfg.Registrations[0].Stat.Path)
+	assert.Equal(t, 100, cfg.Registrations[0].Weight)
+	assert.Equal(t, 50, cfg.Registrations[1].Weight)
+	assert.Equal(t, []*Requirement{{Name: "docs", Min: 2, DeployTag: "Branch:master"}}, cfg.Requirements)
+
+	cfg, err = ParseConfig([]byte(`{"registrations": [{"name": "static",
+		"address": "http://2.2.2.1:8000", "pattern": "/static", "status": {"path": "/status"}}]}`), ".json")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(cfg.Registrations))
+}
+
+func TestParseConfigInvalid(t *testing.T) {
+	_, err := ParseConfig([]byte(`registrations: [{name: nopattern, address: "http://1.1.1.1", status: {path: /status}}]`), ".yml")
+	assert.NotNil(t, err)
+
+	_, err = ParseConfig([]byte(`registrations: [{name: bad, address: "http://1.1.1.1", pattern: "/(", status: {path: /status}}]`), ".yml")
+	assert.NotNil(t, err)
+
+	dup := `registrations:
+  - {name: a, address: "http://1.1.1.1", pattern: /a, status: {path: /status}}
+  - {name: a, address: "http://1.1.1.1", pattern: /b, status: {path: /status}}
+`
+	_, err = ParseConfig([]byte(dup), ".yml")
+	assert.NotNil(t, err)
+
+	_, err = ParseConfig([]byte(`requirements: [{min: 2}]`), ".yml")
+	assert.NotNil(t, err)
+
+	_, err = ParseConfig([]byte(`requirements: [{name: a, min: -1}]`), ".yml")
+	assert.NotNil(t, err)
+
+	_, err = ParseConfig([]byte(`requirements: [{name: a, min: 1}, {name: a, min: 2}]`), ".yml")
+	assert.NotNil(t, err)
+}
+
+func TestApplyConfig(t *testing.T) {
+	reg := NewRegistry(cache.NewLocalCache(), "", "", 60)
+	cfg, err := ParseConfig([]byte(yamlConfig), ".yaml")
+	assert.Nil(t, err)
+
+	added, removed := reg.ApplyConfig(cfg)
+	assert.Equal(t, 2, len(added))
+	assert.Equal(t, 0, len(removed))
+	match, err := reg.FindBestMatch("/docs/index.html")
+	assert.Nil(t, err)
+	assert.Equal(t, "docs", match.Name)
+
+	// applying the same config again changes nothing
+	cfg, _ = ParseConfig([]byte(yamlConfig), ".yaml")
+	added, removed = reg.ApplyConfig(cfg)
+	assert.Equal(t, 0, len(added))
+	assert.Equal(t, 0, len(removed))
+
+	// change one, drop the other
+	cfg, _ = ParseConfig([]byte(`registrations:
+  - {name: static, address: "http://2.2.2.1:8000", pattern: /assets(/.*), status: {path: /status}}
+`), ".yaml")
+	added, removed = reg.ApplyConfig(cfg)
+	assert.Equal(t, []string{Hash("static", "http://2.2.2.1:8000")}, added)
+	assert.Equal(t, []string{Hash("docs", "http://2.2.2.2:8000")}, removed)
+	_, err = reg.FindBestMatch("/docs/index.html")
+	assert.NotNil(t, err)
+	match, err = reg.FindBestMatch("/assets/logo.png")
+	assert.Nil(t, err)
+	assert.Equal(t, "static", match.Name)
+}
+
+func TestStaticRegistrationsComeBack(t *testing.T) {
+	c := cache.NewLocalCache()
+	reg := NewRegistry(c, "", "", 60)
+	cfg, _ := ParseConfig([]byte(yamlConfig), ".yaml")
+	reg.ApplyConfig(cfg)
+
+	// simulate a static registration expiring after it was disabled
+	c.Delete(Hash("docs", "http://2.2.2.2:8000"))
+	match, err := reg.FindBestMatch("/docs")
+	assert.Nil(t, err)
+	assert.Equal(t, "docs", match.Name)
+	assert.NotNil(t, reg.Find(Hash("docs", "http://2.2.2.2:8000")))
+}
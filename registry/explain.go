@@ -0,0 +1,168 @@
+/**
+ * Name: explain.go
+ * Description: Explaining how a URL is routed
+ * Copyright 2016 The Achievement Network. All rights reserved.
+ */
+
+package registry
+
+import (
+	"net/url"
+	"sort"
+
+	"github.com/AchievementNetwork/vasco/cache"
+)
+
+// Candidate is one registration's part in routing a path.
+type Candidate struct {
+	Hash          string  `json:"hash"`
+	Name          string  `json:"name,omitempty"`
+	Address       string  `json:"address,omitempty"`
+	Pattern       string  `json:"pattern,omitempty"`
+	Weight        int     `json:"weight"`
+	Disabled      bool    `json:"disabled"`
+	Expired       bool    `json:"expired"`
+	Matched       bool    `json:"matched"`
+	MatchedLength int     `json:"matchedLength"`
+	TieGroup      bool    `json:"tieGroup"`
+	Probability   float64 `json:"probability"`
+}
+
+// PathExplanation is how one path was matched against every registration.
+// The tie group is the enabled registrations with the longest match; one
+// of them is chosen at random, in proportion to their weights.
+type PathExplanation struct {
+	Path       string       `json:"path"`
+	BestLength int          `json:"bestLength"`
+	Candidates []*Candidate `json:"candidates"`
+}
+
+// What happened with the static path fallback
+const (
+	StaticNotNeeded     = "not needed"
+	StaticNotConfigured = "not configured"
+	StaticUsed          = "used"
+	StaticNoMatch       = "no match"
+)
+
+// Explanation is everything that went into routing a URL.
+type Explanation struct {
+	URL         string           `json:"url"`
+	Match       *PathExplanation `json:"match"`
+	Static      string           `json:"static"`
+	StaticMatch *PathExplanation `json:"staticMatch,omitempty"`
+	Selected    *Registration    `json:"selected,omitempty"`
+	Upstream    string           `json:"upstream,omitempty"`
+	Error       string           `json:"error,omitempty"`
+	CacheError  string           `json:"cacheError,omitempty"`
+}
+
+type byCandidate []*Candidate
+
+func (a byCandidate) Len() int      { return len(a) }
+func (a byCandidate) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byCandidate) Less(i, j int) bool {
+	if a[i].MatchedLength != a[j].MatchedLength {
+		return a[i].MatchedLength > a[j].MatchedLength
+	}
+	if a[i].Name != a[j].Name {
+		return a[i].Name < a[j].Name
+	}
+	return a[i].Address < a[j].Address
+}
+
+// Explain routes a URL the way the proxy would and says why; registrations
+// that have expired but haven't been cleaned up yet are listed too.
+func (r *Registry) Explain(reqUrl *url.URL) *Explanation {
+	e := &Explanation{URL: reqUrl.String()}
+	if err := r.CacheError(); err != nil {
+		e.CacheError = err.Error()
+	}
+	expired := r.expiredHashes()
+	regs := r.getRegistrations(true)
+
+	var found bool
+	e.Match, found = explainPath(reqUrl.Path, regs, expired)
+	switch {
+	case found:
+		e.Static = StaticNotNeeded
+	case r.StaticPath == "":
+		e.Static = StaticNotConfigured
+	default:
+		e.StaticMatch, found = explainPath(r.StaticPath+reqUrl.Path, regs, expired)
+		e.Static = StaticUsed
+		if !found {
+			e.Static = StaticNoMatch
+		}
+	}
+
+	upstream := *reqUrl
+	selected, err := r.Route(&upstream)
+	if err != nil {
+		e.Error = err.Error()
+		return e
+	}
+	e.Selected = selected
+	e.Upstream = upstream.String()
+	return e
+}
+
+// expiredHashes returns the registrations in the item set whose keys have
+// expired (and that haven't been cleaned up yet).
+func (r *Registry) expiredHashes() []string {
+	hashes, err := r.c.SGet(itemsKey)
+	if err != nil {
+		return nil
+	}
+	expired := make([]string, 0)
+	for _, hash := range hashes {
+		if _, err := r.c.Get(hash); err == cache.ErrNotFound && r.staticRegistration(hash) == nil {
+			expired = append(expired, hash)
+		}
+	}
+	return expired
+}
+
+func explainPath(path string, regs []*Registration, expired []string) (*PathExplanation, bool) {
+	pe := &PathExplanation{Path: path, Candidates: make([]*Candidate, 0, len(regs)+len(expired))}
+	for _, reg := range regs {
+		c := &Candidate{
+			Hash:     reg.Hash(),
+			Name:     reg.Name,
+			Address:  reg.Address,
+			Pattern:  reg.Pattern,
+			Weight:   reg.Weight,
+			Disabled: reg.Disabled,
+			Matched:  reg.regex.MatchString(path),
+		}
+		if c.Matched {
+			c.MatchedLength = reg.matchedLength(path)
+			if !c.Disabled && c.MatchedLength > pe.BestLength {
+				pe.BestLength = c.MatchedLength
+			}
+		}
+		pe.Candidates = append(pe.Candidates, c)
+	}
+
+	total := 0
+	found := false
+	for _, c := range pe.Candidates {
+		// FindBestMatch takes a single match whatever its length, so an
+		// empty match can still be in the tie group
+		if c.Matched && !c.Disabled && c.MatchedLength == pe.BestLength {
+			c.TieGroup = true
+			total += c.Weight
+			found = true
+		}
+	}
+	for _, c := range pe.Candidates {
+		if c.TieGroup && total > 0 {
+			c.Probability = float64(c.Weight) / float64(total)
+		}
+	}
+	for _, hash := range expired {
+		pe.Candidates = append(pe.Candidates, &Candidate{Hash: hash, Expired: true})
+	}
+	sort.Sort(byCandidate(pe.Candidates))
+	return pe, found
+}
@@ -0,0 +1,70 @@
+package registry
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/AchievementNetwork/vasco/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExplain(t *testing.T) {
+	lc := cache.NewLocalCache()
+	defer lc.Close()
+	r := NewRegistry(lc, "/static", "", 60)
+	add := func(name, addr, pattern string, weight int) *Registration {
+		reg := NewRegFromJSON(`{"name": "` + name + `", "address": "` + addr + `", "pattern": "` + pattern + `", "status": {"path": "/status"}}`)
+		reg.Weight = weight
+		r.Register(reg, false)
+		return reg
+	}
+	add("tags", "http://1.1.1.1:8081", "/tags", 75)
+	add("tags", "http://1.1.1.2:8081", "/tags", 25)
+	add("extra", "http://1.1.1.3:8081", "/tags/extra", 100)
+	disabled := add("tags", "http://1.1.1.4:8081", "/tags/(.*)", 100)
+	disabled.Disabled = true
+	lc.Set(disabled.Hash(), disabled.String())
+	add("docs", "http://1.1.1.5:8080", "/static(/.*)", 100)
+	gone := add("gone", "http://1.1.1.6:8080", "/tags", 100)
+	lc.Delete(gone.Hash())
+
+	u, _ := url.Parse("/tags/1")
+	e := r.Explain(u)
+	assert.Equal(t, StaticNotNeeded, e.Static)
+	assert.Nil(t, e.StaticMatch)
+	assert.Equal(t, "/tags/1", e.Match.Path)
+	assert.Equal(t, 5, e.Match.BestLength)
+	assert.Equal(t, "", e.Error)
+	assert.Equal(t, "tags", e.Selected.Name)
+	assert.Contains(t, []string{"http://1.1.1.1:8081/tags/1", "http://1.1.1.2:8081/tags/1"}, e.Upstream)
+
+	byAddress := make(map[string]*Candidate)
+	for _, c := range e.Match.Candidates {
+		byAddress[c.Address] = c
+	}
+	assert.Len(t, e.Match.Candidates, 6)
+	assert.True(t, byAddress["http://1.1.1.1:8081"].TieGroup)
+	assert.Equal(t, 0.75, byAddress["http://1.1.1.1:8081"].Probability)
+	assert.Equal(t, 0.25, byAddress["http://1.1.1.2:8081"].Probability)
+	assert.False(t, byAddress["http://1.1.1.3:8081"].Matched)
+	// the disabled one matched, but without its group only "/tags/" counts
+	assert.True(t, byAddress["http://1.1.1.4:8081"].Disabled)
+	assert.True(t, byAddress["http://1.1.1.4:8081"].Matched)
+	assert.Equal(t, 6, byAddress["http://1.1.1.4:8081"].MatchedLength)
+	assert.False(t, byAddress["http://1.1.1.4:8081"].TieGroup)
+	assert.Equal(t, &Candidate{Hash: gone.Hash(), Expired: true}, byAddress[""])
+
+	// nothing matches, so we try the static path
+	u, _ = url.Parse("/index.html")
+	e = r.Explain(u)
+	assert.Equal(t, StaticUsed, e.Static)
+	assert.Equal(t, "/static/index.html", e.StaticMatch.Path)
+	assert.Equal(t, "docs", e.Selected.Name)
+	assert.Equal(t, "http://1.1.1.5:8080/index.html", e.Upstream)
+
+	r.StaticPath = ""
+	e = r.Explain(u)
+	assert.Equal(t, StaticNotConfigured, e.Static)
+	assert.Nil(t, e.Selected)
+	assert.NotEqual(t, "", e.Error)
+}
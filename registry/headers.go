@@ -0,0 +1,115 @@
+/**
+ * Name: headers.go
+ * Description: Header rewriting rules for registrations
+ * Copyright 2016 The Achievement Network. All rights reserved.
+ */
+
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+)
+
+// HeaderRules are the header changes the proxy makes on the way to a
+// registration (request) and on the way back (response).
+type HeaderRules struct {
+	Request  HeaderRuleSet `json:"request,omitempty" yaml:"request,omitempty"`
+	Response HeaderRuleSet `json:"response,omitempty" yaml:"response,omitempty"`
+}
+
+// HeaderRuleSet removes, then sets, then adds headers. Values may include
+// the variables in HeaderVariables, like {name} or {client_ip}.
+type HeaderRuleSet struct {
+	Remove []string          `json:"remove,omitempty" yaml:"remove,omitempty"`
+	Set    map[string]string `json:"set,omitempty" yaml:"set,omitempty"`
+	Add    map[string]string `json:"add,omitempty" yaml:"add,omitempty"`
+}
+
+// HeaderVariables are the variables that header values can use
+var HeaderVariables = []string{"name", "hash", "address", "client_ip", "request_id", "host", "path"}
+
+var headerVarRegex = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// header names are RFC 7230 tokens
+var headerNameRegex = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+func (h *HeaderRules) validate() error {
+	if err := h.Request.validate("request"); err != nil {
+		return err
+	}
+	return h.Response.validate("response")
+}
+
+func (rs HeaderRuleSet) validate(which string) error {
+	names := append([]string{}, rs.Remove...)
+	values := make(map[string]string)
+	for name, value := range rs.Set {
+		names = append(names, name)
+		values[name] = value
+	}
+	for name, value := range rs.Add {
+		names = append(names, name)
+		values[name] = value
+	}
+	for _, name := range names {
+		if !headerNameRegex.MatchString(name) {
+			return fmt.Errorf("The %s header name '%s' is not valid.", which, name)
+		}
+	}
+	for name, value := range values {
+		for _, match := range headerVarRegex.FindAllStringSubmatch(value, -1) {
+			if !isHeaderVariable(match[1]) {
+				return fmt.Errorf("The %s header '%s' uses the unknown variable {%s}.", which, name, match[1])
+			}
+		}
+	}
+	return nil
+}
+
+func isHeaderVariable(name string) bool {
+	for _, v := range HeaderVariables {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply makes the rule set's changes to h, filling in variables from vars.
+func (rs HeaderRuleSet) Apply(h http.Header, vars map[string]string) {
+	for _, name := range rs.Remove {
+		h.Del(name)
+	}
+	for _, name := range sortedKeys(rs.Set) {
+		h.Set(name, ExpandHeaderValue(rs.Set[name], vars))
+	}
+	for _, name := range sortedKeys(rs.Add) {
+		h.Add(name, ExpandHeaderValue(rs.Add[name], vars))
+	}
+}
+
+// ExpandHeaderValue replaces {variable}s in a header value.
+func ExpandHeaderValue(value string, vars map[string]string) string {
+	return headerVarRegex.ReplaceAllStringFunc(value, func(match string) string {
+		return vars[match[1:len(match)-1]]
+	})
+}
+
+// HeaderVars returns the variables that describe a registration; the proxy
+// adds the ones that describe the request.
+func (r *Registration) HeaderVars() map[string]string {
+	return map[string]string{"name": r.Name, "hash": r.Hash(), "address": r.Address}
+}
+
+// so that rules are applied in the same order every time
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
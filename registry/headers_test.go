@@ -0,0 +1,44 @@
+package registry
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeaderRulesValidation(t *testing.T) {
+	reg := NewRegFromJSON(`{"name": "user", "address": "http://1.1.1.1:8080", "pattern": "/user", "status": {"path": "/status"},
+		"headers": {"request": {"set": {"X-Service-Name": "{name}"}}, "response": {"remove": ["Server"]}}}`)
+	assert.NotNil(t, reg)
+	assert.Nil(t, reg.SetDefaults())
+	assert.Equal(t, "{name}", reg.Headers.Request.Set["X-Service-Name"])
+
+	reg.Headers.Request.Add = map[string]string{"X-Who": "{user}"}
+	assert.NotNil(t, reg.SetDefaults())
+	reg.Headers.Request.Add = nil
+	reg.Headers.Response.Remove = []string{"Bad Name"}
+	assert.NotNil(t, reg.SetDefaults())
+}
+
+func TestHeaderRulesApply(t *testing.T) {
+	rules := HeaderRuleSet{
+		Remove: []string{"Server", "X-Powered-By"},
+		Set:    map[string]string{"X-Service-Name": "{name}", "X-Client": "{client_ip} via {host}"},
+		Add:    map[string]string{"Cache-Control": "no-store", "X-Unknown": "{nothing}"},
+	}
+	h := http.Header{}
+	h.Set("Server", "nginx")
+	h.Set("X-Service-Name", "old")
+	h.Set("Cache-Control", "private")
+	rules.Apply(h, map[string]string{"name": "user", "client_ip": "10.0.0.1", "host": "example.com"})
+
+	assert.Equal(t, "", h.Get("Server"))
+	assert.Equal(t, []string{"user"}, h["X-Service-Name"])
+	assert.Equal(t, "10.0.0.1 via example.com", h.Get("X-Client"))
+	assert.Equal(t, []string{"private", "no-store"}, h["Cache-Control"])
+	assert.Equal(t, "", h.Get("X-Unknown"))
+
+	reg := NewRegFromJSON(`{"name": "user", "address": "http://1.1.1.1:8080", "pattern": "/user", "status": {"path": "/status"}}`)
+	assert.Equal(t, map[string]string{"name": "user", "hash": reg.Hash(), "address": "http://1.1.1.1:8080"}, reg.HeaderVars())
+}
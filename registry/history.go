@@ -0,0 +1,251 @@
+/**
+ * Name: history.go
+ * Description: Status history and availability for each registration
+ * Copyright 2016 The Achievement Network. All rights reserved.
+ */
+
+package registry
+
+import (
+	"encoding/json"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Every status update adds a sample to a sorted set per instance (scored by
+// time), and the oldest samples are trimmed so that each one holds at most
+// HistoryLimit of them. An instance is a name and address, which is the same
+// as a registration's hash; expected services that are missing get one too,
+// with an empty address. The instances for each name are kept in a set so we
+// can find them again, and the names are kept in a set of their own.
+//
+// History is only kept for as long as the longest availability window (plus
+// a margin). The keys aren't given expirations, since not every cache can
+// expire sets and sorted sets, and an index that expired would lose track of
+// the history it pointed to; instead, every historyPruneInterval RecordStatus
+// drops the instances that haven't been seen for that long, so services that
+// are renamed or move don't leave their history behind.
+
+// DefaultHistoryLimit is the number of samples kept for each instance; at the
+// default status interval of a minute, it's a day.
+const DefaultHistoryLimit = 1440
+
+// instances that haven't been seen for this long are dropped from the history
+const historyMaxAge = 25 * time.Hour
+
+// how often RecordStatus looks for instances to drop
+const historyPruneInterval = time.Hour
+
+// historyNamesKey is the set of every name that has history; it has a prefix
+// of its own so that it can't clash with a service's name
+const historyNamesKey = "History:names"
+
+// the windows that availability is reported over
+var historyWindows = []struct {
+	name string
+	d    time.Duration
+}{
+	{"1h", time.Hour},
+	{"6h", 6 * time.Hour},
+	{"24h", 24 * time.Hour},
+}
+
+// HistorySample is a single status result for an instance.
+type HistorySample struct {
+	Time       time.Time `json:"time"`
+	Address    string    `json:"address,omitempty"`
+	State      string    `json:"state"`
+	StatusCode int       `json:"code"`
+}
+
+// Transition is a change of state.
+type Transition struct {
+	Time time.Time `json:"time"`
+	From string    `json:"from"`
+	To   string    `json:"to"`
+}
+
+// InstanceHistory describes what's happened to one instance of a service.
+// Availability is the percentage of samples that were up in each window.
+type InstanceHistory struct {
+	Address      string             `json:"address"`
+	State        string             `json:"state"`
+	Since        time.Time          `json:"since"`
+	SinceSeconds int64              `json:"sinceSeconds"`
+	Samples      int                `json:"samples"`
+	Availability map[string]float64 `json:"availability"`
+	Transitions  []Transition       `json:"transitions"`
+}
+
+type byAddress []*InstanceHistory
+
+func (a byAddress) Len() int           { return len(a) }
+func (a byAddress) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byAddress) Less(i, j int) bool { return a[i].Address < a[j].Address }
+
+// ServiceHistory is the history of every instance of a service.
+type ServiceHistory struct {
+	Name      string             `json:"name"`
+	Instances []*InstanceHistory `json:"instances"`
+}
+
+func historyNameKey(name string) string {
+	return "History:name:" + name
+}
+
+func historyKey(hash string) string {
+	return "History:inst:" + hash
+}
+
+// RecordStatus adds a sample for every item in a status block.
+func (r *Registry) RecordStatus(block StatusBlock, now time.Time) {
+	for _, item := range block {
+		name := item.Get("Name")
+		if name == "" || name == "vasco" {
+			continue
+		}
+		hash := Hash(name, item.Get("Address"))
+		code, _ := item["StatusCode"].(int)
+		sample, _ := json.Marshal(HistorySample{Time: now.UTC(), Address: item.Get("Address"), State: item.State(), StatusCode: code})
+
+		key := historyKey(hash)
+		if err := r.c.ZAdd(key, float64(now.UnixNano())/1e9, string(sample)); err != nil {
+			events.Warn("couldn't record status history", "name", name, "err", err)
+			continue
+		}
+		r.c.SAdd(historyNameKey(name), hash)
+		r.c.SAdd(historyNamesKey, name)
+		r.trimHistory(key)
+	}
+
+	last := atomic.LoadInt64(&r.historyPruned)
+	if now.Unix()-last >= int64(historyPruneInterval/time.Second) && atomic.CompareAndSwapInt64(&r.historyPruned, last, now.Unix()) {
+		r.pruneHistory(now)
+	}
+}
+
+// pruneHistory drops every instance that hasn't been seen for historyMaxAge,
+// and forgets names that have no instances left.
+func (r *Registry) pruneHistory(now time.Time) {
+	names, err := r.c.SGet(historyNamesKey)
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		hashes, _ := r.c.SGet(historyNameKey(name))
+		left := len(hashes)
+		for _, hash := range hashes {
+			samples := r.samples(hash)
+			if len(samples) == 0 || now.Sub(samples[len(samples)-1].Time) > historyMaxAge {
+				r.dropHistory(name, hash)
+				left--
+			}
+		}
+		if left == 0 {
+			r.c.SRemove(historyNamesKey, name)
+		}
+	}
+}
+
+// trimHistory removes the oldest samples beyond the limit
+func (r *Registry) trimHistory(key string) {
+	count, err := r.c.ZCard(key)
+	if err != nil || count <= r.HistoryLimit {
+		return
+	}
+	old, err := r.c.ZRange(key, 0, count-r.HistoryLimit-1)
+	if err != nil {
+		return
+	}
+	for _, sample := range old {
+		r.c.ZRem(key, sample)
+	}
+}
+
+// History returns the history of every instance of a service, or nil if
+// there isn't any.
+func (r *Registry) History(name string, now time.Time) *ServiceHistory {
+	hashes, err := r.c.SGet(historyNameKey(name))
+	if err != nil {
+		return nil
+	}
+	hist := &ServiceHistory{Name: name, Instances: make([]*InstanceHistory, 0)}
+	for _, hash := range hashes {
+		samples := r.samples(hash)
+		if len(samples) == 0 || now.Sub(samples[len(samples)-1].Time) > historyMaxAge {
+			r.dropHistory(name, hash)
+			continue
+		}
+		hist.Instances = append(hist.Instances, summarizeHistory(samples, now))
+	}
+	if len(hist.Instances) == 0 {
+		return nil
+	}
+	sort.Sort(byAddress(hist.Instances))
+	return hist
+}
+
+func (r *Registry) samples(hash string) []HistorySample {
+	members, err := r.c.ZRange(historyKey(hash), 0, -1)
+	if err != nil {
+		return nil
+	}
+	samples := make([]HistorySample, 0, len(members))
+	for _, member := range members {
+		var sample HistorySample
+		if err := json.Unmarshal([]byte(member), &sample); err == nil {
+			samples = append(samples, sample)
+		}
+	}
+	return samples
+}
+
+func (r *Registry) dropHistory(name string, hash string) {
+	key := historyKey(hash)
+	members, _ := r.c.ZRange(key, 0, -1)
+	for _, member := range members {
+		r.c.ZRem(key, member)
+	}
+	r.c.SRemove(historyNameKey(name), hash)
+}
+
+// summarizeHistory works out the transitions and availability from samples
+// in time order.
+func summarizeHistory(samples []HistorySample, now time.Time) *InstanceHistory {
+	inst := &InstanceHistory{
+		Samples:      len(samples),
+		Availability: make(map[string]float64),
+		Transitions:  make([]Transition, 0),
+	}
+	for ix, sample := range samples {
+		if ix == 0 {
+			inst.Since = sample.Time
+			continue
+		}
+		if prev := samples[ix-1].State; prev != sample.State {
+			inst.Transitions = append(inst.Transitions, Transition{Time: sample.Time, From: prev, To: sample.State})
+			inst.Since = sample.Time
+		}
+	}
+	last := samples[len(samples)-1]
+	inst.Address = last.Address
+	inst.State = last.State
+	inst.SinceSeconds = int64(now.Sub(inst.Since) / time.Second)
+
+	for _, window := range historyWindows {
+		total, up := 0, 0
+		for _, sample := range samples {
+			if now.Sub(sample.Time) <= window.d {
+				total++
+				if sample.State == "up" {
+					up++
+				}
+			}
+		}
+		if total > 0 {
+			inst.Availability[window.name] = float64(up) * 100 / float64(total)
+		}
+	}
+	return inst
+}
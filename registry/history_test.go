@@ -0,0 +1,124 @@
+package registry
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/AchievementNetwork/vasco/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatusHistory(t *testing.T) {
+	lc := cache.NewLocalCache()
+	defer lc.Close()
+	reg := NewRegistry(lc, "", "", 60)
+	reg.HistoryLimit = 5
+
+	up := StatusItem{"Name": "user", "Address": "http://1.1.1.1:8080", "StatusCode": 200}
+	down := StatusItem{"Name": "user", "Address": "http://1.1.1.1:8080", "StatusCode": 503, "Error": "GET failed"}
+	other := StatusItem{"Name": "user", "Address": "http://1.1.1.2:8080", "StatusCode": 200}
+
+	start := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+	for ix, item := range []StatusItem{up, up, down, up, down, down, up} {
+		reg.RecordStatus(StatusBlock{item, other}, start.Add(time.Duration(ix)*time.Minute))
+	}
+	now := start.Add(10 * time.Minute)
+
+	assert.Nil(t, reg.History("nobody", now))
+	hist := reg.History("user", now)
+	if !assert.NotNil(t, hist) {
+		return
+	}
+	assert.Equal(t, 2, len(hist.Instances))
+
+	// only the last 5 samples are kept: down, up, down, down, up
+	first := hist.Instances[0]
+	assert.Equal(t, "http://1.1.1.1:8080", first.Address)
+	assert.Equal(t, 5, first.Samples)
+	assert.Equal(t, "up", first.State)
+	assert.Equal(t, start.Add(6*time.Minute), first.Since)
+	assert.Equal(t, int64(240), first.SinceSeconds)
+	assert.Equal(t, 3, len(first.Transitions))
+	assert.Equal(t, Transition{Time: start.Add(6 * time.Minute), From: "down", To: "up"}, first.Transitions[2])
+	assert.InDelta(t, 40, first.Availability["1h"], 0.01)
+
+	assert.Equal(t, float64(100), hist.Instances[1].Availability["24h"])
+	assert.Equal(t, 0, len(hist.Instances[1].Transitions))
+
+	// instances that haven't been seen for a long time are forgotten
+	assert.Nil(t, reg.History("user", now.Add(8*24*time.Hour)))
+}
+
+func TestStatusHistoryPruning(t *testing.T) {
+	// the history is kept in sets and sorted sets, which each kind of cache
+	// stores its own way, so this runs against all of them
+	lc := cache.NewLocalCache()
+	defer lc.Close()
+	testHistoryPruning(t, lc)
+
+	dir, err := ioutil.TempDir("", "vasco-history")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	bc, err := cache.NewBoltCache(dir + "/history.db")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer bc.Close()
+	testHistoryPruning(t, bc)
+
+	if os.Getenv("TEST_REDIS") != "" {
+		rc, err := cache.NewRedisCacheFromURL(fmt.Sprintf("redis://localhost:6379?prefix=history%d:", time.Now().UnixNano()))
+		if !assert.Nil(t, err) {
+			return
+		}
+		defer rc.Close()
+		testHistoryPruning(t, rc)
+	}
+}
+
+func testHistoryPruning(t *testing.T, c cache.Cache) {
+	t.Logf("Now testing %T", c)
+	reg := NewRegistry(c, "", "", 60)
+
+	// a service that's renamed leaves its old name behind
+	start := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+	old := StatusItem{"Name": "users", "Address": "http://1.1.1.1:8080", "StatusCode": 200}
+	renamed := StatusItem{"Name": "user", "Address": "http://1.1.1.1:8080", "StatusCode": 200}
+	reg.RecordStatus(StatusBlock{old}, start)
+	names, _ := c.SGet(historyNamesKey)
+	assert.Equal(t, []string{"users"}, names)
+
+	// its history is kept until it's too old to matter
+	reg.RecordStatus(StatusBlock{renamed}, start.Add(time.Hour))
+	assert.NotNil(t, reg.History("users", start.Add(time.Hour)))
+	reg.RecordStatus(StatusBlock{renamed}, start.Add(historyMaxAge+time.Hour))
+
+	_, err := c.SGet(historyNameKey("users"))
+	assert.NotNil(t, err)
+	n, _ := c.ZCard(historyKey(Hash("users", "http://1.1.1.1:8080")))
+	assert.Equal(t, 0, n)
+	names, _ = c.SGet(historyNamesKey)
+	assert.Equal(t, []string{"user"}, names)
+	assert.NotNil(t, reg.History("user", start.Add(historyMaxAge+time.Hour)))
+
+	// a service can't be named after the index of names
+	named := StatusItem{"Name": "names", "Address": "http://1.1.1.2:8080", "StatusCode": 200}
+	reg.RecordStatus(StatusBlock{named}, start.Add(historyMaxAge+2*time.Hour))
+	names, _ = c.SGet(historyNamesKey)
+	sort.Strings(names)
+	assert.Equal(t, []string{"names", "user"}, names)
+	assert.NotNil(t, reg.History("names", start.Add(historyMaxAge+2*time.Hour)))
+
+	// and in the end, everything goes
+	reg.pruneHistory(start.Add(3 * historyMaxAge))
+	_, err = c.SGet(historyNamesKey)
+	assert.NotNil(t, err)
+	n, _ = c.ZCard(historyKey(Hash("user", "http://1.1.1.1:8080")))
+	assert.Equal(t, 0, n)
+}
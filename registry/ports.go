@@ -0,0 +1,125 @@
+/**
+ * Name: ports.go
+ * Description: Leases on listening ports for services on a shared host
+ * Copyright 2016 The Achievement Network. All rights reserved.
+ */
+
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// Services that share a host can ask for a port to listen on before they
+// register. Each port in [MinPort, MaxPort] can be leased by one service at a
+// time; a lease is a cache key that expires and is refreshed just like a
+// registration, so a service that goes away gives its port back.
+
+// Default port range, matching the MINPORT and MAXPORT in the Dockerfile
+const (
+	DefaultMinPort = 8100
+	DefaultMaxPort = 9900
+)
+
+// ErrNoPorts is returned when every port in the range is leased.
+var ErrNoPorts = errors.New("No ports are available.")
+
+// ErrNoLease is returned when a port isn't leased.
+var ErrNoLease = errors.New("That port is not leased.")
+
+// ErrNotLeasee is returned when a service tries to refresh or release a port
+// that's leased to another one.
+var ErrNotLeasee = errors.New("That port is leased to another service.")
+
+// PortLease is a port leased to a service.
+type PortLease struct {
+	Port    int       `json:"port"`
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+}
+
+func portKey(port int) string {
+	return "Port:" + strconv.Itoa(port)
+}
+
+// leaseExpiry is the same as a registration's
+func (r *Registry) leaseExpiry() int {
+	if r.Timeout == 0 {
+		return 0
+	}
+	return r.Timeout + 2
+}
+
+// LeasePort leases a free port in the range to a service. It starts looking
+// at a random port so that concurrent requests (from other replicas, too)
+// don't all fight over the same one.
+func (r *Registry) LeasePort(name string) (*PortLease, error) {
+	n := r.MaxPort - r.MinPort + 1
+	if n <= 0 {
+		return nil, ErrNoPorts
+	}
+	start := rand.Intn(n)
+	for ix := 0; ix < n; ix++ {
+		port := r.MinPort + (start+ix)%n
+		lease := &PortLease{Port: port, Name: name, Created: time.Now().UTC()}
+		data, _ := json.Marshal(lease)
+		ok, err := r.c.SetIfAbsent(portKey(port), string(data), r.leaseExpiry())
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			events.Info("leased port", "port", port, "name", name)
+			return lease, nil
+		}
+	}
+	return nil, ErrNoPorts
+}
+
+// FindPort returns the lease on a port, or nil if it isn't leased.
+func (r *Registry) FindPort(port int) *PortLease {
+	data, err := r.c.Get(portKey(port))
+	if err != nil {
+		return nil
+	}
+	lease := new(PortLease)
+	if err := json.Unmarshal([]byte(data), lease); err != nil {
+		return nil
+	}
+	return lease
+}
+
+// checkLease makes sure a port is leased to the named service
+func (r *Registry) checkLease(port int, name string) error {
+	lease := r.FindPort(port)
+	if lease == nil {
+		return ErrNoLease
+	}
+	if lease.Name != name {
+		return ErrNotLeasee
+	}
+	return nil
+}
+
+// RefreshPort extends the lease on a port for the service that holds it.
+func (r *Registry) RefreshPort(port int, name string) error {
+	if err := r.checkLease(port, name); err != nil {
+		return err
+	}
+	if expiry := r.leaseExpiry(); expiry != 0 {
+		return r.c.Expire(portKey(port), expiry)
+	}
+	return nil
+}
+
+// ReleasePort gives a port back for the service that holds it.
+func (r *Registry) ReleasePort(port int, name string) error {
+	if err := r.checkLease(port, name); err != nil {
+		return err
+	}
+	events.Info("released port", "port", port, "name", name)
+	return r.c.Delete(portKey(port))
+}
@@ -0,0 +1,53 @@
+package registry
+
+import (
+	"testing"
+
+	"github.com/AchievementNetwork/vasco/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPortLeases(t *testing.T) {
+	lc := cache.NewLocalCache()
+	defer lc.Close()
+	reg := NewRegistry(lc, "", "", 60)
+	reg.MinPort, reg.MaxPort = 9000, 9002
+
+	seen := make(map[int]bool)
+	for i := 0; i < 3; i++ {
+		lease, err := reg.LeasePort("user")
+		if assert.Nil(t, err) {
+			assert.True(t, lease.Port >= 9000 && lease.Port <= 9002)
+			assert.False(t, seen[lease.Port])
+			seen[lease.Port] = true
+		}
+	}
+	_, err := reg.LeasePort("tags")
+	assert.Equal(t, ErrNoPorts, err)
+
+	// leases expire like registrations
+	ttl, _ := lc.TTL(portKey(9001))
+	assert.InDelta(t, 62, ttl, 1)
+	lc.Expire(portKey(9001), 5)
+	assert.Nil(t, reg.RefreshPort(9001, "user"))
+	ttl, _ = lc.TTL(portKey(9001))
+	assert.InDelta(t, 62, ttl, 1)
+	assert.Equal(t, "user", reg.FindPort(9001).Name)
+
+	// only the service that holds a lease can refresh or release it
+	lc.Expire(portKey(9001), 5)
+	assert.Equal(t, ErrNotLeasee, reg.RefreshPort(9001, "tags"))
+	ttl, _ = lc.TTL(portKey(9001))
+	assert.InDelta(t, 5, ttl, 1)
+	assert.Equal(t, ErrNotLeasee, reg.ReleasePort(9001, "tags"))
+	assert.Equal(t, "user", reg.FindPort(9001).Name)
+
+	assert.Nil(t, reg.ReleasePort(9001, "user"))
+	assert.Nil(t, reg.FindPort(9001))
+	assert.Equal(t, ErrNoLease, reg.ReleasePort(9001, "user"))
+	assert.Equal(t, ErrNoLease, reg.RefreshPort(9001, "user"))
+
+	lease, err := reg.LeasePort("tags")
+	assert.Nil(t, err)
+	assert.Equal(t, 9001, lease.Port)
+}
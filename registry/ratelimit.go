@@ -0,0 +1,73 @@
+/**
+ * Name: ratelimit.go
+ * Description: Rate limits on registrations
+ * Copyright 2016 The Achievement Network. All rights reserved.
+ */
+
+package registry
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// RateLimit limits how often the proxy sends requests to a registration,
+// with a token bucket that holds Burst requests and refills at Rate requests
+// a second. Every registration with the same name shares the buckets.
+//
+// Key says who gets a bucket:
+//
+//	ip            each client address (the default)
+//	header:Name   each value of a header, like an API key (clients that
+//	              don't send it are limited by address)
+//	global        everyone shares one
+type RateLimit struct {
+	Rate  float64 `json:"rate" yaml:"rate"`
+	Burst int     `json:"burst,omitempty" yaml:"burst,omitempty"`
+	Key   string  `json:"key,omitempty" yaml:"key,omitempty"`
+}
+
+const (
+	RateLimitByIP     = "ip"
+	RateLimitGlobal   = "global"
+	RateLimitByHeader = "header:"
+)
+
+// setDefaults checks a rate limit and fills in its burst and key
+func (rl *RateLimit) setDefaults() error {
+	if rl.Rate <= 0 {
+		return fmt.Errorf("The rate limit must have a rate greater than 0.")
+	}
+	if rl.Burst < 0 {
+		return fmt.Errorf("The rate limit burst cannot be negative.")
+	}
+	if rl.Burst == 0 {
+		rl.Burst = int(math.Max(1, math.Ceil(rl.Rate)))
+	}
+	switch {
+	case rl.Key == "":
+		rl.Key = RateLimitByIP
+	case rl.Key == RateLimitByIP, rl.Key == RateLimitGlobal:
+	case strings.HasPrefix(rl.Key, RateLimitByHeader) && headerNameRegex.MatchString(rl.Key[len(RateLimitByHeader):]):
+	default:
+		return fmt.Errorf("The rate limit key '%s' should be ip, global or header:<name>.", rl.Key)
+	}
+	return nil
+}
+
+// BucketKey returns the cache key of the bucket a request uses. Header
+// values are hashed so that API keys don't end up in the cache.
+func (rl *RateLimit) BucketKey(name string, clientIP string, h http.Header) string {
+	prefix := "RateLimit:" + name + ":"
+	if rl.Key == RateLimitGlobal {
+		return prefix + "global"
+	}
+	if strings.HasPrefix(rl.Key, RateLimitByHeader) {
+		if value := h.Get(rl.Key[len(RateLimitByHeader):]); value != "" {
+			return prefix + "header:" + Hash(value)
+		}
+	}
+	return prefix + "ip:" + clientIP
+}
@@ -0,0 +1,51 @@
+package registry
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimitValidation(t *testing.T) {
+	reg := NewRegFromJSON(`{"name": "user", "address": "http://1.1.1.1:8080", "pattern": "/user", "status": {"path": "/status"},
+		"rateLimit": {"rate": 2.5}}`)
+	assert.NotNil(t, reg)
+	assert.Nil(t, reg.SetDefaults())
+	assert.Equal(t, 3, reg.RateLimit.Burst)
+	assert.Equal(t, RateLimitByIP, reg.RateLimit.Key)
+
+	reg.RateLimit = &RateLimit{Rate: 0.1}
+	assert.Nil(t, reg.SetDefaults())
+	assert.Equal(t, 1, reg.RateLimit.Burst)
+
+	for _, bad := range []*RateLimit{
+		{Rate: 0},
+		{Rate: -1},
+		{Rate: 1, Burst: -1},
+		{Rate: 1, Key: "cookie"},
+		{Rate: 1, Key: "header:"},
+		{Rate: 1, Key: "header:Bad Name"},
+	} {
+		reg.RateLimit = bad
+		assert.NotNil(t, reg.SetDefaults(), bad.Key)
+	}
+}
+
+func TestRateLimitBucketKey(t *testing.T) {
+	h := http.Header{}
+	h.Set("X-Api-Key", "secret")
+
+	rl := &RateLimit{Rate: 1, Key: RateLimitByIP}
+	assert.Equal(t, "RateLimit:user:ip:1.2.3.4", rl.BucketKey("user", "1.2.3.4", h))
+
+	rl.Key = RateLimitGlobal
+	assert.Equal(t, "RateLimit:user:global", rl.BucketKey("user", "1.2.3.4", h))
+
+	rl.Key = "header:X-Api-Key"
+	key := rl.BucketKey("user", "1.2.3.4", h)
+	assert.Equal(t, "RateLimit:user:header:"+Hash("secret"), key)
+	assert.NotContains(t, key, "secret")
+	// without the header, clients are limited by address
+	assert.Equal(t, "RateLimit:user:ip:1.2.3.4", rl.BucketKey("user", "1.2.3.4", http.Header{}))
+}
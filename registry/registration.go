@@ -21,19 +21,24 @@ import (
 )
 
 type Status struct {
-	Path string `json:"path"`
+	Path string `json:"path" yaml:"path"`
 }
 
 type Registration struct {
-	Name     string `json:"name"`
-	Address  string `json:"address"`
-	Pattern  string `json:"pattern"`
-	Weight   int    `json:"weight,omitempty"`
-	Stat     Status `json:"status,omitempty"`
-	Disabled bool   `json:"disabled"`
-	hash     string
-	regex    *regexp.Regexp
-	url      *url.URL
+	Name          string       `json:"name" yaml:"name"`
+	Address       string       `json:"address" yaml:"address"`
+	Pattern       string       `json:"pattern" yaml:"pattern"`
+	Weight        int          `json:"weight,omitempty" yaml:"weight,omitempty"`
+	Stat          Status       `json:"status,omitempty" yaml:"status,omitempty"`
+	Disabled      bool         `json:"disabled" yaml:"disabled"`
+	Rewrite       string       `json:"rewrite,omitempty" yaml:"rewrite,omitempty"`
+	Headers       *HeaderRules `json:"headers,omitempty" yaml:"headers,omitempty"`
+	RateLimit     *RateLimit   `json:"rateLimit,omitempty" yaml:"rateLimit,omitempty"`
+	MaxConcurrent int          `json:"maxConcurrent,omitempty" yaml:"maxConcurrent,omitempty"`
+	QueueTimeout  int          `json:"queueTimeout,omitempty" yaml:"queueTimeout,omitempty"` // milliseconds
+	hash          string
+	regex         *regexp.Regexp
+	url           *url.URL
 }
 
 func NewRegFromJSON(j string) *Registration {
@@ -90,12 +95,31 @@ func (r *Registration) SetDefaults() error {
 	if err := r.CompilePath(); err != nil {
 		return err
 	}
+	if err := r.validateRewrite(); err != nil {
+		return err
+	}
 	if r.Stat.Path == "" {
 		return errors.New("The status path field cannot be blank.")
 	}
 	if r.Weight == 0 {
 		r.Weight = 100
 	}
+	if r.Headers != nil {
+		if err := r.Headers.validate(); err != nil {
+			return err
+		}
+	}
+	if r.RateLimit != nil {
+		if err := r.RateLimit.setDefaults(); err != nil {
+			return err
+		}
+	}
+	if r.MaxConcurrent < 0 {
+		return errors.New("The maxConcurrent field cannot be negative.")
+	}
+	if r.QueueTimeout < 0 {
+		return errors.New("The queueTimeout field cannot be negative.")
+	}
 	return nil
 }
 
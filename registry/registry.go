@@ -12,24 +12,48 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"math/rand"
 	"net/http"
 	"net/url"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/AchievementNetwork/go-util/util"
 	"github.com/AchievementNetwork/stringset"
 	"github.com/AchievementNetwork/vasco/cache"
+	"github.com/AchievementNetwork/vasco/logger"
 )
 
+// events is the registry's event log: registrations coming and going, cache
+// trouble, configuration changes
+var events = logger.Named("registry")
+
+// itemsKey is the cache set holding the hash of every registration
+const itemsKey = "Registry:ITEMS"
+
 // Registry maintains a private cache of the registry data
 type Registry struct {
+	expirations      int64 // first, so it's aligned for atomic access
+	historyPruned    int64 // when RecordStatus last pruned, in unix seconds; also atomic
 	StaticPath       string
 	ExpectedServices *stringset.StringSet
 	c                cache.Cache
 	Timeout          int
+	HistoryLimit     int // the number of status samples kept for each instance
+	MinPort          int // the range of ports that LeasePort hands out
+	MaxPort          int
+	static           map[string]*Registration
+	staticMutex      sync.RWMutex
+	// lastGood is the last complete set of registrations we read from the
+	// cache; if the cache fails, we route with it until the cache comes back
+	lastGood      []*Registration
+	cacheErr      error
+	fallbackMutex sync.RWMutex
+	// OnExpire, if set, is called whenever a registration expires
+	OnExpire func(reg *Registration)
+	inflight *inFlight
 }
 
 type StatusItem map[string]interface{}
@@ -45,6 +69,22 @@ func (s StatusItem) Get(name string) string {
 	}
 }
 
+// State classifies a status item as up, failing (it answered, but not with a
+// 2xx), down (it didn't answer, or it's disabled) or missing.
+func (s StatusItem) State() string {
+	if missing, _ := s["missing"].(bool); missing {
+		return "missing"
+	}
+	if disabled, _ := s["disabled"].(bool); disabled || s.Get("Error") != "" {
+		return "down"
+	}
+	code, _ := s["StatusCode"].(int)
+	if code < 200 || code > 299 {
+		return "failing"
+	}
+	return "up"
+}
+
 type byName StatusBlock
 
 func (a byName) Len() int      { return len(a) }
@@ -64,6 +104,11 @@ func NewRegistry(theCache cache.Cache, staticPath string, expected string, timeo
 		StaticPath:       staticPath,
 		ExpectedServices: stringset.New(),
 		Timeout:          timeout,
+		HistoryLimit:     DefaultHistoryLimit,
+		MinPort:          DefaultMinPort,
+		MaxPort:          DefaultMaxPort,
+		static:           make(map[string]*Registration),
+		inflight:         newInFlight(),
 	}
 	exp := strings.Split(expected, " ")
 	r.ExpectedServices.Add(exp...)
@@ -71,9 +116,38 @@ func NewRegistry(theCache cache.Cache, staticPath string, expected string, timeo
 	if r.ExpectedServices.Contains("") {
 		r.ExpectedServices.Delete("")
 	}
+	// if the cache can tell us when things expire, we want to know right away
+	if n, ok := theCache.(cache.ExpiryNotifier); ok {
+		n.OnExpire(r.expired)
+	}
 	return &r
 }
 
+// expired is called by the cache when a key expires.
+func (r *Registry) expired(key string, value string) {
+	reg := NewRegFromJSON(value)
+	if reg == nil || reg.Hash() != key {
+		// not a registration
+		return
+	}
+	if static := r.staticRegistration(key); static != nil {
+		r.Register(static, false)
+		return
+	}
+	r.c.SRemove(itemsKey, key)
+	atomic.AddInt64(&r.expirations, 1)
+	events.Info("expired", "hash", key, "name", reg.Name, "address", reg.Address)
+	if r.OnExpire != nil {
+		r.OnExpire(reg)
+	}
+}
+
+// Expirations returns the number of registrations that the cache has
+// reported as expired.
+func (r *Registry) Expirations() int64 {
+	return atomic.LoadInt64(&r.expirations)
+}
+
 // Register takes a registration object and stores it so that it can be efficiently
 // queried. It stores it keyed by its hash value, and if a timeout is requested sets an
 // expiration time.
@@ -84,21 +158,41 @@ func (r *Registry) Register(reg *Registration, expire bool) string {
 	reg.Disabled = false
 	hash := reg.Hash()
 
-	r.c.Set(hash, reg.String())
+	ttl := 0
 	if r.Timeout != 0 && expire {
 		// we give clients 2 extra seconds to refresh before timeout
 		// in case they're using our timeout to trigger refresh
-		r.c.Expire(hash, r.Timeout+2)
+		ttl = r.Timeout + 2
+	}
+	if err := r.store(reg, ttl); err != nil {
+		events.Error("register failed", "hash", hash, "name", reg.Name, "address", reg.Address, "err", err)
+		return hash
 	}
-	r.c.SAdd("Registry:ITEMS", hash)
-	log.Printf("register %s: %v\n", hash, reg.String())
+	events.Info("registered", "hash", hash, "name", reg.Name, "address", reg.Address, "pattern", reg.Pattern)
 	return hash
 }
 
+// store writes a registration that lives for ttl seconds (or forever, if
+// ttl is 0). The value, its expiration and its membership in the item set
+// are all written together so nobody ever sees a partial registration.
+func (r *Registry) store(reg *Registration, ttl int) error {
+	hash := reg.Hash()
+	b := r.c.Batch()
+	if ttl > 0 {
+		b.SetWithExpiry(hash, reg.String(), ttl)
+	} else {
+		b.Set(hash, reg.String())
+	}
+	b.SAdd(itemsKey, hash)
+	return b.Exec()
+}
+
 func (r *Registry) Find(hash string) *Registration {
 	regtext, err := r.c.Get(hash)
 	if err != nil {
-		fmt.Println(err)
+		if err != cache.ErrNotFound {
+			events.Warn("find failed", "hash", hash, "err", err)
+		}
 		return nil
 	}
 	reg := NewRegFromJSON(regtext)
@@ -111,14 +205,17 @@ func (r *Registry) Unregister(reg *Registration) {
 	}
 
 	h := reg.Hash()
-	r.c.SRemove("Registry:ITEMS", h)
-	r.c.Delete(h)
+	if err := r.c.Batch().SRemove(itemsKey, h).Delete(h).Exec(); err != nil {
+		events.Error("unregister failed", "hash", h, "err", err)
+	}
 }
 
 func (r *Registry) DetailedStatus() StatusBlock {
 	notfound := r.ExpectedServices.Clone()
 	statuses := StatusBlock{}
-	regs := r.getAllRegistrations()
+	// disabled registrations are checked too, so that we notice when they
+	// come back
+	regs := r.getRegistrations(true)
 	for _, reg := range regs {
 		u, _ := url.Parse(reg.Address)
 		u.Path = reg.Stat.Path
@@ -129,9 +226,8 @@ func (r *Registry) DetailedStatus() StatusBlock {
 			item["StatusCode"] = http.StatusServiceUnavailable
 			if !reg.Disabled {
 				reg.Disabled = true
-				r.c.Set(reg.Hash(), reg.String())
 				// if the service becomes unavailable, expire it in 5 minutes
-				r.c.Expire(reg.Hash(), 300)
+				r.c.SetWithExpiry(reg.Hash(), reg.String(), 300)
 			}
 		} else {
 			body, err := ioutil.ReadAll(result.Body)
@@ -142,14 +238,17 @@ func (r *Registry) DetailedStatus() StatusBlock {
 			item["StatusCode"] = result.StatusCode
 			if reg.Disabled {
 				reg.Disabled = false
-				r.c.Set(reg.Hash(), reg.String())
-				r.c.Expire(reg.Hash(), r.Timeout+2)
+				r.c.SetWithExpiry(reg.Hash(), reg.String(), r.Timeout+2)
 			}
 		}
 		item["Name"] = reg.Name
 		item["Address"] = reg.Address
 		item["Port"] = ""
 		item["disabled"] = reg.Disabled
+		item["inflight"] = r.InFlight(reg.Hash())
+		if reg.MaxConcurrent > 0 {
+			item["maxConcurrent"] = reg.MaxConcurrent
+		}
 		hs := strings.Split(u.Host, ":")
 		if len(hs) == 2 {
 			item["Port"] = hs[1]
@@ -183,6 +282,7 @@ func (r *Registry) DetailedStatus() StatusBlock {
 		item["Port"] = ""
 		item["Error"] = "Expected service not found."
 		item["StatusCode"] = http.StatusServiceUnavailable
+		item["missing"] = true
 		statuses = append(statuses, item)
 	}
 	sort.Sort(byName(statuses))
@@ -203,6 +303,10 @@ func (r *Registry) Refresh(reg *Registration) {
 // given a set of possible registration options, this chooses one
 // of them using a weighted random strategy
 func (r *Registry) choose(choices []*Registration) (best *Registration) {
+	// a lone choice wins whatever its weight
+	if len(choices) == 1 {
+		return choices[0]
+	}
 	total := 0
 	for _, choice := range choices {
 		total += choice.Weight
@@ -219,7 +323,7 @@ func (r *Registry) choose(choices []*Registration) (best *Registration) {
 		}
 	}
 
-	fmt.Printf("WARNING: impossible exit from Registry.choose -- %d %v.\n", target, choices)
+	events.Warn("impossible exit from Registry.choose", "target", target, "choices", len(choices))
 	best = choices[len(choices)-1]
 	return
 }
@@ -227,34 +331,126 @@ func (r *Registry) choose(choices []*Registration) (best *Registration) {
 // getAllRegistrations is a helper function that retrieves all known registrations
 // but also removes any that have expired
 func (r *Registry) getAllRegistrations() []*Registration {
-	hashes, _ := r.c.SGet("Registry:ITEMS")
-	results := make([]*Registration, 0)
+	return r.getRegistrations(false)
+}
+
+// getRegistrations does the work for getAllRegistrations; if includeDisabled
+// is set, disabled registrations are returned as well. If the cache isn't
+// working, it returns the registrations from the last time it was.
+func (r *Registry) getRegistrations(includeDisabled bool) []*Registration {
+	if a, ok := r.c.(cache.Availability); ok {
+		if err := a.Available(); err != nil {
+			return r.fallback(includeDisabled, err)
+		}
+	}
+	hashes, err := r.c.SGet(itemsKey)
+	if err != nil && err != cache.ErrNotFound {
+		return r.fallback(includeDisabled, err)
+	}
+	all := make([]*Registration, 0)
 	removes := make([]string, 0)
 	for _, hash := range hashes {
 		regtext, err := r.c.Get(hash)
-		if err != nil {
-			// the hash has expired so plan to delete the corresponding hash item
-			removes = append(removes, hash)
-		} else {
-			reg := NewRegFromJSON(regtext)
-			// don't consider disabled registrations
-			if !reg.Disabled {
-				results = append(results, reg)
-			}
+		if err == nil {
+			all = append(all, NewRegFromJSON(regtext))
+			continue
 		}
+		if err != cache.ErrNotFound {
+			return r.fallback(includeDisabled, err)
+		}
+		// static registrations never go away; if one was expired (because
+		// it was disabled) we put it back so that it gets checked again
+		if static := r.staticRegistration(hash); static != nil {
+			r.Register(static, false)
+			all = append(all, NewRegFromJSON(static.String()))
+			continue
+		}
+		// the hash has expired so plan to delete the corresponding hash item
+		removes = append(removes, hash)
 	}
 
 	// now delete all the items that expired
 	for _, hash := range removes {
-		r.c.Delete(hash)
-		r.c.SRemove("Registry:ITEMS", hash)
-		log.Printf("Expired %s\n", hash)
+		r.c.Batch().Delete(hash).SRemove(itemsKey, hash).Exec()
+		events.Info("expired", "hash", hash)
 	}
 
+	r.fallbackMutex.Lock()
+	if r.cacheErr != nil {
+		events.Info("cache is working again; routing from the cache")
+	}
+	r.lastGood = all
+	r.cacheErr = nil
+	r.fallbackMutex.Unlock()
+	return filterDisabled(all, includeDisabled)
+}
+
+// fallback returns the last known-good registrations (or, if we've never
+// been able to read the cache, the static ones) and records the cache error.
+func (r *Registry) fallback(includeDisabled bool, err error) []*Registration {
+	r.fallbackMutex.Lock()
+	if r.cacheErr == nil {
+		events.Error("cache failed; routing from the last known registrations", "err", err)
+	}
+	r.cacheErr = err
+	regs := r.lastGood
+	r.fallbackMutex.Unlock()
+
+	if regs == nil {
+		r.staticMutex.RLock()
+		for _, static := range r.static {
+			regs = append(regs, static)
+		}
+		r.staticMutex.RUnlock()
+	}
+	// callers are allowed to modify what we give them
+	results := make([]*Registration, 0, len(regs))
+	for _, reg := range regs {
+		results = append(results, NewRegFromJSON(reg.String()))
+	}
+	return filterDisabled(results, includeDisabled)
+}
+
+func filterDisabled(regs []*Registration, includeDisabled bool) []*Registration {
+	if includeDisabled {
+		return regs
+	}
+	results := make([]*Registration, 0, len(regs))
+	for _, reg := range regs {
+		if !reg.Disabled {
+			results = append(results, reg)
+		}
+	}
 	return results
 }
 
+// CacheError returns nil if the registry is working from its cache, or the
+// reason it isn't (in which case it's routing from the last registrations it
+// knew about).
+func (r *Registry) CacheError() error {
+	if a, ok := r.c.(cache.Availability); ok {
+		if err := a.Available(); err != nil {
+			return err
+		}
+	}
+	r.fallbackMutex.RLock()
+	defer r.fallbackMutex.RUnlock()
+	return r.cacheErr
+}
+
 func (r *Registry) FindBestMatch(surl string) (best *Registration, err error) {
+	choices, err := r.findMatchGroup(surl)
+	if err != nil {
+		return nil, err
+	}
+	best = r.choose(choices)
+	events.Debug("selected", "name", best.Name, "address", best.Address, "url", surl)
+	return best, nil
+}
+
+// findMatchGroup returns the registrations that tie for the best match of a
+// url; the proxy picks one of them.
+func (r *Registry) findMatchGroup(surl string) ([]*Registration, error) {
 	regs := r.getAllRegistrations()
 	matches := make([]*Registration, 0)
 	u, _ := url.Parse(surl)
@@ -266,84 +462,106 @@ func (r *Registry) FindBestMatch(surl string) (best *Registration, err error) {
 
 	switch len(matches) {
 	case 0:
-		log.Printf("No match found for URL '%s'\n", surl)
-		best = nil
-		err = util.NewWebError(http.StatusNotFound, "VASCO-100", "No matching path was found.")
+		events.Debug("no match", "url", surl)
+		return nil, util.NewWebError(http.StatusNotFound, "VASCO-100", "No matching path was found.")
 	case 1:
-		err = nil
-		best = matches[0]
-	default:
-		// at least two patterns were matched, so now we need to compare them for
-		// matching length. If we had these two patterns:
-		//   /foo(/.*)
-		//   /foo/bar(/.*)
-		// and we get /foo/bar/bazz, it will match both, but we want to return
-		// the second -- so we calculate the length of the unparenthesized portion
-		// of our match
-		var choices []*Registration
-		bestlen := 0
-		for _, match := range matches {
-			subs := match.regex.FindStringSubmatch(u.Path)
-			matchedlen := len(subs[0])
-			if len(subs) > 1 {
-				matchedlen -= len(subs[1])
-			}
-			if matchedlen > bestlen {
-				bestlen = matchedlen
-				choices = []*Registration{match}
-			} else if matchedlen == bestlen {
-				choices = append(choices, match)
-			}
-		}
+		return matches, nil
+	}
 
-		best = r.choose(choices)
+	// at least two patterns were matched, so now we need to compare them for
+	// matching length. If we had these two patterns:
+	//   /foo(/.*)
+	//   /foo/bar(/.*)
+	// and we get /foo/bar/bazz, it will match both, but we want to return
+	// the second -- so we calculate the length of the unparenthesized portion
+	// of our match
+	var choices []*Registration
+	bestlen := 0
+	for _, match := range matches {
+		matchedlen := match.matchedLength(u.Path)
+		if matchedlen > bestlen {
+			bestlen = matchedlen
+			choices = []*Registration{match}
+		} else if matchedlen == bestlen {
+			choices = append(choices, match)
+		}
 	}
+	return choices, nil
+}
 
-	if best != nil {
-		log.Printf("Selected '%s' on '%s' for URL '%s'\n", best.Name, best.Address, surl)
+// matchedLength is the length of the unparenthesized portion of the
+// registration's match on path
+func (reg *Registration) matchedLength(path string) int {
+	subs := reg.regex.FindStringSubmatch(path)
+	if subs == nil {
+		return 0
 	}
-	return
+	matchedlen := len(subs[0])
+	if len(subs) > 1 {
+		matchedlen -= len(subs[1])
+	}
+	return matchedlen
 }
 
 // Requirement:
 // Given a request, match it with the set of paths and rewrite it to forward it
 
 func (r *Registry) RewriteUrl(reqUrl *url.URL) error {
-	target, err := r.FindBestMatch(reqUrl.Path)
+	_, err := r.Route(reqUrl)
+	return err
+}
+
+// Route rewrites a URL to point at the registration that should handle it,
+// and returns that registration.
+func (r *Registry) Route(reqUrl *url.URL) (*Registration, error) {
+	return r.route(reqUrl, func(choices []*Registration) (*Registration, error) {
+		return r.choose(choices), nil
+	})
+}
+
+// route routes a URL, using pick to pick a registration from the match group
+func (r *Registry) route(reqUrl *url.URL, pick func([]*Registration) (*Registration, error)) (*Registration, error) {
+	choices, err := r.findMatchGroup(reqUrl.Path)
 
 	// if we got an error and it's a not found error, then
 	// we will forward it to the static server if one is specified
 	if err != nil {
 		if r.StaticPath == "" {
-			fmt.Println("Static path was null so we can't forward the request.")
-			return err
+			events.Debug("no static path, so the request can't be forwarded", "url", reqUrl.Path)
+			return nil, err
 		}
 
 		e, ok := err.(*util.WebError)
 		if !ok {
-			return err
+			return nil, err
 		}
 
 		if e.Code != http.StatusNotFound {
-			return err
+			return nil, err
 		}
 
 		reqUrl.Path = r.StaticPath + reqUrl.Path
-		target, err = r.FindBestMatch(reqUrl.Path)
+		if reqUrl.RawPath != "" {
+			reqUrl.RawPath = r.StaticPath + reqUrl.RawPath
+		}
+		choices, err = r.findMatchGroup(reqUrl.Path)
 		if err != nil {
-			fmt.Println("Error - Static lookup failed! ", err.Error())
-			return err
+			events.Debug("static lookup failed", "url", reqUrl.Path, "err", err)
+			return nil, err
 		}
 	}
 
-	// if the registration pattern included parentheses, we're going to
-	// rewrite the URL path
-	matches := target.regex.FindStringSubmatch(reqUrl.Path)
-	if len(matches) > 1 {
-		reqUrl.Path = matches[1]
+	target, err := pick(choices)
+	if err != nil {
+		return nil, err
 	}
+	events.Debug("selected", "name", target.Name, "address", target.Address, "url", reqUrl.Path)
+
+	// if the registration has a rewrite template, or its pattern included
+	// parentheses, we're going to rewrite the URL path
+	target.rewrite(reqUrl)
 
 	reqUrl.Scheme = target.url.Scheme
 	reqUrl.Host = target.url.Host
-	return nil
+	return target, nil
 }
@@ -1,6 +1,7 @@
 package registry
 
 import (
+	"errors"
 	"fmt"
 	"net/url"
 	"os"
@@ -197,3 +198,92 @@ func TestRoutingRandom(t *testing.T) {
 	assert.InDelta(t, 9, output["http://1.1.1.2:8081/tags/whatever"], 7)
 	fmt.Println(output)
 }
+
+func TestExpiryNotification(t *testing.T) {
+	lc := cache.NewLocalCache()
+	defer lc.Close()
+	reg := NewRegistry(lc, "", "", 60)
+	var expired []*Registration
+	reg.OnExpire = func(r *Registration) {
+		expired = append(expired, r)
+	}
+
+	hash := reg.Register(NewRegFromJSON(makeJson(servers[0])), true)
+	reg.Register(NewRegFromJSON(makeJson(servers[1])), true)
+	lc.Expire(hash, 0)
+	// reading the key is one way for the cache to notice that it's gone
+	assert.Nil(t, reg.Find(hash))
+
+	assert.Equal(t, 1, len(expired))
+	assert.Equal(t, servers[0].name, expired[0].Name)
+	assert.Equal(t, int64(1), reg.Expirations())
+	items, _ := lc.SGet("Registry:ITEMS")
+	assert.Equal(t, []string{Hash(servers[1].name, servers[1].addr)}, items)
+}
+
+// brokenCache fails every read while it's down, like redis does when the
+// connection goes away
+type brokenCache struct {
+	cache.Cache
+	down       bool
+	writesDown bool
+}
+
+func (b *brokenCache) Batch() cache.Batch {
+	if b.writesDown {
+		return brokenBatch{b.Cache.Batch()}
+	}
+	return b.Cache.Batch()
+}
+
+func (b *brokenCache) Get(key string) (string, error) {
+	if b.down {
+		return "", errors.New("connection refused")
+	}
+	return b.Cache.Get(key)
+}
+
+func (b *brokenCache) SGet(key string) ([]string, error) {
+	if b.down {
+		return nil, errors.New("connection refused")
+	}
+	return b.Cache.SGet(key)
+}
+
+// brokenBatch is what a brokenCache hands out while writes are down
+type brokenBatch struct {
+	cache.Batch
+}
+
+func (b brokenBatch) Exec() error {
+	return errors.New("connection refused")
+}
+
+func TestCacheFallback(t *testing.T) {
+	bc := &brokenCache{Cache: cache.NewLocalCache()}
+	defer bc.Close()
+	reg := NewRegistry(bc, "", "", 60)
+
+	// with nothing known and nothing static, nothing matches
+	bc.down = true
+	_, err := reg.FindBestMatch("/user/1")
+	assert.NotNil(t, err)
+	assert.NotNil(t, reg.CacheError())
+
+	bc.down = false
+	reg.Register(NewRegFromJSON(makeJson(servers[0])), true)
+	best, err := reg.FindBestMatch("/user/1")
+	assert.Nil(t, err)
+	assert.Nil(t, reg.CacheError())
+
+	// while the cache is down, we route with what we knew
+	bc.down = true
+	fallback, err := reg.FindBestMatch("/user/1")
+	assert.Nil(t, err)
+	assert.Equal(t, best.Address, fallback.Address)
+	assert.NotNil(t, reg.CacheError())
+
+	bc.down = false
+	reg.FindBestMatch("/user/1")
+	assert.Nil(t, reg.CacheError())
+}
@@ -0,0 +1,109 @@
+/**
+ * Name: rewrite.go
+ * Description: Rewriting request paths for a registration
+ * Copyright 2016 The Achievement Network. All rights reserved.
+ */
+
+package registry
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+)
+
+// A registration changes the path it's sent in one of two ways. If it has a
+// rewrite template, the path is replaced by the template, in which
+//
+//	{name}  is the pattern's named group (?P<name>...)
+//	{1}     is the pattern's first parenthesized group, and so on
+//	{path}  is the whole original path
+//
+// so the pattern /v1(?P<rest>/.*) with the rewrite /v2{rest} replaces a
+// prefix, and the pattern /api/ with the rewrite /internal{path} adds one.
+// Otherwise, if the pattern has parentheses, the path is replaced by the
+// first parenthesized group, as it always has been.
+//
+// Paths with escaped characters that matter (like %2F) are rewritten in
+// their escaped form, so that the escaping reaches the backend intact.
+
+var rewriteVarRegex = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*|[0-9]+)\}`)
+
+func (r *Registration) validateRewrite() error {
+	if r.Rewrite == "" {
+		return nil
+	}
+	if r.Rewrite[0] != '/' && r.Rewrite[0] != '{' {
+		return fmt.Errorf("The rewrite '%s' must start with / or a variable.", r.Rewrite)
+	}
+	for _, match := range rewriteVarRegex.FindAllStringSubmatch(r.Rewrite, -1) {
+		name := match[1]
+		if n, err := strconv.Atoi(name); err == nil {
+			if n < 1 || n > r.regex.NumSubexp() {
+				return fmt.Errorf("The rewrite '%s' uses {%s}, but the pattern doesn't have that many groups.", r.Rewrite, name)
+			}
+			continue
+		}
+		if name != "path" && subexpIndex(r.regex, name) < 0 {
+			return fmt.Errorf("The rewrite '%s' uses {%s}, which isn't a named group in the pattern.", r.Rewrite, name)
+		}
+	}
+	return nil
+}
+
+// rewrite changes a URL's path (and its escaped form) as the registration
+// says to.
+func (r *Registration) rewrite(u *url.URL) {
+	if u.RawPath != "" {
+		if escaped, ok := r.rewritePath(u.EscapedPath()); ok {
+			if path, err := url.PathUnescape(escaped); err == nil {
+				u.Path = path
+				u.RawPath = escaped
+				return
+			}
+		}
+	}
+	if path, ok := r.rewritePath(u.Path); ok {
+		u.Path = path
+		u.RawPath = ""
+	}
+}
+
+// rewritePath returns the rewritten path, or false if the pattern doesn't
+// match it.
+func (r *Registration) rewritePath(path string) (string, bool) {
+	matches := r.regex.FindStringSubmatch(path)
+	if matches == nil {
+		return "", false
+	}
+	if r.Rewrite != "" {
+		return rewriteVarRegex.ReplaceAllStringFunc(r.Rewrite, func(v string) string {
+			name := v[1 : len(v)-1]
+			if name == "path" {
+				return path
+			}
+			ix, err := strconv.Atoi(name)
+			if err != nil {
+				ix = subexpIndex(r.regex, name)
+			}
+			if ix < 0 || ix >= len(matches) {
+				return ""
+			}
+			return matches[ix]
+		}), true
+	}
+	if len(matches) > 1 {
+		return matches[1], true
+	}
+	return path, true
+}
+
+func subexpIndex(re *regexp.Regexp, name string) int {
+	for ix, sub := range re.SubexpNames() {
+		if ix > 0 && sub == name {
+			return ix
+		}
+	}
+	return -1
+}
@@ -0,0 +1,59 @@
+package registry
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/AchievementNetwork/vasco/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func rewriteReg(pattern, rewrite string) *Registration {
+	return &Registration{Name: pattern, Address: "http://1.1.1.9:8080", Pattern: pattern, Rewrite: rewrite, Stat: Status{Path: "/status"}}
+}
+
+func TestRewriteValidation(t *testing.T) {
+	assert.Nil(t, rewriteReg("/v1(?P<rest>/.*)", "/v2{rest}").SetDefaults())
+	assert.Nil(t, rewriteReg("/a(/.*)/b(/.*)", "{2}{1}").SetDefaults())
+	assert.Nil(t, rewriteReg("/api/", "/internal{path}").SetDefaults())
+	assert.NotNil(t, rewriteReg("/v1(?P<rest>/.*)", "/v2{other}").SetDefaults())
+	assert.NotNil(t, rewriteReg("/v1(/.*)", "/v2{2}").SetDefaults())
+	assert.NotNil(t, rewriteReg("/v1(/.*)", "v2{1}").SetDefaults())
+}
+
+func TestRewrite(t *testing.T) {
+	r := NewRegistry(cache.NewLocalCache(), "", "", 60)
+	r.Register(rewriteReg("/v1(?P<rest>/.*)", "/v2{rest}"), false)
+	r.Register(rewriteReg("/api/", "/internal{path}"), false)
+	r.Register(rewriteReg("/swap/(?P<a>[^/]+)/(?P<b>[^/]+)", "/{b}/{a}"), false)
+	r.Register(rewriteReg("/old(/.*)", ""), false)
+
+	route := func(raw string) string {
+		u, err := url.Parse(raw)
+		assert.Nil(t, err)
+		_, err = r.Route(u)
+		assert.Nil(t, err)
+		return u.String()
+	}
+	assert.Equal(t, "http://1.1.1.9:8080/v2/users/1?x=1", route("http://example.com/v1/users/1?x=1"))
+	assert.Equal(t, "http://1.1.1.9:8080/internal/api/users", route("/api/users"))
+	assert.Equal(t, "http://1.1.1.9:8080/two/one", route("/swap/one/two"))
+	assert.Equal(t, "http://1.1.1.9:8080/thing", route("/old/thing"))
+
+	// escaped slashes and the like reach the backend as they were sent
+	assert.Equal(t, "http://1.1.1.9:8080/v2/files/a%2Fb", route("/v1/files/a%2Fb"))
+	assert.Equal(t, "http://1.1.1.9:8080/files/a%2Fb%20c", route("/old/files/a%2Fb%20c"))
+	u, _ := url.Parse("/swap/a%2Fb/c")
+	r.Route(u)
+	assert.Equal(t, "/c/a/b", u.Path)
+	assert.Equal(t, "/c/a%2Fb", u.EscapedPath())
+}
+
+func TestRewriteStatic(t *testing.T) {
+	r := NewRegistry(cache.NewLocalCache(), "/static", "", 60)
+	r.Register(rewriteReg("/static(/.*)", ""), false)
+	u, _ := url.Parse("/docs/a%2Fb.html")
+	_, err := r.Route(u)
+	assert.Nil(t, err)
+	assert.Equal(t, "http://1.1.1.9:8080/docs/a%2Fb.html", u.String())
+}
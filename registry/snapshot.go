@@ -0,0 +1,175 @@
+/**
+ * Name: snapshot.go
+ * Description: Export and import of the whole registry
+ * Copyright 2016 The Achievement Network. All rights reserved.
+ */
+
+package registry
+
+import (
+	"fmt"
+	"time"
+)
+
+// SnapshotVersion is the version of the snapshot format written by Export.
+const SnapshotVersion = 1
+
+// Snapshot is a point-in-time copy of every registration in the registry,
+// suitable for backing up routing state or moving it between caches.
+type Snapshot struct {
+	Version       int             `json:"version"`
+	Created       time.Time       `json:"created"`
+	Registrations []SnapshotEntry `json:"registrations"`
+}
+
+// SnapshotEntry is a single registration in a snapshot. TTL is the number of
+// seconds the registration had left to live; 0 means it never expires.
+type SnapshotEntry struct {
+	Registration *Registration `json:"registration"`
+	TTL          int           `json:"ttl"`
+	Static       bool          `json:"static,omitempty"`
+}
+
+// Import modes
+const (
+	ImportMerge   = "merge"   // add and update registrations, leave the rest alone
+	ImportReplace = "replace" // also remove registrations that aren't in the snapshot
+)
+
+// ImportItem identifies a registration affected by an import.
+type ImportItem struct {
+	Hash    string `json:"hash"`
+	Name    string `json:"name"`
+	Address string `json:"address"`
+}
+
+// ImportFailure is a registration that an import couldn't store.
+type ImportFailure struct {
+	ImportItem
+	Error string `json:"error"`
+}
+
+// ImportResult describes what an import did (or, for a dry run, would do).
+// Registrations that couldn't be stored are listed under Failed rather than
+// Added or Updated.
+type ImportResult struct {
+	Mode      string          `json:"mode"`
+	DryRun    bool            `json:"dryRun"`
+	Added     []ImportItem    `json:"added"`
+	Updated   []ImportItem    `json:"updated"`
+	Removed   []ImportItem    `json:"removed"`
+	Failed    []ImportFailure `json:"failed"`
+	Unchanged int             `json:"unchanged"`
+}
+
+func newImportItem(reg *Registration) ImportItem {
+	return ImportItem{Hash: reg.Hash(), Name: reg.Name, Address: reg.Address}
+}
+
+// Export returns a snapshot of all registrations, including disabled ones.
+func (r *Registry) Export() *Snapshot {
+	snap := &Snapshot{
+		Version:       SnapshotVersion,
+		Created:       time.Now().UTC(),
+		Registrations: make([]SnapshotEntry, 0),
+	}
+	for _, reg := range r.getRegistrations(true) {
+		entry := SnapshotEntry{Registration: reg}
+		if ttl, err := r.c.TTL(reg.Hash()); err == nil && ttl > 0 {
+			entry.TTL = ttl
+		}
+		entry.Static = r.staticRegistration(reg.Hash()) != nil
+		snap.Registrations = append(snap.Registrations, entry)
+	}
+	return snap
+}
+
+// Import applies a snapshot to the registry. In merge mode, registrations in
+// the snapshot are added or updated; in replace mode, registrations that are
+// not in the snapshot are also removed (except for static registrations,
+// which belong to the configuration file). If dryRun is set, the result
+// describes the changes but nothing is modified. If a snapshot has more than
+// one entry for a registration, the last one wins.
+func (r *Registry) Import(snap *Snapshot, mode string, dryRun bool) (*ImportResult, error) {
+	if snap.Version != SnapshotVersion {
+		return nil, fmt.Errorf("Unsupported snapshot version %d (expected %d).", snap.Version, SnapshotVersion)
+	}
+	if mode != ImportMerge && mode != ImportReplace {
+		return nil, fmt.Errorf("Import mode must be '%s' or '%s'.", ImportMerge, ImportReplace)
+	}
+	// entries are kept in snapshot order, once each
+	incoming := make(map[string]int)
+	entries := make([]SnapshotEntry, 0, len(snap.Registrations))
+	for ix, entry := range snap.Registrations {
+		if entry.Registration == nil {
+			return nil, fmt.Errorf("Snapshot entry %d has no registration.", ix)
+		}
+		if err := entry.Registration.SetDefaults(); err != nil {
+			return nil, fmt.Errorf("Snapshot entry %d (%s): %s", ix, entry.Registration.Name, err.Error())
+		}
+		hash := entry.Registration.Hash()
+		if at, ok := incoming[hash]; ok {
+			entries[at] = entry
+			continue
+		}
+		incoming[hash] = len(entries)
+		entries = append(entries, entry)
+	}
+
+	current := make(map[string]*Registration)
+	for _, reg := range r.getRegistrations(true) {
+		current[reg.Hash()] = reg
+	}
+
+	result := &ImportResult{
+		Mode:    mode,
+		DryRun:  dryRun,
+		Added:   make([]ImportItem, 0),
+		Updated: make([]ImportItem, 0),
+		Removed: make([]ImportItem, 0),
+		Failed:  make([]ImportFailure, 0),
+	}
+	for _, entry := range entries {
+		reg := entry.Registration
+		old, ok := current[reg.Hash()]
+		if ok && old.String() == reg.String() {
+			result.Unchanged++
+			continue
+		}
+		if !dryRun {
+			if err := r.restore(entry); err != nil {
+				events.Error("restore failed", "hash", reg.Hash(), "err", err)
+				result.Failed = append(result.Failed, ImportFailure{newImportItem(reg), err.Error()})
+				continue
+			}
+		}
+		if ok {
+			result.Updated = append(result.Updated, newImportItem(reg))
+		} else {
+			result.Added = append(result.Added, newImportItem(reg))
+		}
+	}
+	if mode == ImportReplace {
+		for hash, reg := range current {
+			if _, ok := incoming[hash]; ok || r.staticRegistration(hash) != nil {
+				continue
+			}
+			result.Removed = append(result.Removed, newImportItem(reg))
+			if !dryRun {
+				r.Unregister(reg)
+			}
+		}
+	}
+
+	events.Info("imported snapshot", "mode", mode, "dryrun", dryRun, "added", len(result.Added),
+		"updated", len(result.Updated), "removed", len(result.Removed), "unchanged", result.Unchanged, "failed", len(result.Failed))
+	return result, nil
+}
+
+// restore stores a snapshot entry the same way Register does. It doesn't
+// call Register itself, because that would enable the registration and give
+// it a fresh timeout, and a restored one keeps its disabled flag and its
+// remaining lifetime.
+func (r *Registry) restore(entry SnapshotEntry) error {
+	return r.store(entry.Registration, entry.TTL)
+}
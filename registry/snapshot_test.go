@@ -0,0 +1,121 @@
+package registry
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/AchievementNetwork/vasco/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func newSnapshotRegistry(svrs ...server) *Registry {
+	reg := NewRegistry(cache.NewLocalCache(), "", "", 60)
+	for _, svr := range svrs {
+		reg.Register(NewRegFromJSON(makeJson(svr)), true)
+	}
+	return reg
+}
+
+func TestExport(t *testing.T) {
+	reg := newSnapshotRegistry(servers[0], servers[1])
+	snap := reg.Export()
+	assert.Equal(t, SnapshotVersion, snap.Version)
+	assert.Equal(t, 2, len(snap.Registrations))
+	for _, entry := range snap.Registrations {
+		assert.InDelta(t, 62, entry.TTL, 1)
+		assert.False(t, entry.Static)
+	}
+
+	// the snapshot must survive a round trip through JSON
+	data, err := json.Marshal(snap)
+	assert.Nil(t, err)
+	var snap2 Snapshot
+	assert.Nil(t, json.Unmarshal(data, &snap2))
+	assert.Equal(t, 2, len(snap2.Registrations))
+}
+
+func TestImportMerge(t *testing.T) {
+	snap := newSnapshotRegistry(servers[0], servers[1]).Export()
+	reg := newSnapshotRegistry(servers[1], servers[5])
+
+	result, err := reg.Import(snap, ImportMerge, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(result.Added))
+	assert.Equal(t, servers[0].addr, result.Added[0].Address)
+	assert.Equal(t, 0, len(result.Updated))
+	assert.Equal(t, 0, len(result.Removed))
+	assert.Equal(t, 1, result.Unchanged)
+	assert.Equal(t, 3, len(reg.getAllRegistrations()))
+
+	ttl, err := reg.c.TTL(Hash(servers[0].name, servers[0].addr))
+	assert.Nil(t, err)
+	assert.InDelta(t, 62, ttl, 1)
+}
+
+func TestImportReplaceDryRun(t *testing.T) {
+	snap := newSnapshotRegistry(servers[0], servers[1]).Export()
+	reg := newSnapshotRegistry(servers[1], servers[5])
+
+	result, err := reg.Import(snap, ImportReplace, true)
+	assert.Nil(t, err)
+	assert.True(t, result.DryRun)
+	assert.Equal(t, 1, len(result.Added))
+	assert.Equal(t, 1, len(result.Removed))
+	assert.Equal(t, servers[5].name, result.Removed[0].Name)
+	// nothing changed
+	assert.Nil(t, reg.Find(Hash(servers[0].name, servers[0].addr)))
+	assert.NotNil(t, reg.Find(Hash(servers[5].name, servers[5].addr)))
+
+	result, err = reg.Import(snap, ImportReplace, false)
+	assert.Nil(t, err)
+	assert.NotNil(t, reg.Find(Hash(servers[0].name, servers[0].addr)))
+	assert.Nil(t, reg.Find(Hash(servers[5].name, servers[5].addr)))
+}
+
+func TestImportInvalid(t *testing.T) {
+	reg := newSnapshotRegistry()
+	_, err := reg.Import(&Snapshot{Version: 99}, ImportMerge, false)
+	assert.NotNil(t, err)
+	_, err = reg.Import(&Snapshot{Version: SnapshotVersion}, "sideways", false)
+	assert.NotNil(t, err)
+	bad := &Snapshot{Version: SnapshotVersion, Registrations: []SnapshotEntry{
+		{Registration: &Registration{Name: "nopattern", Address: "http://1.1.1.1"}},
+	}}
+	_, err = reg.Import(bad, ImportMerge, false)
+	assert.NotNil(t, err)
+}
+
+func TestImportDuplicates(t *testing.T) {
+	snap := newSnapshotRegistry(servers[0]).Export()
+	// a later copy of the same registration wins, and is only counted once
+	dup := *snap.Registrations[0].Registration
+	dup.Disabled = true
+	snap.Registrations = append(snap.Registrations, SnapshotEntry{Registration: &dup, TTL: 30})
+	reg := newSnapshotRegistry()
+
+	result, err := reg.Import(snap, ImportMerge, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(result.Added))
+	assert.Equal(t, 0, len(result.Updated))
+	found := reg.Find(Hash(servers[0].name, servers[0].addr))
+	assert.NotNil(t, found)
+	assert.True(t, found.Disabled)
+}
+
+func TestImportFailure(t *testing.T) {
+	snap := newSnapshotRegistry(servers[0], servers[1]).Export()
+	bc := &brokenCache{Cache: cache.NewLocalCache()}
+	defer bc.Close()
+	reg := NewRegistry(bc, "", "", 60)
+	reg.Register(NewRegFromJSON(makeJson(servers[1])), true)
+
+	bc.writesDown = true
+	result, err := reg.Import(snap, ImportMerge, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(result.Added))
+	assert.Equal(t, 1, result.Unchanged)
+	assert.Equal(t, 1, len(result.Failed))
+	assert.Equal(t, servers[0].addr, result.Failed[0].Address)
+	assert.Equal(t, "connection refused", result.Failed[0].Error)
+	assert.Nil(t, reg.Find(Hash(servers[0].name, servers[0].addr)))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// Every proxied request has a request ID, so that it can be followed from
+// our access log to the backend's logs. If the client sent one (in the
+// header named by REQUEST_ID_HEADER, X-Request-Id by default) we keep it;
+// otherwise we make one up. Either way it's passed upstream, echoed in the
+// response and written in our logs as request_id.
+
+const defaultRequestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength keeps clients from filling our logs through the header
+const maxRequestIDLength = 128
+
+// validRequestID accepts IDs of printable ASCII without spaces or quotes,
+// which covers UUIDs and the usual trace ID formats.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for ix := 0; ix < len(id); ix++ {
+		if c := id[ix]; c <= ' ' || c > '~' || c == '"' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns 16 random bytes as hex
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestID returns the request's ID, generating one if the client didn't
+// send a usable one, and sets it on the request (so it goes upstream) and
+// on the response.
+func (v *Vasco) requestID(rw http.ResponseWriter, req *http.Request) string {
+	id := req.Header.Get(v.requestIDHeader)
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	req.Header.Set(v.requestIDHeader, id)
+	rw.Header().Set(v.requestIDHeader, id)
+	return id
+}
+
+func withRequestID(req *http.Request, id string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), requestIDKey, id))
+}
+
+func requestIDFrom(req *http.Request) string {
+	id, _ := req.Context().Value(requestIDKey).(string)
+	return id
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/AchievementNetwork/vasco/registry"
+)
+
+// Overall states reported by /status
+const (
+	StateOK       = "ok"
+	StateDegraded = "degraded"
+	StateCritical = "critical"
+)
+
+// StatusRules decide what the overall state is and which HTTP code /status
+// returns for it. They come from the environment:
+//
+//	STATUS_CRITICAL_SERVICES  space-separated name[:min] entries; if fewer than
+//	                          min (default 1) instances of a service are up,
+//	                          the state is critical
+//	STATUS_MISSING            the state when an expected service is missing:
+//	                          critical (the default), degraded or ok
+//	STATUS_DEGRADED_CODE      the HTTP code for degraded (default 200)
+//	STATUS_CRITICAL_CODE      the HTTP code for critical (default 500)
+//
+// Anything that's failing or down (or a degraded cache) makes the state at
+// least degraded.
+type StatusRules struct {
+	Critical     map[string]int
+	Missing      string
+	DegradedCode int
+	CriticalCode int
+}
+
+// StatusSummary is the body of the /status response.
+type StatusSummary struct {
+	State      string   `json:"state"`
+	Up         int      `json:"up"`
+	Failing    int      `json:"failing"`
+	Down       int      `json:"down"`
+	Missing    int      `json:"missing"`
+	Unexpected int      `json:"unexpected"`
+	Cache      string   `json:"cache"`
+	CacheError string   `json:"cacheError,omitempty"`
+	Problems   []string `json:"problems"`
+}
+
+func loadStatusRules() (*StatusRules, error) {
+	rules := &StatusRules{
+		Critical: make(map[string]int),
+		Missing:  getEnvWithDefault("STATUS_MISSING", StateCritical),
+	}
+	switch rules.Missing {
+	case StateOK, StateDegraded, StateCritical:
+	default:
+		return nil, fmt.Errorf("STATUS_MISSING must be %s, %s or %s", StateOK, StateDegraded, StateCritical)
+	}
+
+	for _, entry := range strings.Fields(getEnvWithDefault("STATUS_CRITICAL_SERVICES", "")) {
+		name, min := entry, 1
+		if ix := strings.LastIndex(entry, ":"); ix != -1 {
+			n, err := strconv.Atoi(entry[ix+1:])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("STATUS_CRITICAL_SERVICES: invalid minimum in '%s'", entry)
+			}
+			name, min = entry[:ix], n
+		}
+		rules.Critical[name] = min
+	}
+
+	var err error
+	if rules.DegradedCode, err = statusCode("STATUS_DEGRADED_CODE", http.StatusOK); err != nil {
+		return nil, err
+	}
+	if rules.CriticalCode, err = statusCode("STATUS_CRITICAL_CODE", http.StatusInternalServerError); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func statusCode(name string, def int) (int, error) {
+	code, err := strconv.Atoi(getEnvWithDefault(name, strconv.Itoa(def)))
+	if err != nil || code < 200 || code > 599 {
+		return 0, fmt.Errorf("%s must be an HTTP status code", name)
+	}
+	return code, nil
+}
+
+func worse(a, b string) string {
+	rank := map[string]int{StateOK: 0, StateDegraded: 1, StateCritical: 2}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
+
+// Summarize applies the rules to a status block.
+func (rules *StatusRules) Summarize(block registry.StatusBlock, cacheErr error) *StatusSummary {
+	sum := &StatusSummary{State: StateOK, Cache: "ok", Problems: make([]string, 0)}
+	healthy := make(map[string]int)
+	for _, item := range block {
+		name := item.Get("Name")
+		switch item.State() {
+		case "up":
+			sum.Up++
+			healthy[name]++
+		case "failing":
+			sum.Failing++
+			sum.State = worse(sum.State, StateDegraded)
+			sum.Problems = append(sum.Problems, fmt.Sprintf("%s at %s is failing", name, item.Get("Address")))
+		case "down":
+			sum.Down++
+			sum.State = worse(sum.State, StateDegraded)
+			sum.Problems = append(sum.Problems, fmt.Sprintf("%s at %s is down", name, item.Get("Address")))
+		case "missing":
+			sum.Missing++
+			sum.State = worse(sum.State, rules.Missing)
+			sum.Problems = append(sum.Problems, fmt.Sprintf("expected service %s is missing", name))
+		}
+		if unexpected, _ := item["unexpected"].(bool); unexpected {
+			sum.Unexpected++
+		}
+	}
+	names := make([]string, 0, len(rules.Critical))
+	for name := range rules.Critical {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if min := rules.Critical[name]; healthy[name] < min {
+			sum.State = StateCritical
+			sum.Problems = append(sum.Problems, fmt.Sprintf("critical service %s has %d healthy instances (needs %d)", name, healthy[name], min))
+		}
+	}
+	if cacheErr != nil {
+		sum.Cache = StateDegraded
+		sum.CacheError = cacheErr.Error()
+		sum.State = worse(sum.State, StateDegraded)
+		sum.Problems = append(sum.Problems, "the cache is unavailable: "+cacheErr.Error())
+	}
+	return sum
+}
+
+// Code returns the HTTP status code for a summary.
+func (rules *StatusRules) Code(sum *StatusSummary) int {
+	switch sum.State {
+	case StateCritical:
+		return rules.CriticalCode
+	case StateDegraded:
+		return rules.DegradedCode
+	}
+	return http.StatusOK
+}
+
+// Violation is a requirement that strict status found unmet.
+type Violation struct {
+	Service     string `json:"service"`
+	Address     string `json:"address,omitempty"`
+	Requirement string `json:"requirement"` // healthy, min, revision or deploytag
+	Expected    string `json:"expected"`
+	Actual      string `json:"actual"`
+}
+
+// StrictResult is the body of the /status/strict response.
+type StrictResult struct {
+	OK         bool        `json:"ok"`
+	Violations []Violation `json:"violations"`
+}
+
+// parseRequirements adds the requirements given as query parameters to
+// (a copy of) base. Each parameter may be repeated or comma-separated:
+//
+//	min=name:N          at least N healthy instances
+//	revision=name:rev   every healthy instance reports this revision
+//	deploytag=name:tag  every healthy instance reports this deploy tag
+func parseRequirements(qp url.Values, base map[string]*registry.Requirement) (map[string]*registry.Requirement, error) {
+	reqs := make(map[string]*registry.Requirement)
+	for name, req := range base {
+		copied := *req
+		reqs[name] = &copied
+	}
+	get := func(name string) *registry.Requirement {
+		if reqs[name] == nil {
+			reqs[name] = &registry.Requirement{Name: name}
+		}
+		return reqs[name]
+	}
+
+	for _, param := range []string{"min", "revision", "deploytag"} {
+		for _, value := range qp[param] {
+			for _, entry := range strings.Split(value, ",") {
+				// deploy tags can contain colons, so only the first one counts
+				parts := strings.SplitN(entry, ":", 2)
+				if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+					return nil, fmt.Errorf("%s must look like name:value, not '%s'", param, entry)
+				}
+				req := get(parts[0])
+				switch param {
+				case "min":
+					n, err := strconv.Atoi(parts[1])
+					if err != nil || n < 0 {
+						return nil, fmt.Errorf("invalid minimum in '%s'", entry)
+					}
+					req.Min = n
+				case "revision":
+					req.Revision = parts[1]
+				case "deploytag":
+					req.DeployTag = parts[1]
+				}
+			}
+		}
+	}
+	return reqs, nil
+}
+
+// strictViolations checks a status block against the requirements. Every
+// instance of a service must be healthy, unless the service has a minimum,
+// in which case enough of them must be.
+func strictViolations(block registry.StatusBlock, reqs map[string]*registry.Requirement) []Violation {
+	violations := make([]Violation, 0)
+	healthy := make(map[string]int)
+	for _, item := range block {
+		name := item.Get("Name")
+		req := reqs[name]
+		state := item.State()
+		if state != "up" {
+			if req == nil || req.Min == 0 {
+				violations = append(violations, Violation{
+					Service:     name,
+					Address:     item.Get("Address"),
+					Requirement: "healthy",
+					Expected:    "up",
+					Actual:      state,
+				})
+			}
+			continue
+		}
+		healthy[name]++
+		if req == nil {
+			continue
+		}
+		if req.Revision != "" && item.Get("revision") != req.Revision {
+			violations = append(violations, Violation{
+				Service:     name,
+				Address:     item.Get("Address"),
+				Requirement: "revision",
+				Expected:    req.Revision,
+				Actual:      item.Get("revision"),
+			})
+		}
+		if req.DeployTag != "" && item.Get("deploytag") != req.DeployTag {
+			violations = append(violations, Violation{
+				Service:     name,
+				Address:     item.Get("Address"),
+				Requirement: "deploytag",
+				Expected:    req.DeployTag,
+				Actual:      item.Get("deploytag"),
+			})
+		}
+	}
+
+	names := make([]string, 0, len(reqs))
+	for name := range reqs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if min := reqs[name].Min; healthy[name] < min {
+			violations = append(violations, Violation{
+				Service:     name,
+				Requirement: "min",
+				Expected:    strconv.Itoa(min),
+				Actual:      strconv.Itoa(healthy[name]),
+			})
+		}
+	}
+	return violations
+}
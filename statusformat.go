@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/AchievementNetwork/go-util/util"
+	"github.com/AchievementNetwork/vasco/registry"
+)
+
+// The status endpoints can write their status block in several formats,
+// chosen by the format query parameter or else by the Accept header:
+//
+//	json        application/json
+//	text        text/plain (the fixed-width table of /status/summary)
+//	csv         text/csv
+//	prometheus  text/plain; version=0.0.4 (what Prometheus asks for)
+//
+// and the block can be filtered with query parameters (each of which may be
+// repeated or comma-separated):
+//
+//	name=user,tags     only these services
+//	state=down         only items in these states (up, failing, down, missing)
+//	unexpected=true    only unexpected (or with false, only expected) services
+//	fields=Name,state  only these fields (json, text and csv)
+//
+// "state" is always available as a field, even though it's computed.
+
+const (
+	formatJSON       = "json"
+	formatText       = "text"
+	formatCSV        = "csv"
+	formatPrometheus = "prometheus"
+)
+
+// the fields used for text and csv when none are asked for
+var defaultStatusFields = []string{"Name", "Address", "state", "StatusCode", "deploytag", "revision", "disabled", "unexpected"}
+
+// negotiateFormat picks the format for a request, or returns an error if the
+// format parameter is invalid.
+func negotiateFormat(req *http.Request, def string) (string, error) {
+	if format := req.URL.Query().Get("format"); format != "" {
+		switch format {
+		case formatJSON, formatText, formatCSV, formatPrometheus:
+			return format, nil
+		}
+		return "", fmt.Errorf("format must be %s, %s, %s or %s", formatJSON, formatText, formatCSV, formatPrometheus)
+	}
+	for _, accept := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "application/json":
+			return formatJSON, nil
+		case "text/csv":
+			return formatCSV, nil
+		case "application/openmetrics-text":
+			return formatPrometheus, nil
+		case "text/plain":
+			if params["version"] != "" {
+				return formatPrometheus, nil
+			}
+			return formatText, nil
+		}
+	}
+	return def, nil
+}
+
+// splitParam returns all the comma-separated values of a query parameter
+func splitParam(qp url.Values, name string) []string {
+	values := make([]string, 0)
+	for _, value := range qp[name] {
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+	}
+	return values
+}
+
+// filterStatus returns the items of a block that match the query.
+func filterStatus(block registry.StatusBlock, qp url.Values) (registry.StatusBlock, error) {
+	names := make(map[string]bool)
+	for _, name := range splitParam(qp, "name") {
+		names[name] = true
+	}
+	states := make(map[string]bool)
+	for _, state := range splitParam(qp, "state") {
+		switch state {
+		case "up", "failing", "down", "missing":
+			states[state] = true
+		default:
+			return nil, fmt.Errorf("state must be up, failing, down or missing, not '%s'", state)
+		}
+	}
+	var unexpected *bool
+	if value := qp.Get("unexpected"); value != "" {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected must be true or false")
+		}
+		unexpected = &b
+	}
+
+	filtered := registry.StatusBlock{}
+	for _, item := range block {
+		if len(names) > 0 && !names[item.Get("Name")] {
+			continue
+		}
+		if len(states) > 0 && !states[item.State()] {
+			continue
+		}
+		if isUnexpected, _ := item["unexpected"].(bool); unexpected != nil && isUnexpected != *unexpected {
+			continue
+		}
+		filtered = append(filtered, item)
+	}
+	return filtered, nil
+}
+
+// selectFields returns copies of the items with only the given fields
+func selectFields(block registry.StatusBlock, fields []string) registry.StatusBlock {
+	selected := registry.StatusBlock{}
+	for _, item := range block {
+		copied := registry.StatusItem{}
+		for _, field := range fields {
+			if field == "state" {
+				copied[field] = item.State()
+			} else if value, ok := item[field]; ok {
+				copied[field] = value
+			}
+		}
+		selected = append(selected, copied)
+	}
+	return selected
+}
+
+func fieldValue(item registry.StatusItem, field string) string {
+	if field == "state" {
+		return item.State()
+	}
+	if value, ok := item[field]; ok && value != nil {
+		return fmt.Sprint(value)
+	}
+	return ""
+}
+
+// writeStatus filters a status block and writes it in the negotiated format.
+func writeStatus(rw http.ResponseWriter, req *http.Request, block registry.StatusBlock, def string) {
+	format, err := negotiateFormat(req, def)
+	if err != nil {
+		util.WriteNewWebError(rw, http.StatusBadRequest, "VAS-109", err.Error())
+		return
+	}
+	qp := req.URL.Query()
+	block, err = filterStatus(block, qp)
+	if err != nil {
+		util.WriteNewWebError(rw, http.StatusBadRequest, "VAS-109", err.Error())
+		return
+	}
+	fields := splitParam(qp, "fields")
+
+	switch format {
+	case formatJSON:
+		if len(fields) > 0 {
+			block = selectFields(block, fields)
+		}
+		util.WriteJSONPretty(rw, block)
+	case formatText:
+		rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writeStatusText(rw, block, fields)
+	case formatCSV:
+		rw.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		if len(fields) == 0 {
+			fields = defaultStatusFields
+		}
+		writeStatusCSV(rw, block, fields)
+	case formatPrometheus:
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeStatusPrometheus(rw, block)
+	}
+}
+
+const sumfmt = "%7s %6s %26s  %s\n"
+
+// writeStatusText writes the summary table; if fields are given, it writes
+// those instead, separated by tabs.
+func writeStatusText(w io.Writer, block registry.StatusBlock, fields []string) {
+	if len(fields) > 0 {
+		fmt.Fprintln(w, strings.Join(fields, "\t"))
+		for _, item := range block {
+			values := make([]string, 0, len(fields))
+			for _, field := range fields {
+				values = append(values, fieldValue(item, field))
+			}
+			fmt.Fprintln(w, strings.Join(values, "\t"))
+		}
+		return
+	}
+
+	fmt.Fprintf(w, sumfmt, "State", "Code", "Ver", "Name")
+	for _, item := range block {
+		tag := item.Get("deploytag")
+		if tag == "" {
+			tag = "unknown"
+		}
+		state := "ok"
+		if item.State() != "up" {
+			state = "NOT OK"
+		}
+		fmt.Fprintf(w, sumfmt, state, fieldValue(item, "StatusCode"), tag, item.Get("Name"))
+	}
+}
+
+func writeStatusCSV(w io.Writer, block registry.StatusBlock, fields []string) {
+	cw := csv.NewWriter(w)
+	cw.Write(fields)
+	for _, item := range block {
+		values := make([]string, 0, len(fields))
+		for _, field := range fields {
+			values = append(values, fieldValue(item, field))
+		}
+		cw.Write(values)
+	}
+	cw.Flush()
+}
+
+// prometheus label values escape backslashes, quotes and newlines
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeStatusPrometheus(w io.Writer, block registry.StatusBlock) {
+	counts := map[string]int{"up": 0, "failing": 0, "down": 0, "missing": 0}
+	fmt.Fprintln(w, "# HELP vasco_service_up Whether a service instance answered its status check with a 2xx.")
+	fmt.Fprintln(w, "# TYPE vasco_service_up gauge")
+	for _, item := range block {
+		state := item.State()
+		counts[state]++
+		up := 0
+		if state == "up" {
+			up = 1
+		}
+		fmt.Fprintf(w, "vasco_service_up{%s} %d\n", promLabels(item), up)
+	}
+	fmt.Fprintln(w, "# HELP vasco_service_status_code The HTTP code from a service instance's status check.")
+	fmt.Fprintln(w, "# TYPE vasco_service_status_code gauge")
+	for _, item := range block {
+		code, _ := item["StatusCode"].(int)
+		fmt.Fprintf(w, "vasco_service_status_code{%s} %d\n", promLabels(item), code)
+	}
+	fmt.Fprintln(w, "# HELP vasco_service_inflight The requests this server has in flight to a service instance.")
+	fmt.Fprintln(w, "# TYPE vasco_service_inflight gauge")
+	for _, item := range block {
+		if inflight, ok := item["inflight"].(int); ok {
+			fmt.Fprintf(w, "vasco_service_inflight{%s} %d\n", promLabels(item), inflight)
+		}
+	}
+	fmt.Fprintln(w, "# HELP vasco_services The number of service instances in each state.")
+	fmt.Fprintln(w, "# TYPE vasco_services gauge")
+	states := make([]string, 0, len(counts))
+	for state := range counts {
+		states = append(states, state)
+	}
+	sort.Strings(states)
+	for _, state := range states {
+		fmt.Fprintf(w, "vasco_services{state=\"%s\"} %d\n", state, counts[state])
+	}
+}
+
+func promLabels(item registry.StatusItem) string {
+	unexpected, _ := item["unexpected"].(bool)
+	return fmt.Sprintf(`name="%s",address="%s",deploytag="%s",unexpected="%t"`,
+		promEscaper.Replace(item.Get("Name")),
+		promEscaper.Replace(item.Get("Address")),
+		promEscaper.Replace(item.Get("deploytag")),
+		unexpected)
+}
@@ -0,0 +1,235 @@
+/**
+ * Name: export.go
+ * Description: Span exporters: OTLP/HTTP (JSON), stdout and none
+ * Copyright 2016 The Achievement Network. All rights reserved.
+ */
+
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Exporter sends finished spans somewhere.
+type Exporter interface {
+	Export(service string, spans []*Span) error
+}
+
+// The exporter is configured with the standard OpenTelemetry variables:
+//
+//	OTEL_TRACES_EXPORTER         none (the default), otlp, or stdout
+//	OTEL_EXPORTER_OTLP_ENDPOINT  the collector, default http://localhost:4318
+//	OTEL_EXPORTER_OTLP_HEADERS   extra headers, as key=value,key=value
+//	OTEL_SERVICE_NAME            the service.name resource attribute
+const (
+	ExporterNone   = "none"
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+
+	DefaultOTLPEndpoint = "http://localhost:4318"
+)
+
+// FromEnv returns a tracer configured by the environment.
+func FromEnv(service string) (*Tracer, error) {
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		service = name
+	}
+	switch kind := os.Getenv("OTEL_TRACES_EXPORTER"); kind {
+	case "", ExporterNone:
+		return NewTracer(service, nil), nil
+	case ExporterStdout, "console":
+		return NewTracer(service, &StdoutExporter{W: os.Stdout}), nil
+	case ExporterOTLP:
+		endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if endpoint == "" {
+			endpoint = DefaultOTLPEndpoint
+		}
+		exp := NewOTLPExporter(endpoint)
+		for _, header := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+			if header = strings.TrimSpace(header); header == "" {
+				continue
+			}
+			kv := strings.SplitN(header, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return nil, fmt.Errorf("invalid OTLP header '%s' (should be key=value)", header)
+			}
+			exp.Headers.Set(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+		}
+		return NewTracer(service, exp), nil
+	default:
+		return nil, fmt.Errorf("unknown traces exporter '%s' (should be %s, %s or %s)", kind, ExporterNone, ExporterOTLP, ExporterStdout)
+	}
+}
+
+// OTLPExporter posts spans to an OpenTelemetry collector over OTLP/HTTP,
+// JSON encoded.
+type OTLPExporter struct {
+	URL     string
+	Headers http.Header
+	Client  *http.Client
+}
+
+func NewOTLPExporter(endpoint string) *OTLPExporter {
+	return &OTLPExporter{
+		URL:     strings.TrimRight(endpoint, "/") + "/v1/traces",
+		Headers: make(http.Header),
+		Client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (e *OTLPExporter) Export(service string, spans []*Span) error {
+	data, err := json.Marshal(newOTLPRequest(service, spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", e.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	for k, v := range e.Headers {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("OTLP export to %s returned %d", e.URL, resp.StatusCode)
+	}
+	return nil
+}
+
+// StdoutExporter writes each span as a line of JSON; it's handy for
+// debugging, and tests point W at a buffer.
+type StdoutExporter struct {
+	W io.Writer
+}
+
+func (e *StdoutExporter) Export(service string, spans []*Span) error {
+	enc := json.NewEncoder(e.W)
+	for _, span := range spans {
+		if err := enc.Encode(newOTLPSpan(span)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The OTLP/JSON encoding: IDs are hex, 64-bit numbers are strings.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    StatusCode `json:"code,omitempty"`
+	Message string     `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+func newOTLPRequest(service string, spans []*Span) otlpRequest {
+	converted := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		converted = append(converted, newOTLPSpan(span))
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: newOTLPAttributes([]interface{}{"service.name", service})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "github.com/AchievementNetwork/vasco/tracing"}, Spans: converted}},
+	}}}
+}
+
+func newOTLPSpan(s *Span) otlpSpan {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	span := otlpSpan{
+		TraceID:           s.sc.TraceID.String(),
+		SpanID:            s.sc.SpanID.String(),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes:        newOTLPAttributes(s.attributes),
+		Status:            otlpStatus{Code: s.status, Message: s.statusMessage},
+	}
+	if s.parent.IsValid() {
+		span.ParentSpanID = s.parent.String()
+	}
+	return span
+}
+
+func newOTLPAttributes(kv []interface{}) []otlpAttribute {
+	attrs := make([]otlpAttribute, 0, len(kv)/2)
+	for ix := 0; ix+1 < len(kv); ix += 2 {
+		var value otlpValue
+		switch v := kv[ix+1].(type) {
+		case bool:
+			value.BoolValue = &v
+		case int:
+			s := strconv.Itoa(v)
+			value.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(v, 10)
+			value.IntValue = &s
+		case float64:
+			value.DoubleValue = &v
+		default:
+			s := fmt.Sprint(v)
+			value.StringValue = &s
+		}
+		attrs = append(attrs, otlpAttribute{Key: fmt.Sprint(kv[ix]), Value: value})
+	}
+	return attrs
+}
@@ -0,0 +1,302 @@
+/**
+ * Name: trace.go
+ * Description: Tracing spans with W3C trace context propagation
+ * Copyright 2016 The Achievement Network. All rights reserved.
+ */
+
+// Package tracing records OpenTelemetry-style spans and exports them over
+// OTLP/HTTP (JSON), to stdout, or nowhere. It propagates trace context with
+// the W3C traceparent header, so our spans join traces that started in a
+// client and continue into the backends we proxy to.
+//
+//	ctx, span := tracer.Start(tracing.Extract(req.Context(), req.Header), "proxy", tracing.KindServer)
+//	defer span.End()
+//	span.SetAttributes("http.method", req.Method)
+//
+// It only implements the parts of OpenTelemetry that vasco needs, which
+// keeps the SDK and its dependencies out of our vendor tree.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+func (t TraceID) IsValid() bool { return t != TraceID{} }
+func (s SpanID) IsValid() bool  { return s != SpanID{} }
+
+// SpanContext is what's propagated from one process to the next
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+const TraceparentHeader = "Traceparent"
+
+// Traceparent formats the span context as a W3C traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// ParseTraceparent parses a W3C traceparent header value.
+func ParseTraceparent(value string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, fmt.Errorf("invalid traceparent '%s'", value)
+	}
+	// version 00 has exactly four parts; later versions may add more
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, fmt.Errorf("invalid traceparent '%s'", value)
+	}
+	if err := decodeHex(sc.TraceID[:], parts[1]); err != nil {
+		return sc, fmt.Errorf("invalid trace id in traceparent '%s'", value)
+	}
+	if err := decodeHex(sc.SpanID[:], parts[2]); err != nil {
+		return sc, fmt.Errorf("invalid span id in traceparent '%s'", value)
+	}
+	var flags [1]byte
+	if err := decodeHex(flags[:], parts[3]); err != nil {
+		return sc, fmt.Errorf("invalid flags in traceparent '%s'", value)
+	}
+	sc.Sampled = flags[0]&1 == 1
+	if !sc.IsValid() {
+		return sc, fmt.Errorf("invalid traceparent '%s'", value)
+	}
+	return sc, nil
+}
+
+// decodeHex insists on lowercase hex of exactly the right length
+func decodeHex(dst []byte, s string) error {
+	if len(s) != hex.EncodedLen(len(dst)) || strings.ToLower(s) != s {
+		return fmt.Errorf("bad length or case")
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err
+}
+
+// Extract returns a context carrying the span context from a traceparent
+// header, if there's a valid one; spans started from it are its children.
+func Extract(ctx context.Context, h http.Header) context.Context {
+	sc, err := ParseTraceparent(h.Get(TraceparentHeader))
+	if err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteKey, sc)
+}
+
+// Inject sets the traceparent header for the span in the context.
+func Inject(ctx context.Context, h http.Header) {
+	if span := SpanFromContext(ctx); span != nil {
+		h.Set(TraceparentHeader, span.SpanContext().Traceparent())
+	}
+}
+
+type contextKey int
+
+const (
+	spanKey contextKey = iota
+	remoteKey
+)
+
+// SpanFromContext returns the current span, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey).(*Span)
+	return span
+}
+
+// SpanKind is the OTLP span kind
+type SpanKind int
+
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+// StatusCode is the OTLP status code
+type StatusCode int
+
+const (
+	StatusUnset StatusCode = 0
+	StatusOK    StatusCode = 1
+	StatusError StatusCode = 2
+)
+
+// Span is one timed operation
+type Span struct {
+	mutex         sync.Mutex
+	tracer        *Tracer
+	sc            SpanContext
+	parent        SpanID
+	name          string
+	kind          SpanKind
+	start         time.Time
+	end           time.Time
+	attributes    []interface{}
+	status        StatusCode
+	statusMessage string
+	ended         bool
+}
+
+func (s *Span) SpanContext() SpanContext {
+	return s.sc
+}
+
+// SetAttributes adds attributes to the span, as alternating keys and values.
+func (s *Span) SetAttributes(kv ...interface{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.attributes = append(s.attributes, kv...)
+}
+
+// SetStatus sets the span's status.
+func (s *Span) SetStatus(code StatusCode, message string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.status = code
+	s.statusMessage = message
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(err error) {
+	s.SetStatus(StatusError, err.Error())
+}
+
+// End finishes the span and hands it to the tracer to export. Only the
+// first call does anything.
+func (s *Span) End() {
+	s.mutex.Lock()
+	if s.ended {
+		s.mutex.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mutex.Unlock()
+	if s.sc.Sampled {
+		s.tracer.record(s)
+	}
+}
+
+// Tracer starts spans and batches finished ones for its exporter.
+type Tracer struct {
+	service  string
+	exporter Exporter
+	mutex    sync.Mutex
+	pending  []*Span
+	done     chan struct{}
+}
+
+// batching limits
+const (
+	maxPending    = 2048
+	batchSize     = 256
+	batchInterval = 5 * time.Second
+)
+
+// NewTracer returns a tracer that exports to exp in the background; if exp
+// is nil, spans are still created (and propagated) but never exported.
+func NewTracer(service string, exp Exporter) *Tracer {
+	t := &Tracer{service: service, exporter: exp, done: make(chan struct{})}
+	if exp != nil {
+		go t.loop()
+	}
+	return t
+}
+
+// Start starts a span that's a child of the span (local or remote) in ctx,
+// and returns a context carrying it.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	span := &Span{tracer: t, name: name, kind: kind, start: time.Now(), sc: SpanContext{Sampled: true}}
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.sc.TraceID = parent.sc.TraceID
+		span.sc.Sampled = parent.sc.Sampled
+		span.parent = parent.sc.SpanID
+	} else if remote, ok := ctx.Value(remoteKey).(SpanContext); ok {
+		span.sc.TraceID = remote.TraceID
+		span.sc.Sampled = remote.Sampled
+		span.parent = remote.SpanID
+	} else {
+		rand.Read(span.sc.TraceID[:])
+	}
+	rand.Read(span.sc.SpanID[:])
+	return context.WithValue(ctx, spanKey, span), span
+}
+
+func (t *Tracer) record(s *Span) {
+	if t.exporter == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	// if the exporter can't keep up we drop spans rather than memory
+	if len(t.pending) < maxPending {
+		t.pending = append(t.pending, s)
+	}
+}
+
+func (t *Tracer) loop() {
+	ticker := time.NewTicker(batchInterval / 10)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+			t.mutex.Lock()
+			n := len(t.pending)
+			t.mutex.Unlock()
+			if n >= batchSize || (n > 0 && time.Since(last) >= batchInterval) {
+				t.Flush()
+				last = time.Now()
+			}
+		}
+	}
+}
+
+// Flush exports everything that's finished.
+func (t *Tracer) Flush() error {
+	if t.exporter == nil {
+		return nil
+	}
+	t.mutex.Lock()
+	spans := t.pending
+	t.pending = nil
+	t.mutex.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+	return t.exporter.Export(t.service, spans)
+}
+
+// Shutdown stops the background export and flushes what's left.
+func (t *Tracer) Shutdown() error {
+	if t.exporter == nil {
+		return nil
+	}
+	close(t.done)
+	return t.Flush()
+}
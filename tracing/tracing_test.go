@@ -0,0 +1,145 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestTraceparent(t *testing.T) {
+	sc, err := ParseTraceparent(parent)
+	assert.Nil(t, err)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", sc.SpanID.String())
+	assert.True(t, sc.Sampled)
+	assert.Equal(t, parent, sc.Traceparent())
+
+	sc, err = ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	assert.Nil(t, err)
+	assert.False(t, sc.Sampled)
+
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		_, err := ParseTraceparent(bad)
+		assert.NotNil(t, err, bad)
+	}
+	// later versions may have more fields
+	_, err = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra")
+	assert.Nil(t, err)
+}
+
+func TestSpans(t *testing.T) {
+	var buf bytes.Buffer
+	tracer := NewTracer("test", &StdoutExporter{W: &buf})
+	defer tracer.Shutdown()
+
+	h := http.Header{}
+	h.Set(TraceparentHeader, parent)
+	ctx, server := tracer.Start(Extract(context.Background(), h), "server", KindServer)
+	_, child := tracer.Start(ctx, "child", KindInternal)
+	child.SetAttributes("count", 3, "ok", true, "name", "x")
+	child.SetError(errors.New("boom"))
+	child.End()
+	child.End()
+	server.End()
+
+	// children share the trace, and hang off their parent
+	assert.Equal(t, server.SpanContext().TraceID, child.SpanContext().TraceID)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", server.SpanContext().TraceID.String())
+	assert.NotEqual(t, server.SpanContext().SpanID, child.SpanContext().SpanID)
+
+	assert.Nil(t, tracer.Flush())
+	dec := json.NewDecoder(&buf)
+	var first, second map[string]interface{}
+	assert.Nil(t, dec.Decode(&first))
+	assert.Nil(t, dec.Decode(&second))
+	assert.False(t, dec.More())
+	assert.Equal(t, "child", first["name"])
+	assert.Equal(t, server.SpanContext().SpanID.String(), first["parentSpanId"])
+	assert.Equal(t, map[string]interface{}{"code": float64(2), "message": "boom"}, first["status"])
+	assert.Len(t, first["attributes"], 3)
+	assert.Equal(t, "server", second["name"])
+	assert.Equal(t, "00f067aa0ba902b7", second["parentSpanId"])
+	assert.Equal(t, float64(KindServer), second["kind"])
+
+	// an unsampled parent isn't exported, but is still propagated
+	h.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	ctx, unsampled := tracer.Start(Extract(context.Background(), h), "server", KindServer)
+	unsampled.End()
+	assert.Nil(t, tracer.Flush())
+	assert.Equal(t, 0, buf.Len())
+	out := http.Header{}
+	Inject(ctx, out)
+	assert.Contains(t, out.Get(TraceparentHeader), "-00")
+}
+
+func TestTransportAndOTLP(t *testing.T) {
+	var received http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer backend.Close()
+
+	var payload map[string]interface{}
+	var auth string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		auth = r.Header.Get("Authorization")
+		data, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(data, &payload)
+	}))
+	defer collector.Close()
+
+	os.Setenv("OTEL_TRACES_EXPORTER", "otlp")
+	os.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL)
+	os.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "Authorization=Bearer xyz")
+	defer os.Unsetenv("OTEL_TRACES_EXPORTER")
+	defer os.Unsetenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	defer os.Unsetenv("OTEL_EXPORTER_OTLP_HEADERS")
+	tracer, err := FromEnv("test")
+	assert.Nil(t, err)
+	defer tracer.Shutdown()
+
+	client := &http.Client{Transport: &Transport{Tracer: tracer, Name: "backend"}}
+	req, _ := http.NewRequest("GET", backend.URL+"/x", nil)
+	resp, err := client.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.NotEqual(t, "", received.Get(TraceparentHeader))
+	assert.Equal(t, "", req.Header.Get(TraceparentHeader))
+
+	assert.Nil(t, tracer.Flush())
+	assert.Equal(t, "Bearer xyz", auth)
+	rs := payload["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	resource := rs["resource"].(map[string]interface{})["attributes"].([]interface{})[0]
+	assert.Equal(t, map[string]interface{}{"key": "service.name", "value": map[string]interface{}{"stringValue": "test"}}, resource)
+	span := rs["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "backend", span["name"])
+	assert.Equal(t, float64(KindClient), span["kind"])
+	sc, err := ParseTraceparent(received.Get(TraceparentHeader))
+	assert.Nil(t, err)
+	assert.Equal(t, sc.SpanID.String(), span["spanId"])
+	assert.Equal(t, float64(StatusError), span["status"].(map[string]interface{})["code"])
+
+	os.Setenv("OTEL_TRACES_EXPORTER", "carrier-pigeon")
+	_, err = FromEnv("test")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,53 @@
+/**
+ * Name: transport.go
+ * Description: Client spans for outgoing HTTP requests
+ * Copyright 2016 The Achievement Network. All rights reserved.
+ */
+
+package tracing
+
+import (
+	"net/http"
+)
+
+// Transport wraps a RoundTripper so that each request gets a client span
+// (a child of the span in the request's context) and carries it to the
+// server in the traceparent header.
+type Transport struct {
+	Base   http.RoundTripper
+	Tracer *Tracer
+	Name   string
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	name := t.Name
+	if name == "" {
+		name = "HTTP " + req.Method
+	}
+	ctx, span := t.Tracer.Start(req.Context(), name, KindClient)
+	span.SetAttributes("http.method", req.Method, "http.url", req.URL.String(), "net.peer.name", req.URL.Host)
+
+	// a RoundTripper mustn't change the request it's given
+	out := req.WithContext(ctx)
+	out.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		out.Header[k] = v
+	}
+	Inject(ctx, out.Header)
+
+	resp, err := base.RoundTrip(out)
+	if err != nil {
+		span.SetError(err)
+	} else {
+		span.SetAttributes("http.status_code", resp.StatusCode)
+		if resp.StatusCode >= 500 {
+			span.SetStatus(StatusError, resp.Status)
+		}
+	}
+	span.End()
+	return resp, err
+}
@@ -9,40 +9,94 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/AchievementNetwork/go-util/boneful"
+	"github.com/AchievementNetwork/go-util/util"
 	"github.com/AchievementNetwork/vasco/cache"
 	"github.com/AchievementNetwork/vasco/registry"
+	"github.com/AchievementNetwork/vasco/tracing"
 	"github.com/go-zoo/bone"
 )
 
 // Vasco is a struct that manages the collection of data
 type Vasco struct {
-	cache          cache.Cache
-	registry       *registry.Registry
-	lastStatus     registry.StatusBlock
-	statusTimer    *LoopTimer
-	allowedMethods []string
-	allowedHeaders []string
-	allowedOrigins []string
+	cache           cache.Cache
+	registry        *registry.Registry
+	lastStatus      registry.StatusBlock
+	statusRules     *StatusRules
+	requirements    map[string]*registry.Requirement
+	alerter         *Alerter
+	alertSink       *alertSink
+	reqMutex        sync.RWMutex
+	timerMutex      sync.Mutex
+	statusTimer     *LoopTimer // guarded by timerMutex, and nil until we've started up
+	requestIDHeader string     // carries request IDs through the proxy
+	tracer          *tracing.Tracer
+	forwarding      *forwardPolicy
+	limiter         cache.RateLimiter
+	allowedMethods  []string
+	allowedHeaders  []string
+	allowedOrigins  []string
 }
 
 func NewVasco(c cache.Cache, staticPath string, expected string) *Vasco {
 	stimeout := getEnvWithDefault("DISCOVERY_EXPIRATION", "3600")
 	timeout, _ := strconv.Atoi(stimeout)
 	r := registry.NewRegistry(c, staticPath, expected, timeout)
-	return &Vasco{
-		cache:    c,
-		registry: r,
+	if limit, err := strconv.Atoi(getEnvWithDefault("STATUS_HISTORY", "")); err == nil && limit > 0 {
+		r.HistoryLimit = limit
+	}
+	r.MinPort, _ = strconv.Atoi(getEnvWithDefault("MINPORT", strconv.Itoa(registry.DefaultMinPort)))
+	r.MaxPort, _ = strconv.Atoi(getEnvWithDefault("MAXPORT", strconv.Itoa(registry.DefaultMaxPort)))
+	if r.MinPort <= 0 || r.MaxPort < r.MinPort {
+		fatal("invalid port range", "min", r.MinPort, "max", r.MaxPort)
+	}
+	rules, err := loadStatusRules()
+	if err != nil {
+		fatal("invalid status rules", "err", err)
+	}
+	alerter, err := loadAlerter()
+	if err != nil {
+		fatal("invalid alert configuration", "err", err)
+	}
+	tracer, err := tracing.FromEnv("vasco")
+	if err != nil {
+		fatal("invalid tracing configuration", "err", err)
+	}
+	forwarding, err := loadForwardPolicy()
+	if err != nil {
+		fatal("invalid forwarding configuration", "err", err)
+	}
+	requestIDHeader := http.CanonicalHeaderKey(getEnvWithDefault("REQUEST_ID_HEADER", defaultRequestIDHeader))
+	// rate limits are shared if the cache can share them
+	limiter, ok := c.(cache.RateLimiter)
+	if !ok {
+		limiter = cache.NewMemoryRateLimiter()
+	}
+	v := &Vasco{
+		cache:           c,
+		registry:        r,
+		statusRules:     rules,
+		alerter:         alerter,
+		alertSink:       &alertSink{},
+		requestIDHeader: requestIDHeader,
+		tracer:          tracer,
+		forwarding:      forwarding,
+		limiter:         limiter,
 		// if these ever need to vary based on the deploy it would be better if
 		// they came from the environment. But right now it doesn't seem necessary.
 		allowedOrigins: []string{"*"},
@@ -58,15 +112,23 @@ func NewVasco(c cache.Cache, staticPath string, expected string) *Vasco {
 			"Content-Range",
 			"Content-Disposition",
 			"Content-Description",
+			requestIDHeader,
 		},
 	}
+	// a registration going away changes the status picture
+	r.OnExpire = func(reg *registry.Registration) {
+		v.refreshStatusSoon()
+	}
+	return v
 }
 
 // logit is middleware to log requests
 func logit(handler http.HandlerFunc) http.HandlerFunc {
 	return func(rw http.ResponseWriter, req *http.Request) {
-		log.Printf("%s %s\n", req.Method, req.URL)
-		handler(rw, req)
+		start := time.Now()
+		rec := newResponseRecorder(rw)
+		handler(rec, req)
+		logAccess("registry", req, rec, start, nil)
 	}
 }
 
@@ -79,6 +141,10 @@ func logit(handler http.HandlerFunc) http.HandlerFunc {
 //         repeating this request may return a different result.)
 //     DELETE /register/myAddr
 //         Removes the IP and all its children
+//     GET /registry/export
+//         Returns a snapshot of all registrations
+//     POST /registry/import
+//         Applies a snapshot (merge or replace, optionally as a dry run)
 
 func (v *Vasco) CreateRegistryService() *bone.Mux {
 	svc := new(boneful.Service).
@@ -143,6 +209,13 @@ func (v *Vasco) CreateRegistryService() *bone.Mux {
 
 	    If a forwarded request times out, the server is immediately marked with a status of "down".
 
+		### rewrite
+
+		An optional template for the path the server is sent, instead of the parenthesized part of the pattern. {name} is replaced with the pattern's named group (?P<name>...), {1} with its first group (and so on), and {path} with the whole original path.
+		Example:
+		{ "pattern": "/v1(?P<rest>/.*)", "rewrite": "/v2{rest}" } -- server/v1/foo redirects to myAddr/v2/foo
+		{ "pattern": "/api/", "rewrite": "/internal{path}" } -- server/api/foo redirects to myAddr/internal/api/foo
+
 		### weight
 
 	    When multiple possible paths are matched (usually because there are multiple machines handling a given path), Vasco chooses between them using a weighted random selection.
@@ -158,6 +231,24 @@ func (v *Vasco) CreateRegistryService() *bone.Mux {
         The path to be used to check status of the server (this path is concatenated with the address field to build a status query). Status is checked every N seconds, where N is defined in the Vasco configuration. A 200 reply means the server is up and functioning. A payload may be delivered with more detailed status information. It is returned as part of the discover server's status block (if it successfully parses as a JSON object, it is delivered that way, otherwise as a string). This must be specified.
 
 
+		### headers
+
+		Optional rules for changing headers on the way to the server ("request") and on the way back ("response"). Each has "remove" (a list of names), "set" and "add" (objects of name: value), applied in that order. Values may include {name}, {hash}, {address}, {client_ip}, {request_id}, {host} and {path}, which are replaced with the registration's and the request's values.
+		Example:
+		{ "headers": { "request": { "set": { "X-Service-Name": "{name}" } }, "response": { "remove": ["Server"], "set": { "X-Frame-Options": "DENY" } } } }
+
+		### rateLimit
+
+		Optional. Limits requests to the registration with a token bucket that holds "burst" requests (by default the rate, rounded up) and refills at "rate" requests a second. "key" says who gets a bucket: "ip" (each client address, the default), "header:Name" (each value of that header, like an API key; clients that don't send it are limited by address) or "global" (everyone shares one). Registrations with the same name share their buckets, and so do Vasco servers that share a Redis cache. Requests over the limit get a 429 with a Retry-After header straight away, without taking or waiting for a maxConcurrent slot.
+		Example:
+		{ "rateLimit": { "rate": 10, "burst": 20, "key": "header:X-Api-Key" } }
+
+		### maxConcurrent
+
+		Optional. The most requests each Vasco server will have in flight to the registration at once. When it's full, a request goes to another registration with the same name in the same match group (those that tie for the longest match) that has room; registrations with other names are left alone, since they may have rate limits of their own. If none does, the request waits up to "queueTimeout" milliseconds (by default it doesn't wait) for a request to finish, and then gets a 503. The status reports each registration's "inflight" count.
+		Example:
+		{ "maxConcurrent": 20, "queueTimeout": 250 }
+
 		### Example
 
 	    Simplest usage:
@@ -166,6 +257,17 @@ func (v *Vasco) CreateRegistryService() *bone.Mux {
 
 	        That will forward everything to discoveryserver/foo to my.address/foo
 
+		## Static configuration
+
+		Registrations that should always exist can be listed in a YAML or JSON file
+		named by the -config flag (or the VASCO_CONFIG environment variable). Each
+		entry has the same fields as a registration, under a top-level "registrations" key.
+		These registrations never expire. A top-level "requirements" key lists the
+		requirements (name, min, revision and deploytag) that /status/strict checks
+		services against. The file is validated at startup (Vasco won't
+		start if it is invalid) and reloaded on SIGHUP, when new or changed entries are
+		registered and entries that have been removed are unregistered.
+
 
 		`)
 
@@ -190,12 +292,70 @@ func (v *Vasco) CreateRegistryService() *bone.Mux {
 		Returns(http.StatusNotFound, "Key not found", nil))
 
 	svc.Route(svc.GET("/register/test").To(logit(v.testRegistration)).
-		Doc("Returns the result of the load balancer (where the LB would resolve to this time -- repeating this request may return a different result.)").
+		Doc("Returns the result of the load balancer (where the LB would resolve to this time -- repeating this request may return a different result.) The upstream field is the URL the request would be forwarded to, after any rewriting. With explain=true, it instead returns every registration that was considered: whether it matched and how long the match was, whether it's disabled or expired, whether it was in the tie group of longest matches and its chance of being chosen from that group, then what happened with the static path fallback and the registration and upstream URL that were chosen this time.").
 		Operation("testRegistration").
 		Param(boneful.QueryParameter("url", "the url to test").DataType("string").Required(true)).
+		Param(boneful.QueryParameter("explain", "true to explain how the url was routed").DataType("string").Required(false)).
 		Produces("application/json").
+		Returns(http.StatusBadRequest, "The url is not valid", nil).
 		Returns(http.StatusNotFound, "No matching url found", nil).
-		Writes(registry.Registration{}))
+		Writes(routeTest{Registration: &registry.Registration{}}))
+
+	svc.Route(svc.POST("/ports").To(logit(v.leasePort)).
+		Doc("Leases a free port between MINPORT and MAXPORT to a service, so that services sharing a host can each find a port to listen on before they register. Leases expire and are refreshed just like registrations.").
+		Operation("leasePort").
+		Param(boneful.QueryParameter("name", "the name of the service that wants the port").DataType("string").Required(true)).
+		Produces("application/json").
+		Writes(registry.PortLease{Port: 8123, Name: "user", Created: time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)}).
+		Returns(http.StatusBadRequest, "The name was missing", nil).
+		Returns(http.StatusServiceUnavailable, "No ports are available", nil))
+
+	svc.Route(svc.GET("/ports/:port").To(logit(v.findPort)).
+		Doc("Returns the lease on a port.").
+		Operation("findPort").
+		Param(boneful.PathParameter("port", "the leased port").DataType("int")).
+		Produces("application/json").
+		Writes(registry.PortLease{Port: 8123, Name: "user", Created: time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)}).
+		Returns(http.StatusNotFound, "That port is not leased", nil))
+
+	svc.Route(svc.PUT("/ports/:port").To(logit(v.refreshPort)).
+		Doc("Refreshes the lease on a port. Only the service that holds the lease can refresh it.").
+		Operation("refreshPort").
+		Param(boneful.PathParameter("port", "the leased port").DataType("int")).
+		Param(boneful.QueryParameter("name", "the name of the service that holds the lease").DataType("string").Required(true)).
+		Returns(http.StatusBadRequest, "The name was missing", nil).
+		Returns(http.StatusNotFound, "That port is not leased", nil).
+		Returns(http.StatusConflict, "That port is leased to another service", nil))
+
+	svc.Route(svc.DELETE("/ports/:port").To(logit(v.releasePort)).
+		Doc("Gives a leased port back. Only the service that holds the lease can release it.").
+		Operation("releasePort").
+		Param(boneful.PathParameter("port", "the leased port").DataType("int")).
+		Param(boneful.QueryParameter("name", "the name of the service that holds the lease").DataType("string").Required(true)).
+		Returns(http.StatusBadRequest, "The name was missing", nil).
+		Returns(http.StatusNotFound, "That port is not leased", nil).
+		Returns(http.StatusConflict, "That port is leased to another service", nil))
+
+	svc.Route(svc.GET("/registry/export").To(logit(v.exportRegistry)).
+		Doc("Returns a versioned snapshot of every registration, including its remaining time to live in seconds (0 if it never expires).").
+		Operation("exportRegistry").
+		Produces("application/json").
+		Writes(registry.Snapshot{}))
+
+	svc.Route(svc.POST("/registry/import").To(logit(v.importRegistry)).
+		Doc("Applies a snapshot produced by /registry/export and returns the changes that were made. "+
+			"In merge mode (the default), registrations in the snapshot are added or updated and everything else is left alone. "+
+			"In replace mode, registrations that are not in the snapshot are also removed, except for static registrations. "+
+			"With dryrun, nothing is changed but the response describes what would have happened.").
+		Operation("importRegistry").
+		Param(boneful.QueryParameter("mode", "'merge' or 'replace'").DataType("string").Required(false)).
+		Param(boneful.QueryParameter("dryrun", "if non-empty, report the changes without making them").DataType("string").Required(false)).
+		Consumes("application/json").
+		Produces("application/json").
+		Reads(registry.Snapshot{}).
+		Returns(http.StatusBadRequest, "The snapshot was invalid", nil).
+		Returns(http.StatusInternalServerError, "Some registrations couldn't be stored; the result lists them as failed", nil).
+		Writes(registry.ImportResult{}))
 
 	return svc.Mux()
 
@@ -211,19 +371,47 @@ func (v *Vasco) CreateStatusService() *bone.Mux {
 		Operation("statusOptions"))
 
 	svc.Route(svc.GET("/status").To(v.statusGeneral).
-		Doc("Generates aggregated status information.").
+		Doc("Summarizes the most recent status as counts of services that are up, failing, down, missing or unexpected, plus an overall state (ok, degraded or critical). Anything failing or down, or a degraded cache, makes the state degraded; a missing expected service (STATUS_MISSING) or a critical service with too few healthy instances (STATUS_CRITICAL_SERVICES, as name:min) makes it critical. STATUS_DEGRADED_CODE and STATUS_CRITICAL_CODE set the response code for those states.").
 		Returns(http.StatusInternalServerError, "There is a major service problem.", nil).
-		Operation("statusGeneral"))
+		Operation("statusGeneral").
+		Produces("application/json").
+		Writes(StatusSummary{
+			State:    StateDegraded,
+			Up:       4,
+			Down:     1,
+			Cache:    "ok",
+			Problems: []string{"tags at http://10.0.0.5:8081 is down"},
+		}))
 
 	svc.Route(svc.GET("/status/strict").To(v.statusStrict).
-		Doc("Returns 200 only if all expected servers are up.").
-		Returns(http.StatusInternalServerError, "At least one server is down.", nil).
-		Operation("statusStrict"))
+		Doc("Returns 200 only if every requirement is met, and otherwise lists the violated requirements. Without requirements, every instance of every expected or registered service must be up. Requirements come from the configuration file and from the query parameters, which take precedence; a service with a minimum only needs that many healthy instances.").
+		Param(boneful.QueryParameter("min", "name:N -- at least N healthy instances of the service (repeatable, or comma-separated)").DataType("string").Required(false)).
+		Param(boneful.QueryParameter("revision", "name:revision -- every healthy instance must report this revision").DataType("string").Required(false)).
+		Param(boneful.QueryParameter("deploytag", "name:tag -- every healthy instance must report this deploy tag").DataType("string").Required(false)).
+		Returns(http.StatusBadRequest, "A requirement in the query was invalid.", nil).
+		Returns(http.StatusInternalServerError, "At least one requirement was not met.", nil).
+		Operation("statusStrict").
+		Produces("application/json").
+		Writes(StrictResult{
+			OK: false,
+			Violations: []Violation{{
+				Service:     "user",
+				Requirement: "min",
+				Expected:    "2",
+				Actual:      "1",
+			}},
+		}))
 
 	svc.Route(svc.GET("/status/detail").To(v.statusDetail).
-		Doc("Generates detailed status information.").
+		Doc("Generates detailed status information, as JSON unless another format is asked for. Each registration's inflight is the number of requests this server has in flight to it right now.").
 		Param(boneful.QueryParameter("wait", "if non-empty, wait for current status from all services before returning result.").DataType("string").Required(false)).
-		Produces("application/json").
+		Param(boneful.QueryParameter("format", "json, text, csv or prometheus; if it's missing, the Accept header decides").DataType("string").Required(false)).
+		Param(boneful.QueryParameter("name", "only these services (comma-separated)").DataType("string").Required(false)).
+		Param(boneful.QueryParameter("state", "only items in these states: up, failing, down or missing (comma-separated)").DataType("string").Required(false)).
+		Param(boneful.QueryParameter("unexpected", "true for only unexpected services, false for only expected ones").DataType("string").Required(false)).
+		Param(boneful.QueryParameter("fields", "only these fields, for json, text and csv (comma-separated; state is computed)").DataType("string").Required(false)).
+		Produces("application/json", "text/plain", "text/csv", "text/plain; version=0.0.4").
+		Returns(http.StatusBadRequest, "The format or a filter was invalid.", nil).
 		Returns(http.StatusInternalServerError, "There is a major service problem.", nil).
 		Operation("statusDetail").
 		Writes(registry.StatusBlock{registry.StatusItem{
@@ -233,14 +421,75 @@ func (v *Vasco) CreateStatusService() *bone.Mux {
 			"configtype":    "devel",
 			"configversion": "None",
 			"deploytag":     "Branch:master",
+			"inflight":      3,
 			"revision":      "b1b171d",
 			"uptime":        "21h18m0.252103556s",
 		}}))
 
+	svc.Route(svc.GET("/status/dashboard").To(v.statusDashboard).
+		Doc("An HTML dashboard showing the overall state and each service's state, code, version, address, disabled flag, expected and unexpected marks and recent history. It refreshes itself every 10 seconds from the other status endpoints.").
+		Operation("statusDashboard").
+		Produces("text/html"))
+
+	svc.Route(svc.GET("/status/history/:name").To(v.statusHistory).
+		Doc("Returns the recent status history of every instance of a service: its current state and how long it has been in it, its state transitions, and the percentage of status checks that found it up over the last 1h, 6h and 24h. Each instance keeps the last STATUS_HISTORY (default 1440) results, and is forgotten 25 hours after it was last seen.").
+		Param(boneful.PathParameter("name", "the service name").DataType("string")).
+		Returns(http.StatusNotFound, "There is no history for that name.", nil).
+		Operation("statusHistory").
+		Produces("application/json").
+		Writes(registry.ServiceHistory{
+			Name: "user",
+			Instances: []*registry.InstanceHistory{{
+				Address:      "http://10.0.0.5:8080",
+				State:        "up",
+				Since:        time.Date(2016, 3, 1, 12, 5, 0, 0, time.UTC),
+				SinceSeconds: 3300,
+				Samples:      120,
+				Availability: map[string]float64{"1h": 98.3, "6h": 99.7, "24h": 99.7},
+				Transitions: []registry.Transition{
+					{Time: time.Date(2016, 3, 1, 12, 4, 0, 0, time.UTC), From: "up", To: "down"},
+					{Time: time.Date(2016, 3, 1, 12, 5, 0, 0, time.UTC), From: "down", To: "up"},
+				},
+			}},
+		}))
+
+	svc.Route(svc.POST("/alerts/test").To(v.testAlerts).
+		Doc("Sends a test alert to every webhook in ALERT_WEBHOOKS and returns the result for each one. Alerts are also sent whenever an instance goes down or comes back up, an expected service goes missing or comes back, or an unexpected service appears; ALERT_DEBOUNCE holds back repeated changes to the same instance.").
+		Operation("testAlerts").
+		Produces("application/json").
+		Writes(map[string]string{"json:http://localhost:8082/alerts/sink": "ok"}))
+
+	svc.Route(svc.POST("/alerts/sink").To(v.alertSink.receive).
+		Doc("Accepts alerts from a json webhook and remembers the last 100, so that webhooks can be tried out without an external service.").
+		Operation("receiveAlerts").
+		Consumes("application/json").
+		Reads(map[string][]Alert{"alerts": {}}).
+		Returns(http.StatusBadRequest, "The alerts were invalid.", nil))
+
+	svc.Route(svc.GET("/alerts/sink").To(v.alertSink.list).
+		Doc("Returns the alerts received by the sink.").
+		Operation("listAlerts").
+		Produces("application/json").
+		Writes([]Alert{{
+			Time:    time.Date(2016, 3, 1, 12, 4, 0, 0, time.UTC),
+			Event:   AlertDown,
+			Name:    "user",
+			Address: "http://10.0.0.5:8080",
+			From:    "up",
+			To:      "down",
+			Message: "user at http://10.0.0.5:8080 is down.",
+		}}))
+
 	svc.Route(svc.GET("/status/summary").To(v.statusSummary).
-		Doc("Generates summarized status information.").
-		Produces("text/plain").
+		Doc("Generates summarized status information, as a text table unless another format is asked for.").
+		Param(boneful.QueryParameter("format", "json, text, csv or prometheus; if it's missing, the Accept header decides").DataType("string").Required(false)).
+		Param(boneful.QueryParameter("name", "only these services (comma-separated)").DataType("string").Required(false)).
+		Param(boneful.QueryParameter("state", "only items in these states: up, failing, down or missing (comma-separated)").DataType("string").Required(false)).
+		Param(boneful.QueryParameter("unexpected", "true for only unexpected services, false for only expected ones").DataType("string").Required(false)).
+		Param(boneful.QueryParameter("fields", "only these fields, for json, text and csv (comma-separated; state is computed)").DataType("string").Required(false)).
+		Produces("text/plain", "application/json", "text/csv", "text/plain; version=0.0.4").
 		Writes("  State   Code                        Ver  Name").
+		Returns(http.StatusBadRequest, "The format or a filter was invalid.", nil).
 		Returns(http.StatusInternalServerError, "There is a major service problem.", nil).
 		Operation("statusSummary"))
 
@@ -267,15 +516,71 @@ func (f MatchingReverseProxy) ServeHTTP(w http.ResponseWriter, req *http.Request
 	// if it's just an options request, we don't need to do anything
 	// and can short-circuit the response
 	if req.Method == "OPTIONS" {
-		log.Printf("Access-Control-Request-Headers: %s", req.Header["Access-Control-Request-Headers"])
+		vascoLog.Debug("options request", "path", req.URL.Path, "headers", req.Header.Get("Access-Control-Request-Headers"))
 		return
 	}
 
-	t := time.Now()
-	f.H.ServeHTTP(w, req)
-	dt := time.Now().Sub(t) / time.Microsecond
+	start := time.Now()
+	id := f.V.requestID(w, req)
+	req = withClientIP(req, f.V.forwarding.clientIP(req))
+	ctx, span := f.V.tracer.Start(tracing.Extract(req.Context(), req.Header), "proxy "+req.Method, tracing.KindServer)
+	span.SetAttributes("http.method", req.Method, "http.target", req.URL.RequestURI(),
+		"http.client_ip", clientIP(req), "vasco.request_id", id)
+	req = withRequestID(req.WithContext(ctx), id)
+	rec := newResponseRecorder(w)
+	var route *proxyRoute
+	// deferred, like done below, because the reverse proxy panics with
+	// http.ErrAbortHandler when the client goes away mid-response
+	defer func() {
+		span.SetAttributes("http.status_code", rec.status)
+		if rec.status >= 500 {
+			span.SetStatus(tracing.StatusError, http.StatusText(rec.status))
+		}
+		span.End()
+		logAccess("proxy", req, rec, start, route)
+	}()
+
+	// we route here rather than in the director so that we know (and can
+	// log) where the request went
+	_, routeSpan := f.V.tracer.Start(ctx, "route", tracing.KindInternal)
+	upstream := *req.URL
+	reg, done, err := f.V.registry.Acquire(ctx, &upstream, f.V.admitRequest(req))
+	if limited, ok := err.(*rateLimitError); ok {
+		// the rate limit is checked before a slot is taken, so a client
+		// that's over it can't tie up (or queue for) room it won't use
+		routeSpan.SetAttributes("vasco.registration", limited.reg.Name, "vasco.hash", limited.reg.Hash())
+		routeSpan.End()
+		span.SetAttributes("vasco.rate_limited", true)
+		writeRateLimited(rec, limited.reg, limited.wait)
+	} else if err != nil {
+		routeSpan.SetError(err)
+		routeSpan.End()
+		writeRouteError(rec, err)
+	} else {
+		defer done()
+		route = &proxyRoute{reg: reg, url: &upstream, vars: reg.HeaderVars()}
+		route.vars["client_ip"] = clientIP(req)
+		route.vars["request_id"] = id
+		route.vars["host"] = req.Host
+		route.vars["path"] = req.URL.Path
+		routeSpan.SetAttributes("vasco.registration", reg.Name, "vasco.hash", reg.Hash(), "http.url", upstream.String())
+		routeSpan.End()
+		f.H.ServeHTTP(rec, withRoute(req, route))
+	}
+}
 
-	log.Printf("%s -> %s: %d uSec", req.RequestURI, req.URL.String(), dt)
+// writeRouteError answers a request that couldn't be routed: either nothing
+// matched it, or everything that did was too busy
+func writeRouteError(rw http.ResponseWriter, err error) {
+	if e, ok := err.(*util.WebError); ok && e.Code == http.StatusServiceUnavailable {
+		util.WriteNewWebError(rw, http.StatusServiceUnavailable, "VAS-116", err.Error())
+		return
+	}
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		util.WriteNewWebError(rw, http.StatusServiceUnavailable, "VAS-116", "The request was given up on while it waited for room.")
+		return
+	}
+	util.WriteNewWebError(rw, http.StatusNotFound, "VAS-114", err.Error())
 }
 
 // NewMatchingReverseProxy returns a new ReverseProxy that rewrites
@@ -283,10 +588,92 @@ func (f MatchingReverseProxy) ServeHTTP(w http.ResponseWriter, req *http.Request
 // rewrite the path as well if that was specified.
 func NewMatchingReverseProxy(v *Vasco) *MatchingReverseProxy {
 	director := func(req *http.Request) {
-		v.registry.RewriteUrl(req.URL)
+		route := routeFrom(req)
+		if route == nil {
+			v.registry.RewriteUrl(req.URL)
+			return
+		}
+		v.forwarding.setHeaders(req, route.url.Path)
+		if route.reg.Headers != nil {
+			route.reg.Headers.Request.Apply(req.Header, route.vars)
+		}
+		req.URL.Scheme = route.url.Scheme
+		req.URL.Host = route.url.Host
+		req.URL.Path = route.url.Path
+		req.URL.RawPath = route.url.RawPath
+		if !v.forwarding.preserveHost {
+			req.Host = route.url.Host
+		}
+	}
+
+	// we've already put the request ID on the response, so a backend that
+	// echoes it mustn't add a second copy
+	modifyResponse := func(resp *http.Response) error {
+		resp.Header.Del(v.requestIDHeader)
+		if route := routeFrom(resp.Request); route != nil && route.reg.Headers != nil {
+			route.reg.Headers.Response.Apply(resp.Header, route.vars)
+		}
+		return nil
+	}
+
+	errorHandler := func(rw http.ResponseWriter, req *http.Request, err error) {
+		fields := []interface{}{"path", req.URL.Path, "request_id", requestIDFrom(req), "err", err}
+		if route := routeFrom(req); route != nil {
+			fields = append(fields, "registration", route.reg.Name, "hash", route.reg.Hash(), "upstream", route.url.String())
+		}
+		vascoLog.Error("proxy error", fields...)
+		rw.WriteHeader(http.StatusBadGateway)
 	}
 
-	return &MatchingReverseProxy{V: v, H: &httputil.ReverseProxy{Director: director}}
+	return &MatchingReverseProxy{V: v, H: &httputil.ReverseProxy{
+		Director:       director,
+		ModifyResponse: modifyResponse,
+		ErrorHandler:   errorHandler,
+		// the upstream call is a child span, and passes the trace on
+		Transport: &tracing.Transport{Tracer: v.tracer, Name: "upstream"},
+	}}
+}
+
+// loadConfig reads the static configuration file and applies any differences
+// to the registry.
+func (v *Vasco) loadConfig(path string) error {
+	cfg, err := registry.LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	v.registry.ApplyConfig(cfg)
+
+	reqs := make(map[string]*registry.Requirement)
+	for _, req := range cfg.Requirements {
+		reqs[req.Name] = req
+	}
+	v.reqMutex.Lock()
+	v.requirements = reqs
+	v.reqMutex.Unlock()
+	return nil
+}
+
+// configRequirements returns the strict status requirements from the
+// configuration file.
+func (v *Vasco) configRequirements() map[string]*registry.Requirement {
+	v.reqMutex.RLock()
+	defer v.reqMutex.RUnlock()
+	return v.requirements
+}
+
+// goroutine that reloads the static configuration whenever we get a SIGHUP;
+// a configuration that fails to load leaves the previous one in place.
+func (v *Vasco) reloadOnHangup(path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		vascoLog.Info("SIGHUP: reloading configuration", "path", path)
+		if err := v.loadConfig(path); err != nil {
+			vascoLog.Error("couldn't reload configuration; keeping the old one", "path", path, "err", err)
+			continue
+		}
+		v.refreshStatusSoon()
+	}
 }
 
 // goroutine that does a ListenAndServe and reports any errors on the error channel
@@ -303,59 +690,106 @@ func getEnvWithDefault(name, def string) string {
 }
 
 func main() {
+	if err := configureLogging(); err != nil {
+		log.Fatalf("Invalid logging configuration: %s", err.Error())
+	}
+
 	var kindOfCache string
 	var proxyPort string = getEnvWithDefault("VASCO_PROXY", "8080")
 	var registryPort string = getEnvWithDefault("VASCO_REGISTRY", "8081")
 	var statusPort string = getEnvWithDefault("VASCO_STATUS", "8082")
 	var staticPath string = getEnvWithDefault("STATIC_PATH", "")
 	var expectedServices string = getEnvWithDefault("EXPECTED_SERVICES", "")
+	// REDIS_ADDR is host:port or a URL; see cache.ParseRedisURL for the forms
 	var redisAddr string = getEnvWithDefault("REDIS_ADDR", "")
+	var configFile string = getEnvWithDefault("VASCO_CONFIG", "")
+	var cacheDir string = getEnvWithDefault("CACHE_DIR", "")
 
 	flag.StringVar(&registryPort, "registryport", registryPort, "The registry (management) port.")
 	flag.StringVar(&proxyPort, "proxyport", proxyPort, "The proxy (forwarding) port.")
 	flag.StringVar(&statusPort, "statusport", statusPort, "The status port.")
-	flag.StringVar(&kindOfCache, "cache", "memory", "Specify the type of cache: memory or redis")
+	flag.StringVar(&kindOfCache, "cache", "memory", "Specify the type of cache: memory, redis or bolt")
+	flag.StringVar(&cacheDir, "cachedir", cacheDir, "A directory where the memory cache persists its data (if empty, it isn't persisted) and the bolt cache keeps its database.")
+	flag.StringVar(&configFile, "config", configFile, "A YAML or JSON file of static registrations; reloaded on SIGHUP.")
 	flag.Parse()
 
 	var err error
 	if _, err = url.Parse(redisAddr); redisAddr != "" && err == nil {
 		kindOfCache = "redis"
-		log.Printf("kindOfCache: %s", kindOfCache)
-		log.Printf("redisAddr: %s", redisAddr)
+		vascoLog.Info("using redis, since REDIS_ADDR is set", "cache", kindOfCache)
 	}
 
 	var v *Vasco
 	switch kindOfCache {
 	case "redis":
-		v = NewVasco(cache.NewRedisCache(redisAddr), staticPath, expectedServices)
+		c, err := cache.NewRedisCacheFromURL(redisAddr)
+		if err != nil {
+			fatal("unable to connect to redis", "err", err)
+		}
+		v = NewVasco(c, staticPath, expectedServices)
 	case "memory":
-		v = NewVasco(cache.NewLocalCache(), staticPath, expectedServices)
+		if cacheDir == "" {
+			v = NewVasco(cache.NewLocalCache(), staticPath, expectedServices)
+			break
+		}
+		snapshotTime, _ := strconv.Atoi(getEnvWithDefault("SNAPSHOT_TIME", "300"))
+		c, err := cache.NewPersistentLocalCache(cacheDir, time.Duration(snapshotTime)*time.Second)
+		if err != nil {
+			fatal("unable to load the cache", "dir", cacheDir, "err", err)
+		}
+		vascoLog.Info("memory cache persisted", "dir", cacheDir)
+		v = NewVasco(c, staticPath, expectedServices)
+	case "bolt":
+		boltFile := filepath.Join(cacheDir, "vasco.db")
+		c, err := cache.NewBoltCache(boltFile)
+		if err != nil {
+			fatal("unable to open the bolt cache", "path", boltFile, "err", err)
+		}
+		vascoLog.Info("bolt cache opened", "path", boltFile)
+		v = NewVasco(c, staticPath, expectedServices)
 	default:
-		panic("Valid cache types are 'memory' and 'redis'")
+		panic("Valid cache types are 'memory', 'redis' and 'bolt'")
 	}
 
+	if configFile != "" {
+		if err := v.loadConfig(configFile); err != nil {
+			fatal("invalid configuration", "path", configFile, "err", err)
+		}
+		go v.reloadOnHangup(configFile)
+	}
+
+	// close the cache cleanly on shutdown so that a persistent cache can
+	// write its final snapshot
+	go func() {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		vascoLog.Info("shutting down", "signal", (<-stop).String())
+		v.tracer.Shutdown()
+		v.cache.Close()
+		os.Exit(0)
+	}()
+
 	registryMux := v.CreateRegistryService()
 	statusMux := v.CreateStatusService()
 
 	// wait a few seconds to let clients find us and then start requesting and watching status
 	statusTime, _ := strconv.Atoi(getEnvWithDefault("STATUS_TIME", "60"))
-	v.statusTimer = NewLoopTimer(250*time.Millisecond, time.Duration(statusTime)*time.Second, v.statusUpdate)
-	v.statusTimer.AtMost(10 * time.Second)
+	v.startStatusTimer(time.Duration(statusTime)*time.Second, 10*time.Second)
 
 	serverErrors := make(chan error)
 
-	log.Printf("reverse proxy listening on port %s", proxyPort)
+	vascoLog.Info("reverse proxy listening", "port", proxyPort)
 	forwarder := &http.Server{Addr: ":" + proxyPort, Handler: NewMatchingReverseProxy(v)}
 	go LandS(forwarder, serverErrors)
 
-	log.Printf("status system listening on port %s", statusPort)
+	vascoLog.Info("status system listening", "port", statusPort)
 	statuser := &http.Server{Addr: ":" + statusPort, Handler: statusMux}
 	go LandS(statuser, serverErrors)
 
-	log.Printf("registry listening on port %s", registryPort)
+	vascoLog.Info("registry listening", "port", registryPort)
 	server := &http.Server{Addr: ":" + registryPort, Handler: registryMux}
 	go LandS(server, serverErrors)
 
 	err = <-serverErrors
-	log.Fatal(err)
+	fatal("server failed", "err", err)
 }
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -8,9 +12,16 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/AchievementNetwork/vasco/cache"
+	"github.com/AchievementNetwork/vasco/logger"
+	"github.com/AchievementNetwork/vasco/registry"
+	"github.com/AchievementNetwork/vasco/tracing"
 	"github.com/go-zoo/bone"
 	"github.com/stretchr/testify/assert"
 )
@@ -67,3 +78,801 @@ func TestSaveDocs(t *testing.T) {
 	io.Copy(f, w2.Body)
 	f.Close()
 }
+
+func TestStatusSummary(t *testing.T) {
+	block := registry.StatusBlock{
+		registry.StatusItem{"Name": "user", "Address": "http://1.1.1.1:8080", "StatusCode": 200},
+		registry.StatusItem{"Name": "user", "Address": "http://1.1.1.2:8080", "StatusCode": 500},
+		registry.StatusItem{"Name": "tags", "Address": "http://1.1.1.3:8080", "StatusCode": 503, "Error": "GET failed", "disabled": true},
+		registry.StatusItem{"Name": "extra", "Address": "http://1.1.1.4:8080", "StatusCode": 200, "unexpected": true},
+	}
+	rules := &StatusRules{
+		Critical:     map[string]int{},
+		Missing:      StateCritical,
+		DegradedCode: http.StatusOK,
+		CriticalCode: http.StatusServiceUnavailable,
+	}
+	sum := rules.Summarize(block, nil)
+	assert.Equal(t, StateDegraded, sum.State)
+	assert.Equal(t, 2, sum.Up)
+	assert.Equal(t, 1, sum.Failing)
+	assert.Equal(t, 1, sum.Down)
+	assert.Equal(t, 1, sum.Unexpected)
+	assert.Equal(t, 2, len(sum.Problems))
+	assert.Equal(t, http.StatusOK, rules.Code(sum))
+
+	// too few healthy instances of a critical service
+	rules.Critical["user"] = 2
+	sum = rules.Summarize(block, nil)
+	assert.Equal(t, StateCritical, sum.State)
+	assert.Equal(t, http.StatusServiceUnavailable, rules.Code(sum))
+
+	// a missing service is only as bad as the rules say
+	rules.Critical = map[string]int{}
+	rules.Missing = StateDegraded
+	block = append(block, registry.StatusItem{"Name": "assess", "StatusCode": 503, "Error": "Expected service not found.", "missing": true})
+	sum = rules.Summarize(block, nil)
+	assert.Equal(t, StateDegraded, sum.State)
+	assert.Equal(t, 1, sum.Missing)
+
+	sum = rules.Summarize(registry.StatusBlock{}, errors.New("connection refused"))
+	assert.Equal(t, StateDegraded, sum.State)
+	assert.Equal(t, StateDegraded, sum.Cache)
+}
+
+func TestStatusGeneral(t *testing.T) {
+	v.lastStatus = registry.StatusBlock{
+		registry.StatusItem{"Name": "user", "Address": "http://1.1.1.1:8080", "StatusCode": 200},
+		registry.StatusItem{"Name": "assess", "StatusCode": 503, "Error": "Expected service not found.", "missing": true},
+	}
+	defer func() { v.lastStatus = nil }()
+
+	req, _ := http.NewRequest("GET", "/status", nil)
+	w := httptest.NewRecorder()
+	statusmux.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	var sum StatusSummary
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &sum))
+	assert.Equal(t, StateCritical, sum.State)
+	assert.Equal(t, 1, sum.Up)
+	assert.Equal(t, 1, sum.Missing)
+}
+
+func TestStatusStrict(t *testing.T) {
+	v.lastStatus = registry.StatusBlock{
+		registry.StatusItem{"Name": "user", "Address": "http://1.1.1.1:8080", "StatusCode": 200, "revision": "abc"},
+		registry.StatusItem{"Name": "user", "Address": "http://1.1.1.2:8080", "StatusCode": 200, "revision": "abc"},
+		registry.StatusItem{"Name": "user", "Address": "http://1.1.1.3:8080", "Error": "GET failed"},
+		registry.StatusItem{"Name": "tags", "Address": "http://1.1.1.4:8080", "StatusCode": 200, "deploytag": "Branch:master"},
+	}
+	defer func() { v.lastStatus = nil }()
+
+	strict := func(query string) (int, StrictResult) {
+		req, _ := http.NewRequest("GET", "/status/strict"+query, nil)
+		w := httptest.NewRecorder()
+		statusmux.ServeHTTP(w, req)
+		var result StrictResult
+		json.Unmarshal(w.Body.Bytes(), &result)
+		return w.Code, result
+	}
+
+	// by default, the instance that's down is a problem
+	code, result := strict("")
+	assert.Equal(t, http.StatusInternalServerError, code)
+	assert.False(t, result.OK)
+	assert.Equal(t, []Violation{{Service: "user", Address: "http://1.1.1.3:8080",
+		Requirement: "healthy", Expected: "up", Actual: "down"}}, result.Violations)
+
+	// unless two healthy instances are enough
+	code, result = strict("?min=user:2&revision=user:abc&deploytag=tags:Branch:master")
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, result.OK)
+
+	code, result = strict("?min=user:3,tags:1&deploytag=tags:Branch:release")
+	assert.Equal(t, http.StatusInternalServerError, code)
+	assert.Equal(t, 2, len(result.Violations))
+	assert.Equal(t, "deploytag", result.Violations[0].Requirement)
+	assert.Equal(t, "min", result.Violations[1].Requirement)
+	assert.Equal(t, "2", result.Violations[1].Actual)
+
+	code, _ = strict("?min=user")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// an item without a status code is failing, not a panic
+	v.lastStatus = registry.StatusBlock{registry.StatusItem{"Name": "odd"}}
+	code, result = strict("")
+	assert.Equal(t, http.StatusInternalServerError, code)
+	assert.Equal(t, "failing", result.Violations[0].Actual)
+}
+
+// recordingNotifier keeps the alerts it's sent
+type recordingNotifier struct {
+	alerts []Alert
+}
+
+func (n *recordingNotifier) Notify(alerts []Alert) error {
+	n.alerts = append(n.alerts, alerts...)
+	return nil
+}
+
+func (n *recordingNotifier) String() string {
+	return "recording"
+}
+
+func TestAlerter(t *testing.T) {
+	n := &recordingNotifier{}
+	a := NewAlerter([]Notifier{n}, time.Minute)
+	a.send = func(n Notifier, alerts []Alert) { n.Notify(alerts) }
+
+	up := registry.StatusItem{"Name": "user", "Address": "http://1.1.1.1:8080", "StatusCode": 200}
+	down := registry.StatusItem{"Name": "user", "Address": "http://1.1.1.1:8080", "StatusCode": 503, "Error": "GET failed", "disabled": true}
+	missing := registry.StatusItem{"Name": "tags", "StatusCode": 503, "Error": "Expected service not found.", "missing": true}
+	tags := registry.StatusItem{"Name": "tags", "Address": "http://1.1.1.2:8080", "StatusCode": 200}
+	extra := registry.StatusItem{"Name": "extra", "Address": "http://1.1.1.3:8080", "StatusCode": 200, "unexpected": true}
+
+	now := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+	// the first status is only remembered
+	a.Observe(registry.StatusBlock{up, missing}, now)
+	assert.Equal(t, 0, len(n.alerts))
+
+	now = now.Add(time.Minute)
+	a.Observe(registry.StatusBlock{down, tags, extra}, now)
+	if assert.Equal(t, 3, len(n.alerts)) {
+		assert.Equal(t, AlertUnexpected, n.alerts[0].Event)
+		assert.Equal(t, AlertPresent, n.alerts[1].Event)
+		assert.Equal(t, AlertDown, n.alerts[2].Event)
+		assert.Equal(t, "down", n.alerts[2].To)
+	}
+
+	// flapping back and forth within the debounce time isn't reported...
+	n.alerts = nil
+	a.Observe(registry.StatusBlock{up, tags, extra}, now.Add(10*time.Second))
+	a.Observe(registry.StatusBlock{down, tags, extra}, now.Add(20*time.Second))
+	a.Observe(registry.StatusBlock{down, tags, extra}, now.Add(2*time.Minute))
+	assert.Equal(t, 0, len(n.alerts))
+
+	// ...but a change that sticks is, once the debounce time is up
+	a.Observe(registry.StatusBlock{up, tags, extra}, now.Add(2*time.Minute+10*time.Second))
+	assert.Equal(t, 1, len(n.alerts))
+	assert.Equal(t, AlertUp, n.alerts[0].Event)
+
+	a.Observe(registry.StatusBlock{up, missing, extra}, now.Add(5*time.Minute))
+	assert.Equal(t, 2, len(n.alerts))
+	assert.Equal(t, AlertMissing, n.alerts[1].Event)
+}
+
+func TestAlerterFlushTimer(t *testing.T) {
+	n := &recordingNotifier{}
+	a := NewAlerter([]Notifier{n}, time.Minute)
+	a.send = func(n Notifier, alerts []Alert) { n.Notify(alerts) }
+	var wait time.Duration
+	var fire func()
+	a.after = func(d time.Duration, f func()) *time.Timer {
+		wait, fire = d, f
+		return time.NewTimer(time.Hour)
+	}
+
+	up := registry.StatusItem{"Name": "user", "Address": "http://1.1.1.1:8080", "StatusCode": 200}
+	down := registry.StatusItem{"Name": "user", "Address": "http://1.1.1.1:8080", "StatusCode": 503, "Error": "GET failed"}
+	now := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+	a.Observe(registry.StatusBlock{up}, now)
+	a.Observe(registry.StatusBlock{down}, now.Add(time.Minute))
+	assert.Equal(t, 1, len(n.alerts))
+	assert.Nil(t, fire)
+
+	// a recovery inside the debounce window is held, but sent when the
+	// window ends even if there's no status update then
+	a.Observe(registry.StatusBlock{up}, now.Add(time.Minute+10*time.Second))
+	assert.Equal(t, 1, len(n.alerts))
+	if assert.NotNil(t, fire) {
+		assert.Equal(t, 50*time.Second, wait)
+		fire()
+	}
+	if assert.Equal(t, 2, len(n.alerts)) {
+		assert.Equal(t, AlertUp, n.alerts[1].Event)
+	}
+}
+
+func TestAlertOnRecovery(t *testing.T) {
+	// the backend drops the connection while it's failing, like a server
+	// that's gone away
+	var failing int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Write([]byte(`{"revision": "abc"}`))
+	}))
+	defer backend.Close()
+
+	lc := cache.NewLocalCache()
+	defer lc.Close()
+	r := registry.NewRegistry(lc, "", "", 60)
+	r.Register(registry.NewRegFromJSON(fmt.Sprintf(`{"name": "flaky", "address": "%s", "pattern": "/flaky", "status": {"path": "/status"}}`, backend.URL)), true)
+
+	n := &recordingNotifier{}
+	a := NewAlerter([]Notifier{n}, 0)
+	a.send = func(n Notifier, alerts []Alert) { n.Notify(alerts) }
+	now := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+	observe := func() {
+		now = now.Add(time.Minute)
+		a.Observe(r.DetailedStatus(), now)
+	}
+
+	observe()
+	atomic.StoreInt32(&failing, 1)
+	observe()
+	// it's still reported (as down) while it's disabled
+	observe()
+	atomic.StoreInt32(&failing, 0)
+	observe()
+
+	if assert.Equal(t, 2, len(n.alerts)) {
+		assert.Equal(t, AlertDown, n.alerts[0].Event)
+		assert.Equal(t, AlertUp, n.alerts[1].Event)
+		assert.Equal(t, backend.URL, n.alerts[1].Address)
+	}
+	block := r.DetailedStatus()
+	if assert.Equal(t, 1, len(block)) {
+		assert.Equal(t, false, block[0]["disabled"])
+	}
+}
+
+func TestAlertWebhooks(t *testing.T) {
+	sink := &alertSink{}
+	ts := httptest.NewServer(http.HandlerFunc(sink.receive))
+	defer ts.Close()
+
+	var slackBody map[string]string
+	slack := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&slackBody)
+	}))
+	defer slack.Close()
+
+	hook, err := newWebhookNotifier("json", ts.URL)
+	assert.Nil(t, err)
+	slackHook, err := newWebhookNotifier("slack", slack.URL)
+	assert.Nil(t, err)
+	_, err = newWebhookNotifier("xml", slack.URL)
+	assert.NotNil(t, err)
+
+	a := NewAlerter([]Notifier{hook, slackHook}, time.Minute)
+	results := a.Test(time.Now())
+	assert.Equal(t, map[string]string{hook.String(): "ok", slackHook.String(): "ok"}, results)
+	if assert.Equal(t, 1, len(sink.alerts)) {
+		assert.Equal(t, AlertTest, sink.alerts[0].Event)
+	}
+	assert.Equal(t, "This is a test alert from Vasco.", slackBody["text"])
+
+	w := httptest.NewRecorder()
+	sink.list(w, nil)
+	var listed []Alert
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &listed))
+	assert.Equal(t, 1, len(listed))
+}
+
+func TestStatusDashboard(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/status/dashboard", nil)
+	w := httptest.NewRecorder()
+	statusmux.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	page := w.Body.String()
+	assert.Contains(t, page, "<title>Vasco status</title>")
+
+	// it's self-contained: nothing is loaded from anywhere else
+	external := regexp.MustCompile(`(?i)(src|href)\s*=\s*["']?\s*(https?:)?//|@import|url\(\s*["']?(https?:)?//`)
+	assert.Empty(t, external.FindAllString(page, -1))
+
+	// and it keeps itself up to date from the status JSON and each
+	// service's history, relative to where it's served
+	assert.Contains(t, page, `location.pathname.replace(/\/dashboard\/?$/, "")`)
+	assert.Contains(t, page, `getJSON("", showSummary)`)
+	assert.Contains(t, page, `getJSON("/detail", showServices)`)
+	assert.Contains(t, page, `getJSON("/history/" + encodeURIComponent(name)`)
+	assert.Contains(t, page, "setInterval(refresh, REFRESH)")
+}
+
+func TestStatusFormats(t *testing.T) {
+	v.lastStatus = registry.StatusBlock{
+		registry.StatusItem{"Name": "tags", "Address": "http://1.1.1.2:8081", "StatusCode": 503, "Error": "GET failed", "deploytag": "Branch:master"},
+		registry.StatusItem{"Name": "user", "Address": "http://1.1.1.1:8080", "StatusCode": 200, "deploytag": "Branch:master"},
+		registry.StatusItem{"Name": "extra", "Address": "http://1.1.1.3:8080", "StatusCode": 200, "unexpected": true},
+	}
+	defer func() { v.lastStatus = nil }()
+
+	get := func(path string, accept string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		statusmux.ServeHTTP(w, req)
+		return w
+	}
+
+	// the summary is still a table by default
+	w := get("/status/summary", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), " NOT OK    503              Branch:master  tags\n")
+
+	w = get("/status/summary?state=down&fields=Name,state", "application/json")
+	var block registry.StatusBlock
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &block))
+	assert.Equal(t, registry.StatusBlock{registry.StatusItem{"Name": "tags", "state": "down"}}, block)
+
+	w = get("/status/detail?unexpected=false&fields=Name,StatusCode", "text/csv")
+	assert.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, "Name,StatusCode\ntags,503\nuser,200\n", w.Body.String())
+
+	w = get("/status/detail?name=user,extra", "text/plain;version=0.0.4")
+	assert.Contains(t, w.Body.String(), `vasco_service_up{name="user",address="http://1.1.1.1:8080",deploytag="Branch:master",unexpected="false"} 1`)
+	assert.Contains(t, w.Body.String(), `vasco_services{state="up"} 2`)
+	assert.NotContains(t, w.Body.String(), `name="tags"`)
+
+	w = get("/status/detail?format=text&fields=Name", "application/json")
+	assert.Equal(t, "Name\ntags\nuser\nextra\n", w.Body.String())
+
+	assert.Equal(t, http.StatusBadRequest, get("/status/detail?format=xml", "").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/status/detail?state=sideways", "").Code)
+}
+
+func TestPortEndpoints(t *testing.T) {
+	do := func(method string, path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, nil)
+		w := httptest.NewRecorder()
+		registrymux.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/ports").Code)
+	w := do("POST", "/ports?name=user")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var lease registry.PortLease
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &lease))
+	assert.Equal(t, "user", lease.Name)
+	assert.True(t, lease.Port >= registry.DefaultMinPort && lease.Port <= registry.DefaultMaxPort)
+
+	path := fmt.Sprintf("/ports/%d", lease.Port)
+	assert.Equal(t, http.StatusOK, do("GET", path).Code)
+	assert.Equal(t, http.StatusBadRequest, do("PUT", path).Code)
+	assert.Equal(t, http.StatusOK, do("PUT", path+"?name=user").Code)
+
+	// another service can't take the port away
+	w = do("DELETE", path+"?name=tags")
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "VAS-117")
+	assert.Equal(t, http.StatusConflict, do("PUT", path+"?name=tags").Code)
+	assert.Equal(t, http.StatusOK, do("GET", path).Code)
+
+	assert.Equal(t, http.StatusOK, do("DELETE", path+"?name=user").Code)
+	assert.Equal(t, http.StatusNotFound, do("GET", path).Code)
+	assert.Equal(t, http.StatusNotFound, do("PUT", path+"?name=user").Code)
+	assert.Equal(t, http.StatusBadRequest, do("DELETE", "/ports/eighty?name=user").Code)
+}
+
+func TestProxyAccessLog(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer upstream.Close()
+	reg := registry.NewRegFromJSON(fmt.Sprintf(`{"name": "echo", "address": "%s", "pattern": "/echo(/.*)"}`, upstream.URL))
+	hash := v.registry.Register(reg, false)
+	defer v.registry.Unregister(reg)
+
+	var buf bytes.Buffer
+	logger.Configure(&buf, logger.FormatJSON, logger.InfoLevel)
+	defer logger.Configure(os.Stderr, logger.FormatLogfmt, logger.InfoLevel)
+
+	proxy := NewMatchingReverseProxy(v)
+	req, _ := http.NewRequest("GET", "/echo/hello", nil)
+	req.RemoteAddr = "10.0.0.1:5555"
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "/hello", w.Body.String())
+
+	var entry map[string]interface{}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "access", entry["log"])
+	assert.Equal(t, "proxy", entry["server"])
+	assert.Equal(t, "GET", entry["method"])
+	assert.Equal(t, "/echo/hello", entry["path"])
+	assert.Equal(t, float64(200), entry["status"])
+	assert.Equal(t, float64(len("/hello")), entry["bytes"])
+	assert.Equal(t, "echo", entry["registration"])
+	assert.Equal(t, hash, entry["hash"])
+	assert.Equal(t, "10.0.0.1", entry["client"])
+	assert.NotNil(t, entry["latency_ms"])
+
+	// nothing (not even the static path) matches
+	buf.Reset()
+	req, _ = http.NewRequest("GET", "/nowhere", nil)
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	entry = nil
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, float64(404), entry["status"])
+	assert.Nil(t, entry["registration"])
+}
+
+func TestProxyRequestID(t *testing.T) {
+	var seen string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Get("X-Request-Id")
+		// some backends echo it back themselves
+		w.Header().Set("X-Request-Id", seen)
+	}))
+	defer upstream.Close()
+	reg := registry.NewRegFromJSON(fmt.Sprintf(`{"name": "echo", "address": "%s", "pattern": "/echo(/.*)"}`, upstream.URL))
+	v.registry.Register(reg, false)
+	defer v.registry.Unregister(reg)
+
+	var buf bytes.Buffer
+	logger.Configure(&buf, logger.FormatJSON, logger.InfoLevel)
+	defer logger.Configure(os.Stderr, logger.FormatLogfmt, logger.InfoLevel)
+
+	proxy := NewMatchingReverseProxy(v)
+	send := func(id string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		buf.Reset()
+		req, _ := http.NewRequest("GET", "/echo/hello", nil)
+		if id != "" {
+			req.Header.Set("X-Request-Id", id)
+		}
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		// the first line logged for the request
+		var entry map[string]interface{}
+		assert.Nil(t, json.NewDecoder(&buf).Decode(&entry))
+		return w, entry
+	}
+
+	// the client's ID is kept
+	w, entry := send("abc-123")
+	assert.Equal(t, "abc-123", seen)
+	assert.Equal(t, []string{"abc-123"}, w.Header()["X-Request-Id"])
+	assert.Equal(t, "abc-123", entry["request_id"])
+
+	// or we make one up
+	w, entry = send("")
+	assert.Len(t, seen, 32)
+	assert.Equal(t, seen, w.Header().Get("X-Request-Id"))
+	assert.Equal(t, seen, entry["request_id"])
+
+	// including when the client's is unusable
+	w, _ = send("has spaces")
+	assert.Len(t, seen, 32)
+	assert.Equal(t, seen, w.Header().Get("X-Request-Id"))
+
+	// a failed backend is logged with the ID too
+	upstream.Close()
+	w, entry = send("gone-1")
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Equal(t, "gone-1", w.Header().Get("X-Request-Id"))
+	assert.Equal(t, "gone-1", entry["request_id"])
+	assert.Equal(t, "proxy error", entry["msg"])
+}
+
+func TestProxyTracing(t *testing.T) {
+	var traceparent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("Traceparent")
+	}))
+	defer upstream.Close()
+	reg := registry.NewRegFromJSON(fmt.Sprintf(`{"name": "echo", "address": "%s", "pattern": "/echo(/.*)"}`, upstream.URL))
+	v.registry.Register(reg, false)
+	defer v.registry.Unregister(reg)
+
+	var buf bytes.Buffer
+	defer func(tracer *tracing.Tracer) { v.tracer = tracer }(v.tracer)
+	v.tracer = tracing.NewTracer("vasco", &tracing.StdoutExporter{W: &buf})
+	defer v.tracer.Shutdown()
+
+	proxy := NewMatchingReverseProxy(v)
+	req, _ := http.NewRequest("GET", "/echo/hello", nil)
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// the backend is called with the same trace, as a child of our span
+	sc, err := tracing.ParseTraceparent(traceparent)
+	assert.Nil(t, err)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	assert.NotEqual(t, "00f067aa0ba902b7", sc.SpanID.String())
+
+	assert.Nil(t, v.tracer.Flush())
+	spans := make(map[string]map[string]interface{})
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var span map[string]interface{}
+		assert.Nil(t, dec.Decode(&span))
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span["traceId"])
+		spans[span["name"].(string)] = span
+	}
+	assert.Len(t, spans, 3)
+	server := spans["proxy GET"]
+	assert.Equal(t, "00f067aa0ba902b7", server["parentSpanId"])
+	assert.Equal(t, server["spanId"], spans["route"]["parentSpanId"])
+	assert.Equal(t, server["spanId"], spans["upstream"]["parentSpanId"])
+	assert.Equal(t, sc.SpanID.String(), spans["upstream"]["spanId"])
+}
+
+func TestProxyForwarding(t *testing.T) {
+	var seen *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r
+	}))
+	defer upstream.Close()
+	reg := registry.NewRegFromJSON(fmt.Sprintf(`{"name": "echo", "address": "%s", "pattern": "/echo(/.*)"}`, upstream.URL))
+	v.registry.Register(reg, false)
+	defer v.registry.Unregister(reg)
+	upstreamHost := strings.TrimPrefix(upstream.URL, "http://")
+
+	proxy := NewMatchingReverseProxy(v)
+	send := func() {
+		req, _ := http.NewRequest("GET", "http://example.com/echo/hello", nil)
+		req.RemoteAddr = "10.0.0.1:5555"
+		req.Header.Set("X-Forwarded-For", "203.0.113.9")
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("Forwarded", "for=203.0.113.9")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	// by default nobody is trusted, so what the client said is replaced
+	send()
+	assert.Equal(t, "/hello", seen.URL.Path)
+	assert.Equal(t, upstreamHost, seen.Host)
+	assert.Equal(t, "10.0.0.1", seen.Header.Get("X-Forwarded-For"))
+	assert.Equal(t, "example.com", seen.Header.Get("X-Forwarded-Host"))
+	assert.Equal(t, "http", seen.Header.Get("X-Forwarded-Proto"))
+	assert.Equal(t, "80", seen.Header.Get("X-Forwarded-Port"))
+	assert.Equal(t, "/echo", seen.Header.Get("X-Forwarded-Prefix"))
+	assert.Equal(t, "for=10.0.0.1;host=example.com;proto=http", seen.Header.Get("Forwarded"))
+	assert.Equal(t, "1.1 vasco", seen.Header.Get("Via"))
+
+	// from a trusted proxy, we add to what it said
+	os.Setenv("TRUSTED_PROXIES", "10.0.0.0/8 192.168.1.1")
+	os.Setenv("PRESERVE_HOST", "true")
+	defer os.Unsetenv("TRUSTED_PROXIES")
+	defer os.Unsetenv("PRESERVE_HOST")
+	policy, err := loadForwardPolicy()
+	assert.Nil(t, err)
+	defer func(p *forwardPolicy) { v.forwarding = p }(v.forwarding)
+	v.forwarding = policy
+
+	var buf bytes.Buffer
+	logger.Configure(&buf, logger.FormatJSON, logger.InfoLevel)
+	defer logger.Configure(os.Stderr, logger.FormatLogfmt, logger.InfoLevel)
+	send()
+	assert.Equal(t, "example.com", seen.Host)
+	assert.Equal(t, "203.0.113.9, 10.0.0.1", seen.Header.Get("X-Forwarded-For"))
+	assert.Equal(t, "https", seen.Header.Get("X-Forwarded-Proto"))
+	assert.Equal(t, "for=203.0.113.9, for=10.0.0.1;host=example.com;proto=http", seen.Header.Get("Forwarded"))
+	var entry map[string]interface{}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "203.0.113.9", entry["client"])
+
+	os.Setenv("TRUSTED_PROXIES", "10.0.0.0/99")
+	_, err = loadForwardPolicy()
+	assert.NotNil(t, err)
+}
+
+func TestProxyHeaderRules(t *testing.T) {
+	var seen http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header
+		w.Header().Set("Server", "backend/1.0")
+	}))
+	defer upstream.Close()
+	reg := registry.NewRegFromJSON(fmt.Sprintf(`{"name": "echo", "address": "%s", "pattern": "/echo(/.*)",
+		"headers": {
+			"request": {"set": {"X-Service-Name": "{name}", "X-Original": "{host}{path}"}, "remove": ["Cookie"]},
+			"response": {"remove": ["Server"], "add": {"X-Served-By": "{name} {request_id}"}}
+		}}`, upstream.URL))
+	v.registry.Register(reg, false)
+	defer v.registry.Unregister(reg)
+
+	proxy := NewMatchingReverseProxy(v)
+	req, _ := http.NewRequest("GET", "http://example.com/echo/hello", nil)
+	req.Header.Set("Cookie", "secret=1")
+	req.Header.Set("X-Request-Id", "rules-1")
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	assert.Equal(t, "echo", seen.Get("X-Service-Name"))
+	assert.Equal(t, "example.com/echo/hello", seen.Get("X-Original"))
+	assert.Equal(t, "", seen.Get("Cookie"))
+	assert.Equal(t, "", w.Header().Get("Server"))
+	assert.Equal(t, "echo rules-1", w.Header().Get("X-Served-By"))
+}
+
+func TestProxyRateLimit(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	reg := registry.NewRegFromJSON(fmt.Sprintf(`{"name": "limited", "address": "%s", "pattern": "/limited",
+		"rateLimit": {"rate": 0.5, "burst": 2, "key": "header:X-Api-Key"}}`, upstream.URL))
+	v.registry.Register(reg, false)
+	defer v.registry.Unregister(reg)
+
+	proxy := NewMatchingReverseProxy(v)
+	get := func(apiKey string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://example.com/limited", nil)
+		req.Header.Set("X-Api-Key", apiKey)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		return w
+	}
+	assert.Equal(t, http.StatusOK, get("a").Code)
+	assert.Equal(t, http.StatusOK, get("a").Code)
+	w := get("a")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), "VAS-115")
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+	// other keys have their own buckets
+	assert.Equal(t, http.StatusOK, get("b").Code)
+}
+
+func TestProxyConcurrency(t *testing.T) {
+	arrived := make(chan bool)
+	release := make(chan bool)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- true
+		<-release
+	}))
+	defer upstream.Close()
+	reg := registry.NewRegFromJSON(fmt.Sprintf(`{"name": "slow", "address": "%s", "pattern": "/slow", "status": {"path": "/status"},
+		"maxConcurrent": 1}`, upstream.URL))
+	v.registry.Register(reg, false)
+	defer v.registry.Unregister(reg)
+	v.lastStatus = registry.StatusBlock{registry.StatusItem{"Name": "slow", "Address": upstream.URL, "StatusCode": 200, "inflight": 0}}
+	defer func() { v.lastStatus = nil }()
+
+	proxy := NewMatchingReverseProxy(v)
+	get := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://example.com/slow", nil)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		return w
+	}
+	finished := make(chan int)
+	go func() { finished <- get().Code }()
+	<-arrived
+
+	w := get()
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "VAS-116")
+
+	req, _ := http.NewRequest("GET", "/status/detail", nil)
+	w = httptest.NewRecorder()
+	statusmux.ServeHTTP(w, req)
+	var block []map[string]interface{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &block))
+	assert.Equal(t, float64(1), block[0]["inflight"])
+
+	release <- true
+	assert.Equal(t, http.StatusOK, <-finished)
+	assert.Equal(t, 0, v.registry.InFlight(reg.Hash()))
+}
+
+func TestProxyClientGoesAway(t *testing.T) {
+	sent := make(chan bool, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first chunk\n"))
+		w.(http.Flusher).Flush()
+		sent <- true
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+	reg := registry.NewRegFromJSON(fmt.Sprintf(`{"name": "stream", "address": "%s", "pattern": "/stream", "status": {"path": "/status"},
+		"maxConcurrent": 1}`, upstream.URL))
+	v.registry.Register(reg, false)
+	defer v.registry.Unregister(reg)
+
+	// a real server, because that's when the reverse proxy aborts the
+	// handler if it can't finish copying the response
+	proxy := httptest.NewServer(NewMatchingReverseProxy(v))
+	defer proxy.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequest("GET", proxy.URL+"/stream", nil)
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	assert.Nil(t, err)
+	<-sent
+	line := make([]byte, len("first chunk\n"))
+	_, err = io.ReadFull(resp.Body, line)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, v.registry.InFlight(reg.Hash()))
+	cancel()
+	resp.Body.Close()
+
+	// the slot is given back even though the proxy handler was aborted
+	deadline := time.Now().Add(time.Second)
+	for v.registry.InFlight(reg.Hash()) != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, 0, v.registry.InFlight(reg.Hash()))
+}
+
+func TestProxyRateLimitBeforeQueue(t *testing.T) {
+	arrived := make(chan bool)
+	release := make(chan bool)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- true
+		<-release
+	}))
+	defer upstream.Close()
+	reg := registry.NewRegFromJSON(fmt.Sprintf(`{"name": "queued", "address": "%s", "pattern": "/queued", "status": {"path": "/status"},
+		"maxConcurrent": 1, "queueTimeout": 5000, "rateLimit": {"rate": 0.1, "burst": 1}}`, upstream.URL))
+	v.registry.Register(reg, false)
+	defer v.registry.Unregister(reg)
+
+	proxy := NewMatchingReverseProxy(v)
+	get := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://example.com/queued", nil)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		return w
+	}
+	finished := make(chan int)
+	go func() { finished <- get().Code }()
+	<-arrived
+
+	// the slot is taken, but a request that's over its limit is turned away
+	// at once rather than waiting out the queue timeout for it
+	start := time.Now()
+	w := get()
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, 1, v.registry.InFlight(reg.Hash()))
+
+	release <- true
+	assert.Equal(t, http.StatusOK, <-finished)
+	assert.Equal(t, 0, v.registry.InFlight(reg.Hash()))
+}
+
+func TestRegistrationTest(t *testing.T) {
+	reg := registry.NewRegFromJSON(`{"name": "versioned", "address": "http://1.1.1.9:8080", "pattern": "/v1(?P<rest>/.*)",
+		"rewrite": "/v2{rest}", "status": {"path": "/status"}}`)
+	v.registry.Register(reg, false)
+	defer v.registry.Unregister(reg)
+
+	req, _ := http.NewRequest("GET", "/register/test?url=/v1/users/1%3Fx=1", nil)
+	w := httptest.NewRecorder()
+	registrymux.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var result map[string]interface{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, "versioned", result["name"])
+	assert.Equal(t, "/v2{rest}", result["rewrite"])
+	assert.Equal(t, "http://1.1.1.9:8080/v2/users/1?x=1", result["upstream"])
+
+	req, _ = http.NewRequest("GET", "/register/test?url=%25zz", nil)
+	w = httptest.NewRecorder()
+	registrymux.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestRegistrationTestExplain(t *testing.T) {
+	reg := registry.NewRegFromJSON(`{"name": "explained", "address": "http://1.1.1.9:8080", "pattern": "/explained(/.*)",
+		"status": {"path": "/status"}}`)
+	v.registry.Register(reg, false)
+	defer v.registry.Unregister(reg)
+
+	req, _ := http.NewRequest("GET", "/register/test?url=/explained/1&explain=true", nil)
+	w := httptest.NewRecorder()
+	registrymux.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var e registry.Explanation
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &e))
+	assert.Equal(t, "/explained/1", e.Match.Path)
+	assert.Equal(t, registry.StaticNotNeeded, e.Static)
+	assert.Equal(t, "explained", e.Selected.Name)
+	assert.Equal(t, "http://1.1.1.9:8080/1", e.Upstream)
+	assert.Equal(t, 1.0, e.Match.Candidates[0].Probability)
+}